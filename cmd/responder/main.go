@@ -8,22 +8,39 @@ import (
 	"log"
 	"net/http"
 	"os"
+	"time"
 
 	"github.com/rusq/gotsr"
 )
 
+// shutdownTimeout is the time given to the in-flight requests to complete,
+// when the process is terminating.
+const shutdownTimeout = 10 * time.Second
+
 var (
 	addr    = flag.String("addr", ":6060", "http listener address")
 	stop    = flag.Bool("stop", false, "stop running process")
 	status  = flag.Bool("status", false, "process status")
 	pidFile = flag.String("pid", "", "custom PID file")
+	fg      = flag.Bool("fg", false, "run in the foreground")
 )
 
 func main() {
 	flag.Parse()
 
-	// Create a new TSR process
-	p, err := gotsr.New(gotsr.WithPIDFile(*pidFile))
+	// Create a new TSR process.  On -stop, wait for the server to drain
+	// before reporting that the process is stopped.  The child process has no
+	// STDOUT, so its output is redirected to a log file, unless it runs in
+	// the foreground.
+	opts := []gotsr.Option{
+		gotsr.WithPIDFile(*pidFile),
+		gotsr.WithTerminateTimeout(shutdownTimeout + time.Second),
+		gotsr.WithForeground(*fg),
+	}
+	if !*fg {
+		opts = append(opts, gotsr.WithLogFile("responder.log"))
+	}
+	p, err := gotsr.New(opts...)
 	if err != nil {
 		log.Fatal(err)
 	}
@@ -45,11 +62,14 @@ func main() {
 		log.Fatal("already running")
 	}
 
-	// Register a function to be called when the program is terminating.  It is
+	// Create the HTTP server, which will respond to all requests with "OK".
+	srv := newServer(*addr)
+
+	// Register a function to be called when the program is terminating.  It
+	// shuts down the server, letting the in-flight requests complete.  It is
 	// important to add all AtExit functions before calling TSR().
-	p.AtExit(func() {
-		log.Printf("process is terminating")
-	})
+	drained := make(chan struct{})
+	p.AtExit(shutdown(srv, shutdownTimeout, drained))
 
 	// Start the process.  If the process is already running, this will return
 	// an error.
@@ -63,22 +83,19 @@ func main() {
 		// Close removes the PID file with the child's PID.
 		defer p.Close()
 
-		// As we are the child process, we need to redirect the log output to
-		// a file, as there's no STDOUT.
-		f, err := os.Create("responder.log")
-		if err != nil {
-			log.Fatal(err)
-		}
-		defer f.Close()
-		log.SetOutput(f)
-
 		// Writing some info to the log file to indicate that we're alive.
 		log.Printf("this is child with pid: %d, ppid: %d", os.Getpid(), os.Getppid())
 
-		// Start the HTTP server, which will respond to all requests with "OK",
-		// and will terminate if the program is called with -stop flag.
-		if err := responder(context.Background(), *addr); err != nil {
-			log.Printf("http server error: %s", err)
+		// Start the HTTP server, it will be shut down if the program is called
+		// with -stop flag.
+		if err := srv.ListenAndServe(); err != nil {
+			if !errors.Is(err, http.ErrServerClosed) {
+				log.Printf("http server error: %s", err)
+				return
+			}
+			// ListenAndServe returns as soon as the shutdown starts, wait
+			// for the in-flight requests to complete.
+			<-drained
 		}
 	} else {
 		// Write some hints on usage to the STDOUT.
@@ -90,6 +107,13 @@ func main() {
 
 func stopProcess(p *gotsr.Process) error {
 	if err := p.Terminate(); err != nil {
+		// The process has crashed, leaving the PID file behind, it will be
+		// overwritten on the next start.
+		var stale *gotsr.StalePIDError
+		if errors.As(err, &stale) {
+			log.Printf("process %d is not running, stale PID file", stale.PID)
+			return nil
+		}
 		if errors.Is(err, gotsr.ErrNotRunning) {
 			log.Printf("process already stopped")
 			return nil
@@ -101,26 +125,40 @@ func stopProcess(p *gotsr.Process) error {
 }
 
 func printStatus(p *gotsr.Process) error {
-	// Check if the process is running.
-	if running, err := p.IsRunning(); err != nil {
+	st, err := p.Status()
+	if err != nil {
 		if errors.Is(err, gotsr.ErrNotRunning) {
 			log.Printf("process is not running")
 			return nil
 		}
 		return err
-	} else if running {
-		log.Println("process is running")
-	} else {
-		log.Println("process is not running")
 	}
+	log.Printf("process is running, PID=%d, started at %s, uptime %s", st.PID, st.StartedAt.Format(time.RFC3339), st.Uptime.Round(time.Second))
 	return nil
 }
 
-// responder is a simple HTTP server that responds with "OK" to all requests.
-func responder(ctx context.Context, addr string) error {
-	http.Handle("/", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+// newServer returns a simple HTTP server that responds with "OK" to all
+// requests.
+func newServer(addr string) *http.Server {
+	mux := http.NewServeMux()
+	mux.Handle("/", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		w.Header().Add("Content-Type", "text/plain")
 		fmt.Fprintf(w, "OK, PID=%d\n", os.Getpid())
 	}))
-	return http.ListenAndServe(addr, nil)
+	return &http.Server{Addr: addr, Handler: mux}
+}
+
+// shutdown returns the AtExit function that gracefully shuts down the server.
+// It waits for the in-flight requests to complete, but not longer than the
+// timeout, and closes the drained channel once done.
+func shutdown(srv *http.Server, timeout time.Duration, drained chan<- struct{}) func() {
+	return func() {
+		defer close(drained)
+		log.Printf("process is terminating, shutting down the server")
+		ctx, cancel := context.WithTimeout(context.Background(), timeout)
+		defer cancel()
+		if err := srv.Shutdown(ctx); err != nil {
+			log.Printf("server shutdown error: %s", err)
+		}
+	}
 }
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+func Test_shutdown(t *testing.T) {
+	srv := newServer("")
+	// slow down the handler, so that the request is in-flight during the
+	// shutdown.
+	started := make(chan struct{})
+	h := srv.Handler
+	srv.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		close(started)
+		time.Sleep(500 * time.Millisecond)
+		h.ServeHTTP(w, r)
+	})
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go srv.Serve(ln)
+
+	type result struct {
+		body string
+		err  error
+	}
+	res := make(chan result, 1)
+	go func() {
+		resp, err := http.Get("http://" + ln.Addr().String())
+		if err != nil {
+			res <- result{err: err}
+			return
+		}
+		defer resp.Body.Close()
+		body, err := io.ReadAll(resp.Body)
+		res <- result{string(body), err}
+	}()
+	<-started
+
+	drained := make(chan struct{})
+	shutdown(srv, 5*time.Second, drained)()
+	select {
+	case <-drained:
+	default:
+		t.Error("drained is not closed after shutdown")
+	}
+	r := <-res
+	if r.err != nil {
+		t.Fatalf("in-flight request failed: %s", r.err)
+	}
+	if !strings.HasPrefix(r.body, "OK") {
+		t.Errorf("response = %q, want OK", r.body)
+	}
+}
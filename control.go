@@ -0,0 +1,365 @@
+package gotsr
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// defaultNetwork is the network of the control listener, if it is not stored
+// in the PID file, and of the TCP address, set without the network.
+const defaultNetwork = "tcp"
+
+// resolveNetwork returns the network of the control listener, if it is not
+// set with WithControlNetwork: TCP, if the address is set with WithControlAddr
+// or WithNotifyAddr, or listenNetwork otherwise.
+func (p *Process) resolveNetwork() string {
+	if p.controlAddr != "" || p.notifyAddr != "" {
+		return defaultNetwork
+	}
+	return listenNetwork
+}
+
+// ControlMode defines how IsRunning checks that the TSR process is alive, and
+// how Terminate stops it on POSIX.
+type ControlMode int8
+
+const (
+	// ControlSignal checks the process and terminates it with signals.  It's
+	// the default.
+	ControlSignal ControlMode = iota
+	// ControlSocket checks the process with the "ok" command, and terminates
+	// it with the "ex" command sent over the unix socket next to the PID
+	// file, so that the recycled PID of a crashed process is not mistaken
+	// for the running process.  The exiting process is reported as not
+	// running, once it closes the socket.  Reload sends the "reload" command
+	// over the socket as well.  If the socket file has been removed, while
+	// the process is running, Terminate and Reload fall back to the signals.
+	// It's the only mode on Windows, where it makes the control listener use
+	// the unix socket.
+	ControlSocket
+)
+
+// WithControlSocket sets the control mode of the TSR process, that is stored
+// in the PID file.  ControlSocket requires the "unix" network, and sets it.
+func WithControlSocket(mode ControlMode) Option {
+	return func(p *Process) {
+		p.controlMode = mode
+		if mode == ControlSocket {
+			p.network = "unix"
+		}
+	}
+}
+
+// WithControlAddr sets the loopback address of the TCP control listener,
+// "host:port" or "host:first-last" for the first free port of the range, and
+// selects the "tcp" network, unless another is set.  Without WithControlToken,
+// the TSR process refuses the commands, that act on it, with ErrNotPermitted,
+// as any local user can connect.
+func WithControlAddr(addr string) Option {
+	return func(p *Process) {
+		p.controlAddr = addr
+	}
+}
+
+// validateControlAddr checks that the control address is a loopback address
+// with a port or a port range, and that the network is TCP.
+func validateControlAddr(addr, network string) error {
+	if addr == "" {
+		return nil
+	}
+	if network == "unix" {
+		return errors.New("control address can't be set for the unix network")
+	}
+	host, _, _, err := parseControlAddr(addr)
+	if err != nil {
+		return fmt.Errorf("invalid control address %q: %w", addr, err)
+	}
+	if ip := net.ParseIP(host); host != "localhost" && (ip == nil || !ip.IsLoopback()) {
+		return fmt.Errorf("invalid control address %q: must be a loopback address", addr)
+	}
+	return nil
+}
+
+// parseControlAddr parses the control address "host:port" or
+// "host:first-last".  For the single port, first and last are equal.
+func parseControlAddr(addr string) (host string, first, last int, err error) {
+	host, ports, err := net.SplitHostPort(addr)
+	if err != nil {
+		return "", 0, 0, err
+	}
+	sFirst, sLast, isRange := strings.Cut(ports, "-")
+	if first, err = parsePort(sFirst); err != nil {
+		return "", 0, 0, err
+	}
+	last = first
+	if isRange {
+		if last, err = parsePort(sLast); err != nil {
+			return "", 0, 0, err
+		}
+		if first == 0 || first > last {
+			return "", 0, 0, fmt.Errorf("invalid port range %q", ports)
+		}
+	}
+	return host, first, last, nil
+}
+
+// parsePort parses the port number.
+func parsePort(s string) (int, error) {
+	port, err := strconv.Atoi(s)
+	if err != nil || port < 0 || port > 65535 {
+		return 0, fmt.Errorf("invalid port %q", s)
+	}
+	return port, nil
+}
+
+// isPortRange returns true if the control address has the port range.
+func isPortRange(addr string) bool {
+	_, first, last, err := parseControlAddr(addr)
+	return err == nil && first != last
+}
+
+// validateControlMode checks that the control mode can be used with the
+// network.
+func validateControlMode(mode ControlMode, network string) error {
+	switch mode {
+	case ControlSignal:
+		return nil
+	case ControlSocket:
+		if network != "unix" {
+			return fmt.Errorf("control socket requires the unix network, got %q", network)
+		}
+		return nil
+	default:
+		return fmt.Errorf("invalid control mode: %d", mode)
+	}
+}
+
+// controlTimeout bounds the connection to the control listener and the wait
+// for its response, so that a wedged process does not hang the caller.
+var controlTimeout = 2 * time.Second
+
+// validateNetwork checks that the network is supported by the control
+// listener.
+func validateNetwork(network string) error {
+	switch network {
+	case "tcp", "tcp4", "tcp6", "unix":
+		return nil
+	default:
+		return fmt.Errorf("unsupported control network %q: must be one of tcp, tcp4, tcp6 or unix", network)
+	}
+}
+
+// controlListen starts the control listener on the given network.  TCP
+// listeners are bound to addr, or to a random port on the loopback interface,
+// if addr is empty, while the unix socket is created next to the PID file,
+// its name depends on the stage, so that the parent and the TSR process don't
+// collide.  The socket is accessible to the owner only.
+func controlListen(network, addr string, pidFile string, stg stage) (net.Listener, error) {
+	switch network {
+	case "", "tcp", "tcp4", "tcp6":
+		if addr != "" {
+			return listenRange(nz(network, defaultNetwork), addr)
+		}
+		if network == "tcp6" {
+			return net.Listen(network, "[::1]:0")
+		}
+		return net.Listen(nz(network, defaultNetwork), "127.0.0.1:0")
+	case "unix":
+		path := sockPath(pidFile, stg)
+		if err := removeStaleSocket(path); err != nil {
+			return nil, err
+		}
+		ln, err := net.Listen(network, path)
+		if err != nil {
+			return nil, err
+		}
+		if err := os.Chmod(path, 0600); err != nil {
+			ln.Close()
+			return nil, err
+		}
+		return ln, nil
+	default:
+		return nil, validateNetwork(network)
+	}
+}
+
+// listenRange listens on the first free port of the control address, that
+// may have the port range.
+func listenRange(network, addr string) (net.Listener, error) {
+	host, first, last, err := parseControlAddr(addr)
+	if err != nil {
+		return nil, err
+	}
+	for port := first; port <= last; port++ {
+		var ln net.Listener
+		if ln, err = net.Listen(network, net.JoinHostPort(host, strconv.Itoa(port))); err == nil {
+			return ln, nil
+		}
+	}
+	return nil, fmt.Errorf("failed to listen on the control address %s: %w", addr, err)
+}
+
+// removeStaleSocket removes the socket at path, left by a crashed process.  It
+// returns an error, if the socket is still served.
+func removeStaleSocket(path string) error {
+	conn, err := controlDial("unix", path)
+	if err == nil {
+		conn.Close()
+		return fmt.Errorf("control socket %s is in use", path)
+	}
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// controlDial connects to the control listener at addr on the given network.
+// The empty network is the default network, as the PID files written by the
+// older versions do not store it.
+func controlDial(network, addr string) (net.Conn, error) {
+	return net.DialTimeout(nz(network, defaultNetwork), addr, controlTimeout)
+}
+
+// controlRequest sends the command over conn to the control listener, and
+// returns the response.  It returns ErrUnresponsive, if the listener does
+// not respond in controlTimeout.
+func controlRequest(conn net.Conn, cmd string) (string, error) {
+	if err := conn.SetDeadline(time.Now().Add(controlTimeout)); err != nil {
+		return "", err
+	}
+	resp, err := request(conn, cmd)
+	if err != nil {
+		var ne net.Error
+		if errors.As(err, &ne) && ne.Timeout() {
+			return "", ErrUnresponsive
+		}
+		return "", err
+	}
+	return resp, nil
+}
+
+// pingControl checks that the TSR process with the control listener, recorded
+// in pi, is alive.
+func pingControl(pi PIDInfo) (bool, error) {
+	if pi.Addr == "" {
+		return false, errMissingAddr
+	}
+	conn, err := controlDial(pi.Network, pi.Addr)
+	if err != nil {
+		return false, nil
+	}
+	defer conn.Close()
+	if pi.Secret != "" {
+		if err := authenticate(conn, pi, ""); err != nil {
+			return false, err
+		}
+	}
+	resp, err := controlRequest(conn, cmdOK)
+	if err != nil {
+		if errors.Is(err, ErrUnresponsive) {
+			return false, err
+		}
+		// the connection is dropped by the exiting process.
+		return false, nil
+	}
+	if resp != cmdOK {
+		return false, errInvalidResponse
+	}
+	return true, nil
+}
+
+// exitControl sends the exit command to the TSR process with the control
+// listener, recorded in pi, presenting the token, if the process requires it.
+func exitControl(pi PIDInfo, token string) error {
+	if pi.Addr == "" {
+		return errMissingAddr
+	}
+	conn, err := controlDial(pi.Network, pi.Addr)
+	if err != nil {
+		return &StalePIDError{PID: pi.PID, Addr: pi.Addr}
+	}
+	defer conn.Close()
+	if err := authenticate(conn, pi, token); err != nil {
+		return err
+	}
+	resp, err := controlRequest(conn, cmdExit)
+	if err != nil {
+		return err
+	}
+	if resp != cmdOK {
+		return errInvalidResponse
+	}
+	return nil
+}
+
+// reloadControl sends the reload command to the TSR process with the control
+// listener, recorded in pi, and returns the error of the reload.
+func reloadControl(pi PIDInfo, token string) error {
+	if pi.Addr == "" {
+		return errMissingAddr
+	}
+	conn, err := controlDial(pi.Network, pi.Addr)
+	if err != nil {
+		return &StalePIDError{PID: pi.PID, Addr: pi.Addr}
+	}
+	defer conn.Close()
+	if err := authenticate(conn, pi, token); err != nil {
+		return err
+	}
+	// the reload may take a while, so it's not bound by the control timeout.
+	resp, err := request(conn, cmdReload)
+	if err != nil {
+		return err
+	}
+	if resp != cmdOK {
+		return errors.New(resp)
+	}
+	return nil
+}
+
+// resolveAddr returns the address of the control listener, stored in the PID
+// file, as net.Addr.
+func resolveAddr(network, addr string) (net.Addr, error) {
+	network = nz(network, defaultNetwork)
+	if network == "unix" {
+		return net.ResolveUnixAddr(network, addr)
+	}
+	return net.ResolveTCPAddr(network, addr)
+}
+
+// sockPath returns the path of the unix socket of the control listener for
+// the given PID file and stage.
+func sockPath(pidFile string, stg stage) string {
+	return pidFile + "." + strings.ToLower(stg.String()) + ".sock"
+}
+
+// writeFull writes the whole buf to w.  The connections write all the data or
+// fail, but the writer that returns early without an error is retried, so that
+// the peer does not receive the truncated message.
+func writeFull(w io.Writer, buf []byte) error {
+	for len(buf) > 0 {
+		n, err := w.Write(buf)
+		if err != nil {
+			return err
+		}
+		if n == 0 {
+			return io.ErrShortWrite
+		}
+		buf = buf[n:]
+	}
+	return nil
+}
+
+// nz returns s if it's not empty, or def otherwise.
+func nz(s, def string) string {
+	if s == "" {
+		return def
+	}
+	return s
+}
@@ -0,0 +1,307 @@
+package gotsr
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestWithControlNetwork(t *testing.T) {
+	if _, err := New(WithPIDFile("test.pid"), WithControlNetwork("udp")); err == nil {
+		t.Error("New() expected an error for unsupported network")
+	}
+	p, err := New(WithPIDFile(filepath.Join(t.TempDir(), "test.pid")), WithControlNetwork("tcp4"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ln, err := controlListen(p.network, "", p.pidFile, sRunning)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			conn.Close()
+		}
+	}()
+	host, _, err := net.SplitHostPort(ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ip := net.ParseIP(host); ip == nil || ip.To4() == nil {
+		t.Fatalf("listener address %s is not IPv4", ln.Addr())
+	}
+	if err := writeInfo(p.pidFile, PIDInfo{PID: 12345, Addr: ln.Addr().String(), Network: p.network}, defaultPIDFileMode); err != nil {
+		t.Fatal(err)
+	}
+	pi, err := readInfo(p.pidFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pi.Network != "tcp4" {
+		t.Fatalf("PID file network = %q, want %q", pi.Network, "tcp4")
+	}
+	conn, err := controlDial(pi.Network, pi.Addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+	// dialing the IPv4 address over IPv6 must fail, if the network is used.
+	if conn, err := controlDial("tcp6", pi.Addr); err == nil {
+		conn.Close()
+		t.Error("controlDial() over tcp6 expected an error")
+	}
+}
+
+func TestWithControlAddr(t *testing.T) {
+	tests := []struct {
+		name    string
+		addr    string
+		network string
+		wantErr bool
+	}{
+		{"port", "127.0.0.1:7000", "tcp", false},
+		{"localhost", "localhost:7000", "tcp", false},
+		{"ipv6 loopback", "[::1]:7000", "tcp6", false},
+		{"range", "127.0.0.1:7000-7010", "tcp", false},
+		{"no port", "localhost", "tcp", true},
+		{"all interfaces", "0.0.0.0:7000", "tcp", true},
+		{"external host", "example.com:7000", "tcp", true},
+		{"reversed range", "127.0.0.1:7010-7000", "tcp", true},
+		{"random port range", "127.0.0.1:0-7000", "tcp", true},
+		{"invalid port", "127.0.0.1:70000", "tcp", true},
+		{"unix", "127.0.0.1:7000", "unix", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := New(WithPIDFile("test.pid"), WithControlNetwork(tt.network), WithControlAddr(tt.addr))
+			if (err != nil) != tt.wantErr {
+				t.Errorf("New() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+
+	// the free port.
+	free, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := free.Addr().String()
+	free.Close()
+
+	p, err := New(WithPIDFile("test.pid"), WithControlAddr(addr))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ln, err := controlListen(p.network, p.controlAddr, p.pidFile, sRunning)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	if ln.Addr().String() != addr {
+		t.Errorf("listener address = %s, want %s", ln.Addr(), addr)
+	}
+	// the port is busy now.
+	if ln2, err := controlListen(p.network, p.controlAddr, p.pidFile, sRunning); err == nil {
+		ln2.Close()
+		t.Error("controlListen() expected an error for the busy port")
+	} else if !strings.Contains(err.Error(), addr) {
+		t.Errorf("controlListen() error = %v, want the address in it", err)
+	}
+	// the busy port of the range is skipped.
+	_, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	first, _ := strconv.Atoi(port)
+	if first+10 > 65535 {
+		t.Skipf("port %d is at the end of the port range", first)
+	}
+	rangeAddr := fmt.Sprintf("127.0.0.1:%d-%d", first, first+10)
+	ln2, err := controlListen(p.network, rangeAddr, p.pidFile, sRunning)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln2.Close()
+	if got := ln2.Addr().(*net.TCPAddr).Port; got <= first || got > first+10 {
+		t.Errorf("listener port = %d, want in %d-%d", got, first+1, first+10)
+	}
+}
+
+func TestProcess_ControlAddr(t *testing.T) {
+	p, err := New(WithPIDFile(filepath.Join(t.TempDir(), "test.pid")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := p.ControlAddr(); !errors.Is(err, ErrNotRunning) {
+		t.Errorf("ControlAddr() error = %v, want %v", err, ErrNotRunning)
+	}
+	// the PID file of the older version has no address.
+	if err := writePID(p.pidFile, defaultPIDFileMode, 12345); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := p.ControlAddr(); !errors.Is(err, ErrInvalidPIDFile) {
+		t.Errorf("ControlAddr() error = %v, want %v", err, ErrInvalidPIDFile)
+	}
+	const addr = "127.0.0.1:54321"
+	if err := writeInfo(p.pidFile, PIDInfo{PID: 12345, Addr: addr, Network: "tcp"}, defaultPIDFileMode); err != nil {
+		t.Fatal(err)
+	}
+	got, err := p.ControlAddr()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != addr {
+		t.Errorf("ControlAddr() = %q, want %q", got, addr)
+	}
+}
+
+func TestProcess_Addr(t *testing.T) {
+	for _, network := range []string{"tcp", "unix"} {
+		t.Run(network, func(t *testing.T) {
+			p, err := New(WithPIDFile(filepath.Join(t.TempDir(), "test.pid")), WithControlNetwork(network))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, err := p.Addr(); !errors.Is(err, ErrNotRunning) {
+				t.Errorf("Addr() error = %v, want %v", err, ErrNotRunning)
+			}
+			ln, err := controlListen(p.network, "", p.pidFile, sRunning)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer ln.Close()
+			go func() {
+				for {
+					conn, err := ln.Accept()
+					if err != nil {
+						return
+					}
+					conn.Close()
+				}
+			}()
+			if err := writeInfo(p.pidFile, PIDInfo{PID: 12345, Addr: ln.Addr().String(), Network: p.network}, defaultPIDFileMode); err != nil {
+				t.Fatal(err)
+			}
+
+			addr, err := p.Addr()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if addr.Network() != ln.Addr().Network() || addr.String() != ln.Addr().String() {
+				t.Errorf("Addr() = %s %s, want %s %s", addr.Network(), addr, ln.Addr().Network(), ln.Addr())
+			}
+			conn, err := net.Dial(addr.Network(), addr.String())
+			if err != nil {
+				t.Fatal(err)
+			}
+			conn.Close()
+		})
+	}
+	t.Run("no address", func(t *testing.T) {
+		p, err := New(WithPIDFile(filepath.Join(t.TempDir(), "test.pid")))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := writeInfo(p.pidFile, PIDInfo{PID: 12345}, defaultPIDFileMode); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := p.Addr(); !errors.Is(err, ErrNotRunning) {
+			t.Errorf("Addr() error = %v, want %v", err, ErrNotRunning)
+		}
+	})
+}
+
+func Test_controlRequest(t *testing.T) {
+	old := controlTimeout
+	controlTimeout = 100 * time.Millisecond
+	t.Cleanup(func() { controlTimeout = old })
+
+	ln, err := controlListen(defaultNetwork, "", "", sRunning)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		// the wedged process reads the command, but never responds.
+		_, _, _ = readCommand(conn)
+		<-done
+	}()
+	conn, err := controlDial(defaultNetwork, ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if _, err := controlRequest(conn, cmdOK); !errors.Is(err, ErrUnresponsive) {
+		t.Errorf("controlRequest() error = %v, want %v", err, ErrUnresponsive)
+	}
+}
+
+func Test_removeStaleSocket(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test.sock")
+	if err := removeStaleSocket(path); err != nil {
+		t.Errorf("removeStaleSocket() error = %v for the missing socket", err)
+	}
+	ln, err := net.Listen("unix", path)
+	if err != nil {
+		t.Skip(err)
+	}
+	if err := removeStaleSocket(path); err == nil {
+		t.Error("removeStaleSocket() expected an error for the socket in use")
+	}
+	ln.(*net.UnixListener).SetUnlinkOnClose(false)
+	ln.Close()
+	if err := removeStaleSocket(path); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Errorf("stale socket was not removed: %v", err)
+	}
+}
+
+// shortWriter writes at most max bytes at a time without an error.
+type shortWriter struct {
+	w   io.Writer
+	max int
+}
+
+func (s shortWriter) Write(p []byte) (int, error) {
+	if len(p) > s.max {
+		p = p[:s.max]
+	}
+	return s.w.Write(p)
+}
+
+func Test_writeFull(t *testing.T) {
+	msg := []byte(strings.Repeat("ok", 10))
+	var buf bytes.Buffer
+	if err := writeFull(shortWriter{w: &buf, max: 1}, msg); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(buf.Bytes(), msg) {
+		t.Errorf("writeFull() wrote %q, want %q", buf.Bytes(), msg)
+	}
+	// the writer that makes no progress.
+	if err := writeFull(shortWriter{w: &buf, max: 0}, msg); !errors.Is(err, io.ErrShortWrite) {
+		t.Errorf("writeFull() error = %v, want %v", err, io.ErrShortWrite)
+	}
+}
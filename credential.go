@@ -0,0 +1,22 @@
+package gotsr
+
+// WithUser makes the TSR process run as the given user, so that the program
+// started as root, i.e. to bind a privileged port, drops the privileges once
+// detached.  The group of the process is the primary group of the user,
+// unless it's set with WithGroup.  The user must be able to write the PID
+// file.  It has no effect in the launchd mode, where the user is set in the
+// job definition.  New returns an error, if the user does not exist, and
+// ErrNotSupported on Windows.
+func WithUser(username string) Option {
+	return func(p *Process) {
+		p.user = username
+	}
+}
+
+// WithGroup makes the TSR process run with the given group.  New returns an
+// error, if the group does not exist, and ErrNotSupported on Windows.
+func WithGroup(name string) Option {
+	return func(p *Process) {
+		p.group = name
+	}
+}
@@ -0,0 +1,59 @@
+//go:build linux || darwin || freebsd || openbsd || netbsd || dragonfly || solaris || aix
+
+package gotsr
+
+import (
+	"fmt"
+	"os"
+	"os/user"
+	"strconv"
+	"syscall"
+)
+
+// validateCredential checks that the user and the group exist.
+func validateCredential(username, group string) error {
+	_, err := credential(username, group)
+	return err
+}
+
+// credential returns the credential of the TSR process with the given user
+// and group, or nil, if neither is set.  The supplementary groups are
+// cleared, if the launcher runs as root.
+func credential(username, group string) (*syscall.Credential, error) {
+	if username == "" && group == "" {
+		return nil, nil
+	}
+	cred := &syscall.Credential{
+		Uid:         uint32(os.Getuid()),
+		Gid:         uint32(os.Getgid()),
+		NoSetGroups: os.Geteuid() != 0,
+	}
+	if username != "" {
+		u, err := user.Lookup(username)
+		if err != nil {
+			return nil, fmt.Errorf("invalid user %q: %w", username, err)
+		}
+		if cred.Uid, err = parseID(u.Uid); err != nil {
+			return nil, fmt.Errorf("invalid uid of the user %q: %w", username, err)
+		}
+		if cred.Gid, err = parseID(u.Gid); err != nil {
+			return nil, fmt.Errorf("invalid gid of the user %q: %w", username, err)
+		}
+	}
+	if group != "" {
+		g, err := user.LookupGroup(group)
+		if err != nil {
+			return nil, fmt.Errorf("invalid group %q: %w", group, err)
+		}
+		if cred.Gid, err = parseID(g.Gid); err != nil {
+			return nil, fmt.Errorf("invalid gid of the group %q: %w", group, err)
+		}
+	}
+	return cred, nil
+}
+
+// parseID parses the numeric user or group ID.
+func parseID(s string) (uint32, error) {
+	id, err := strconv.ParseUint(s, 10, 32)
+	return uint32(id), err
+}
@@ -0,0 +1,98 @@
+//go:build linux || darwin || freebsd || openbsd || netbsd || dragonfly || solaris || aix
+
+package gotsr
+
+import (
+	"os"
+	"os/user"
+	"path/filepath"
+	"strconv"
+	"testing"
+)
+
+func Test_credential(t *testing.T) {
+	cu, err := user.Current()
+	if err != nil {
+		t.Skip(err)
+	}
+	uid, _ := strconv.Atoi(cu.Uid)
+	gid, _ := strconv.Atoi(cu.Gid)
+	cg, err := user.LookupGroupId(cu.Gid)
+	if err != nil {
+		t.Skip(err)
+	}
+
+	tests := []struct {
+		name     string
+		username string
+		group    string
+		wantNil  bool
+		wantUid  int
+		wantGid  int
+		wantErr  bool
+	}{
+		{"not set", "", "", true, 0, 0, false},
+		{"user", cu.Username, "", false, uid, gid, false},
+		{"group", "", cg.Name, false, os.Getuid(), gid, false},
+		{"user and group", cu.Username, cg.Name, false, uid, gid, false},
+		{"unknown user", "gotsr-no-such-user", "", false, 0, 0, true},
+		{"unknown group", "", "gotsr-no-such-group", false, 0, 0, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cred, err := credential(tt.username, tt.group)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("credential() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+			if (cred == nil) != tt.wantNil {
+				t.Fatalf("credential() = %v, wantNil %v", cred, tt.wantNil)
+			}
+			if cred == nil {
+				return
+			}
+			if int(cred.Uid) != tt.wantUid || int(cred.Gid) != tt.wantGid {
+				t.Errorf("credential() = %d:%d, want %d:%d", cred.Uid, cred.Gid, tt.wantUid, tt.wantGid)
+			}
+		})
+	}
+}
+
+func TestWithUser(t *testing.T) {
+	if _, err := New(WithPIDFile("test.pid"), WithUser("gotsr-no-such-user")); err == nil {
+		t.Error("New() expected an error for unknown user")
+	}
+	if _, err := New(WithPIDFile("test.pid"), WithGroup("gotsr-no-such-group")); err == nil {
+		t.Error("New() expected an error for unknown group")
+	}
+}
+
+func init() {
+	registerHelper(new(userHelper))
+}
+
+// userHelper sets the user of the detached helper.
+type userHelper struct{ User string }
+
+func (f *userHelper) apply(h *helper) error {
+	h.opts = append(h.opts, WithUser(f.User))
+	return nil
+}
+
+func TestWithUser_start(t *testing.T) {
+	cu, err := user.Current()
+	if err != nil {
+		t.Skip(err)
+	}
+	pidFile := filepath.Join(t.TempDir(), "helper.pid")
+	startHelper(t, helperConfig{PIDFile: pidFile}, &userHelper{User: cu.Username})
+	p, err := New(WithPIDFile(pidFile))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if running, err := p.IsRunning(); err != nil || !running {
+		t.Fatalf("IsRunning() = %v, %v, want true", running, err)
+	}
+}
@@ -0,0 +1,10 @@
+package gotsr
+
+// validateCredential returns ErrNotSupported, if the user or the group is
+// set, as the process can't change its credentials on Windows.
+func validateCredential(username, group string) error {
+	if username != "" || group != "" {
+		return ErrNotSupported
+	}
+	return nil
+}
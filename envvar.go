@@ -1,13 +1,130 @@
 package gotsr
 
+import (
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+)
+
+// EnvVarHashLen is the number of the hash characters in the names of the
+// environment variables used by TSR, from 1 to 56.  The longer names make the
+// collisions between the daemons with different PID files less likely, which
+// are detected anyway.  All stages must use the same length, so it should be
+// set before New is called, and not depend on the stage.
+var EnvVarHashLen = 7
+
 // envVar is a unique identifier for the environment variables used by TSR.
 type envVar string
 
 // newEnvVar returns a new unique identifier for the environment variables.
-// It is calculated as the first 7 characters of the SHA1 hash of the given
-// string.
+// It is calculated as the first EnvVarHashLen characters of the SHA-224 hash
+// of the given string.
 func newEnvVar(s string) envVar {
-	return envVar(hash(s)[0:7])
+	h, n := hash(s), EnvVarHashLen
+	if n < 1 || n > len(h) {
+		n = 7
+	}
+	return envVar(h[0:n])
+}
+
+// envIdent returns the string, that the environment variables of the process
+// are derived from: the name of the program, or the PID file name, if it's not
+// set, and the instance name, if it's set.
+func (p *Process) envIdent() string {
+	ident := p.pidFile
+	if p.name != "" {
+		ident = p.name
+	}
+	if p.instance == "" {
+		return ident
+	}
+	return p.instance + ":" + ident
+}
+
+// vars returns the identifier of the environment variables of the process.
+func (p *Process) vars() envVar {
+	return newEnvVar(p.envIdent())
+}
+
+// envKey returns the value of the key environment variable of the process,
+// the full hash of its identifier.
+func (p *Process) envKey() string {
+	return hash(p.envIdent())
+}
+
+// stageEnv returns the stage of the process, set in the environment by the
+// previous stage.  If the variables were set by another daemon, whose
+// variable names collide with ours, the key does not match, and it returns an
+// empty string, as for the launcher.
+func (p *Process) stageEnv() string {
+	vars := p.vars()
+	stg := os.Getenv(vars.stage())
+	if stg != "" && os.Getenv(vars.key()) != p.envKey() {
+		return ""
+	}
+	return stg
+}
+
+// clearForeignEnv unsets the environment variables of the launcher, that were
+// set by another daemon, whose variable names collide with ours, so that they
+// are not passed to the detached process.
+func (p *Process) clearForeignEnv(lg Logger) {
+	for _, name := range p.vars().all() {
+		if _, ok := os.LookupEnv(name); ok {
+			lg.Printf("environment variable %s is set by another program, unsetting it", name)
+			os.Unsetenv(name)
+		}
+	}
+}
+
+// childEnv returns the environment of the detached process: the environment
+// of the current process, and the variables set with WithEnv, that override
+// the variables with the same names, as the last value is used.  The TSR
+// variables are skipped.
+func (p *Process) childEnv() []string {
+	env := os.Environ()
+	if len(p.env) == 0 {
+		return env
+	}
+	names := make([]string, 0, len(p.env))
+	for name := range p.env {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	tsrVars := p.vars().all()
+	for _, name := range names {
+		if isTSRVar(tsrVars, name) {
+			continue
+		}
+		env = append(env, name+"="+p.env[name])
+	}
+	return env
+}
+
+// isTSRVar returns true if name is one of the TSR variables.  The names are
+// compared case-insensitively, as they are on Windows.
+func isTSRVar(tsrVars []string, name string) bool {
+	for _, v := range tsrVars {
+		if strings.EqualFold(v, name) {
+			return true
+		}
+	}
+	return false
+}
+
+// validateEnv checks that the names of the variables, set with WithEnv, are
+// valid.
+func validateEnv(env map[string]string) error {
+	for name, value := range env {
+		if name == "" || strings.ContainsAny(name, "=\x00") {
+			return fmt.Errorf("invalid environment variable name %q", name)
+		}
+		if strings.Contains(value, "\x00") {
+			return fmt.Errorf("invalid value of the environment variable %s: must not contain NUL", name)
+		}
+	}
+	return nil
 }
 
 // stage returns the name of the environment variable that holds the stage.
@@ -19,3 +136,52 @@ func (id envVar) stage() string {
 func (id envVar) pid() string {
 	return "TSR_" + string(id) + "__PID"
 }
+
+// addr returns the name of the environment variable that holds the address
+// of the parent's listener.  It is used to pass the address to the detached
+// process on Windows.
+func (id envVar) addr() string {
+	return "TSR_" + string(id) + "__ADDR"
+}
+
+// listeners returns the name of the environment variable that holds the
+// number of the listeners, passed to the successor on Restart.
+func (id envVar) listeners() string {
+	return "TSR_" + string(id) + "__LNS"
+}
+
+// key returns the name of the environment variable that holds the full hash
+// of the string, that the identifier is derived from, so that the stages can
+// tell their variables from the variables of another daemon.
+func (id envVar) key() string {
+	return "TSR_" + string(id) + "__KEY"
+}
+
+// restarts returns the name of the environment variable that holds the
+// number of the restarts, passed to the TSR process by the supervisor.
+func (id envVar) restarts() string {
+	return "TSR_" + string(id) + "__RST"
+}
+
+// lastExit returns the name of the environment variable that holds the exit
+// status of the crashed TSR process, passed to the restarted one by the
+// supervisor.
+func (id envVar) lastExit() string {
+	return "TSR_" + string(id) + "__LEX"
+}
+
+// exitCode and exitSignal return the names of the environment variables that
+// hold the exit code of the crashed TSR process, and the signal that killed
+// it, passed to the restarted one by the supervisor.
+func (id envVar) exitCode() string {
+	return "TSR_" + string(id) + "__LXC"
+}
+
+func (id envVar) exitSignal() string {
+	return "TSR_" + string(id) + "__LXS"
+}
+
+// all returns the names of all environment variables used by TSR.
+func (id envVar) all() []string {
+	return []string{id.stage(), id.pid(), id.addr(), id.listeners(), id.key(), id.restarts(), id.lastExit(), id.exitCode(), id.exitSignal()}
+}
@@ -0,0 +1,81 @@
+package gotsr
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"math"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// remoteFDStats returns the open file descriptor count and the RLIMIT_NOFILE
+// limits of the TSR process.  On Linux, they are read from /proc, so the
+// process does not need to be involved.
+func remoteFDStats(pidFile, _ string) (open int, soft, hard uint64, err error) {
+	pid, err := readPID(pidFile)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return 0, 0, 0, ErrNotRunning
+		}
+		return 0, 0, 0, err
+	} else if pid == 0 {
+		return 0, 0, 0, ErrNoPID
+	}
+	proc := "/proc/" + strconv.Itoa(pid)
+	fds, err := os.ReadDir(proc + "/fd")
+	if err != nil {
+		if os.IsNotExist(err) {
+			return 0, 0, 0, ErrNotRunning
+		}
+		return 0, 0, 0, err
+	}
+	soft, hard, err = readNoFileLimits(proc + "/limits")
+	if err != nil {
+		return 0, 0, 0, err
+	}
+	return len(fds), soft, hard, nil
+}
+
+// readNoFileLimits reads the soft and hard limits of the open files from the
+// /proc/<pid>/limits file.  Unlimited values are returned as math.MaxUint64.
+func readNoFileLimits(filename string) (soft, hard uint64, err error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer f.Close()
+
+	s := bufio.NewScanner(f)
+	for s.Scan() {
+		line := s.Text()
+		if !strings.HasPrefix(line, "Max open files") {
+			continue
+		}
+		// Max open files  1024  1048576  files
+		fields := strings.Fields(strings.TrimPrefix(line, "Max open files"))
+		if len(fields) < 2 {
+			return 0, 0, fmt.Errorf("invalid limits line: %q", line)
+		}
+		if soft, err = parseLimit(fields[0]); err != nil {
+			return 0, 0, err
+		}
+		if hard, err = parseLimit(fields[1]); err != nil {
+			return 0, 0, err
+		}
+		return soft, hard, nil
+	}
+	if err := s.Err(); err != nil {
+		return 0, 0, err
+	}
+	return 0, 0, errors.New("open files limit not found")
+}
+
+// parseLimit parses the limit value from the limits file.
+func parseLimit(s string) (uint64, error) {
+	if s == "unlimited" {
+		return math.MaxUint64, nil
+	}
+	return strconv.ParseUint(s, 10, 64)
+}
@@ -0,0 +1,143 @@
+package gotsr
+
+import (
+	"fmt"
+	"math"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func init() {
+	registerHelper(new(openFilesHelper))
+}
+
+// openFilesHelper makes the helper open N files on SIGHUP.
+type openFilesHelper struct{ N int }
+
+func (f *openFilesHelper) apply(h *helper) error {
+	h.setup = append(h.setup, func(p *Process) error {
+		// before TSR, so that the handler is in place once the parent
+		// returns.
+		openOnHangup(f.N)
+		return nil
+	})
+	return nil
+}
+
+// openOnHangup opens n files, once the process receives SIGHUP.  The files
+// stay open until the process exits.
+func openOnHangup(n int) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	go func() {
+		<-hup
+		for i := 0; i < n; i++ {
+			if _, err := os.Open(os.Args[0]); err != nil {
+				fmt.Fprintln(os.Stderr, err)
+			}
+		}
+	}()
+}
+
+func TestProcess_RemoteFDStats(t *testing.T) {
+	const openFiles = 10
+
+	pidFile := filepath.Join(t.TempDir(), "helper.pid")
+	startHelper(t, helperConfig{PIDFile: pidFile}, &openFilesHelper{N: openFiles})
+
+	p, err := New(WithPIDFile(pidFile))
+	if err != nil {
+		t.Fatal(err)
+	}
+	before, soft, hard, err := p.RemoteFDStats()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if before == 0 {
+		t.Error("RemoteFDStats() returned zero open descriptors")
+	}
+	if soft == 0 || hard < soft {
+		t.Errorf("RemoteFDStats() limits soft = %d, hard = %d", soft, hard)
+	}
+
+	pid, err := p.PID()
+	if err != nil {
+		t.Fatal(err)
+	}
+	proc, err := os.FindProcess(pid)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := proc.Signal(syscall.SIGHUP); err != nil {
+		t.Fatal(err)
+	}
+	var after int
+	for deadline := time.Now().Add(10 * time.Second); time.Now().Before(deadline); time.Sleep(50 * time.Millisecond) {
+		if after, _, _, err = p.RemoteFDStats(); err != nil {
+			t.Fatal(err)
+		}
+		if after >= before+openFiles {
+			break
+		}
+	}
+	if after < before+openFiles {
+		t.Errorf("RemoteFDStats() open = %d after opening %d files, want at least %d", after, openFiles, before+openFiles)
+	}
+	if err := p.Terminate(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func Test_readNoFileLimits(t *testing.T) {
+	tests := []struct {
+		name     string
+		contents string
+		wantSoft uint64
+		wantHard uint64
+		wantErr  bool
+	}{
+		{
+			"limits",
+			"Limit                     Soft Limit           Hard Limit           Units     \n" +
+				"Max processes             63704                63704                processes \n" +
+				"Max open files            1024                 1048576              files     \n",
+			1024,
+			1048576,
+			false,
+		},
+		{
+			"unlimited",
+			"Max open files            unlimited            unlimited            files     \n",
+			math.MaxUint64,
+			math.MaxUint64,
+			false,
+		},
+		{
+			"missing",
+			"Max processes             63704                63704                processes \n",
+			0,
+			0,
+			true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			filename := filepath.Join(t.TempDir(), "limits")
+			if err := os.WriteFile(filename, []byte(tt.contents), 0666); err != nil {
+				t.Fatal(err)
+			}
+			soft, hard, err := readNoFileLimits(filename)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("readNoFileLimits() error = %v, wantErr %v", err, tt.wantErr)
+				return
+			}
+			if soft != tt.wantSoft || hard != tt.wantHard {
+				t.Errorf("readNoFileLimits() = %d, %d, want %d, %d", soft, hard, tt.wantSoft, tt.wantHard)
+			}
+		})
+	}
+}
@@ -0,0 +1,9 @@
+//go:build !linux && !windows
+
+package gotsr
+
+// remoteFDStats is not supported on this platform, as there's no /proc to
+// read the stats of the other process from.
+func remoteFDStats(pidFile, _ string) (open int, soft, hard uint64, err error) {
+	return 0, 0, 0, ErrNotSupported
+}
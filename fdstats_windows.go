@@ -0,0 +1,76 @@
+package gotsr
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"syscall"
+	"unsafe"
+)
+
+var (
+	kernel32                  = syscall.NewLazyDLL("kernel32.dll")
+	procGetProcessHandleCount = kernel32.NewProc("GetProcessHandleCount")
+)
+
+// handleCount returns the number of open handles of the current process.
+// Windows has no file descriptors, the handle count is the closest
+// approximation.
+func handleCount() (int, error) {
+	var n uint32
+	h, err := syscall.GetCurrentProcess()
+	if err != nil {
+		return 0, err
+	}
+	r, _, err := procGetProcessHandleCount.Call(uintptr(h), uintptr(unsafe.Pointer(&n)))
+	if r == 0 {
+		return 0, err
+	}
+	return int(n), nil
+}
+
+// fdStats returns the payload of the response to the "fd" control command:
+// the handle count and the limits, separated by spaces.  There are no open
+// file limits on Windows, so they are reported as zero.
+func fdStats() (string, error) {
+	n, err := handleCount()
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%d 0 0", n), nil
+}
+
+// remoteFDStats requests the open handle count from the TSR process with the
+// "fd" control command, presenting the control token, if the process requires
+// it.
+func remoteFDStats(pidFile, token string) (open int, soft, hard uint64, err error) {
+	pi, err := readInfo(pidFile)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return 0, 0, 0, ErrNotRunning
+		}
+		return 0, 0, 0, err
+	}
+	if pi.Addr == "" {
+		return 0, 0, 0, errMissingAddr
+	}
+	conn, err := controlDial(pi.Network, pi.Addr)
+	if err != nil {
+		return 0, 0, 0, err
+	}
+	defer conn.Close()
+	if err := authenticate(conn, pi, token); err != nil {
+		return 0, 0, 0, err
+	}
+	resp, err := controlRequest(conn, cmdFDStats)
+	if err != nil {
+		return 0, 0, 0, err
+	}
+	if !strings.HasPrefix(resp, cmdOK) {
+		return 0, 0, 0, errInvalidResponse
+	}
+	if _, err := fmt.Sscan(strings.TrimPrefix(resp, cmdOK), &open, &soft, &hard); err != nil {
+		return 0, 0, 0, fmt.Errorf("invalid response: %w", err)
+	}
+	return open, soft, hard, nil
+}
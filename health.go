@@ -0,0 +1,70 @@
+package gotsr
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// ErrUnhealthy is returned by Health, if the health check of the TSR process
+// fails.  The error of the check follows it.
+var ErrUnhealthy = errors.New("process is unhealthy")
+
+// OnHealth registers the function that checks the health of the program in
+// the TSR process, when it's requested with Health, so that the process that
+// is alive, but does not serve correctly, is told apart.  The functions are
+// called sequentially in the order of registration, and the first error is
+// reported.  A panic in the function is recovered and reported as its error.
+// If no function is registered, the process is healthy.  It should be called
+// before TSR() is called.
+func (p *Process) OnHealth(fn func() error) {
+	p.onHealth = append(p.onHealth, fn)
+}
+
+// Health asks the running TSR process to run the OnHealth functions.  It
+// returns nil, if the process is healthy, the error wrapping ErrUnhealthy
+// with the error of the failed check, or ErrNotRunning, if the process is not
+// running.
+func (p *Process) Health() error {
+	resp, err := p.control(cmdHealth)
+	if err != nil {
+		return err
+	}
+	switch {
+	case resp == cmdOK:
+		return nil
+	case strings.HasPrefix(resp, respUnhealthy):
+		return fmt.Errorf("%w: %s", ErrUnhealthy, strings.TrimPrefix(resp, respUnhealthy))
+	default:
+		return errors.New(resp)
+	}
+}
+
+// runHealth calls the OnHealth functions, and returns the first error.
+func (p *Process) runHealth() error {
+	for _, fn := range p.onHealth {
+		if err := callHealth(fn); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// callHealth calls the OnHealth function, and returns the panic as the error.
+func callHealth(fn func() error) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("health check panicked: %v", r)
+		}
+	}()
+	return fn()
+}
+
+// healthResponse checks the health of the program, and returns the response
+// to the health command.
+func (p *Process) healthResponse() string {
+	if err := p.runHealth(); err != nil {
+		return truncateFrame(respUnhealthy + err.Error())
+	}
+	return cmdOK
+}
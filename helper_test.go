@@ -0,0 +1,291 @@
+package gotsr
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/exec"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// helperEnv is the environment variable that holds the configuration of the
+// helper process.  If it is set, the test binary runs as a helper process
+// instead of running tests.
+const helperEnv = "GOTSR_TEST_HELPER"
+
+// helperLifetime is the maximum time the detached helper process stays
+// resident, so that a failing test does not leave it running forever.
+const helperLifetime = 30 * time.Second
+
+// helperLogLine and helperErrLine are the lines that the detached helper
+// writes to the standard output and standard error.
+const (
+	helperLogLine = "helper is running"
+	helperErrLine = "helper error output"
+)
+
+// helperConfig is the configuration of the helper process, that is shared by
+// the tests.  The features, that only some tests need, are configured with
+// helperFeature.
+type helperConfig struct {
+	PIDFile string
+	// Network is the control network of the helper.
+	Network string
+	// ControlSocket sets the ControlSocket mode of the helper.
+	ControlSocket bool
+	// ControlToken is the control token of the helper.
+	ControlToken string
+	// LogFile is the log file of the helper.
+	LogFile string
+	// StartTimeout is the start timeout of the helper process.
+	StartTimeout time.Duration
+	// StartDelay delays the start of the detached helper process.
+	StartDelay time.Duration
+	// Supervise is the maximum number of the restarts of the crashed helper.
+	Supervise int
+	// Restart makes the helper call Restart instead of TSR.
+	Restart bool
+	// StageLog is the file, where each helper process appends the stage it
+	// enters.
+	StageLog string
+	// ExitLog is the file, where the helper appends "exit" in the AtExit
+	// function.
+	ExitLog string
+	// HangOnExit makes the helper hang in the AtExit function, so that it
+	// does not exit on Terminate.
+	HangOnExit bool
+	// ReloadLog is the file, where the helper appends "reloaded" on each
+	// reload.  The OnReload function, registered before the one that writes
+	// the file, panics.
+	ReloadLog string
+	// Features are the encoded helper features.
+	Features []featureConfig
+}
+
+// helperFeature is the feature of the helper process, that is used by some
+// of the tests, and is declared next to them.  The feature is passed to the
+// helper process as JSON, so it must be registered with registerHelper.
+type helperFeature interface {
+	// apply adds the feature to the helper h.
+	apply(h *helper) error
+}
+
+// featureConfig is the encoded helper feature.
+type featureConfig struct {
+	Name   string
+	Config json.RawMessage
+}
+
+// helperFeatures are the types of the registered helper features by their
+// names.
+var helperFeatures = make(map[string]reflect.Type)
+
+// registerHelper registers the helper features, given as the pointers to
+// their zero values, so that the helper process can decode them.
+func registerHelper(features ...helperFeature) {
+	for _, f := range features {
+		helperFeatures[fmt.Sprintf("%T", f)] = reflect.TypeOf(f).Elem()
+	}
+}
+
+// helper is the helper process being configured.  The features add the
+// options and the functions that run at the stages of the helper.
+type helper struct {
+	opts []Option
+	// setup functions run once the process is created.
+	setup []func(p *Process) error
+	// start replaces TSR, if set.
+	start func(p *Process) (bool, error)
+	// launched functions run in the launcher, once the helper is started.
+	launched []func(p *Process) error
+	// running functions run in the detached helper.
+	running []func(p *Process) error
+}
+
+func TestMain(m *testing.M) {
+	if cfg := os.Getenv(helperEnv); cfg != "" {
+		os.Exit(runHelper(cfg))
+	}
+	os.Exit(m.Run())
+}
+
+// runHelper starts the helper process with the given JSON configuration.  The
+// helper calls TSR, and if it's running headless, stays resident until it is
+// terminated, or helperLifetime elapses.
+func runHelper(config string) int {
+	var cfg helperConfig
+	if err := json.Unmarshal([]byte(config), &cfg); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 2
+	}
+	if err := helperMain(cfg); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	return 0
+}
+
+// helperMain runs the helper process with the given configuration.
+func helperMain(cfg helperConfig) error {
+	h := helper{opts: []Option{WithPIDFile(cfg.PIDFile), WithStartTimeout(cfg.StartTimeout)}}
+	if cfg.LogFile != "" {
+		h.opts = append(h.opts, WithLogFile(cfg.LogFile))
+	}
+	if cfg.Supervise > 0 {
+		h.opts = append(h.opts, WithSupervise(cfg.Supervise, 0))
+	}
+	if cfg.Network != "" {
+		h.opts = append(h.opts, WithControlNetwork(cfg.Network))
+	}
+	if cfg.ControlSocket {
+		h.opts = append(h.opts, WithControlSocket(ControlSocket))
+	}
+	if cfg.ControlToken != "" {
+		h.opts = append(h.opts, WithControlToken(cfg.ControlToken))
+	}
+	for _, fc := range cfg.Features {
+		typ, ok := helperFeatures[fc.Name]
+		if !ok {
+			return fmt.Errorf("unknown helper feature %s", fc.Name)
+		}
+		f := reflect.New(typ).Interface().(helperFeature)
+		if err := json.Unmarshal(fc.Config, f); err != nil {
+			return err
+		}
+		if err := f.apply(&h); err != nil {
+			return err
+		}
+	}
+	p, err := New(h.opts...)
+	if err != nil {
+		return err
+	}
+	if cfg.ExitLog != "" {
+		p.AtExit(func() {
+			if err := appendLine(cfg.ExitLog, "exit"); err != nil {
+				fmt.Fprintln(os.Stderr, err)
+			}
+		})
+	}
+	if cfg.HangOnExit {
+		p.AtExit(func() { time.Sleep(helperLifetime) })
+	}
+	if cfg.StartDelay > 0 && os.Getenv(newEnvVar(cfg.PIDFile).stage()) == sRunning.String() {
+		time.Sleep(cfg.StartDelay)
+	}
+	if cfg.StageLog != "" {
+		enterStage = func(s stage) {
+			if err := appendLine(cfg.StageLog, s.String()); err != nil {
+				fmt.Fprintln(os.Stderr, err)
+			}
+		}
+	}
+	// the helper reloads in place, unless a feature requires the restart.
+	p.OnReload(func() error { return nil })
+	if cfg.ReloadLog != "" {
+		p.OnReload(func() error { panic("reload") })
+		p.OnReload(func() error { return appendLine(cfg.ReloadLog, "reloaded") })
+	}
+	for _, fn := range h.setup {
+		if err := fn(p); err != nil {
+			return err
+		}
+	}
+	start := p.TSR
+	if cfg.Restart {
+		start = p.Restart
+	}
+	if h.start != nil {
+		start = func() (bool, error) { return h.start(p) }
+	}
+	headless, err := start()
+	if err != nil {
+		return err
+	}
+	if !headless {
+		for _, fn := range h.launched {
+			if err := fn(p); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	for _, fn := range h.running {
+		if err := fn(p); err != nil {
+			return err
+		}
+	}
+	fmt.Println(helperLogLine)
+	fmt.Fprintln(os.Stderr, helperErrLine)
+	time.Sleep(helperLifetime)
+	p.Close()
+	return nil
+}
+
+// addMeta adds the key to the metadata in the PID file.
+func addMeta(p *Process, key, value string) error {
+	pi, err := p.Info()
+	if err != nil {
+		return err
+	}
+	if pi.Meta == nil {
+		pi.Meta = make(map[string]string)
+	}
+	pi.Meta[key] = value
+	return p.writePIDFile(pi)
+}
+
+// appendLine appends the line to the file.
+func appendLine(filename, line string) error {
+	f, err := os.OpenFile(filename, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	_, err = fmt.Fprintln(f, line)
+	return err
+}
+
+// startHelper starts the helper process with the given configuration and
+// features, and waits for it to detach.  The detached process is killed when
+// the test finishes, if it's still running.
+func startHelper(t *testing.T, cfg helperConfig, features ...helperFeature) {
+	t.Helper()
+	cmd := helperCommand(t, cfg, features...)
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		t.Fatalf("helper failed: %s: %s", err, out)
+	}
+	t.Cleanup(func() {
+		pid, err := readPID(cfg.PIDFile)
+		if err != nil {
+			return
+		}
+		if p, err := os.FindProcess(pid); err == nil {
+			_ = p.Kill()
+		}
+		os.Remove(cfg.PIDFile)
+	})
+}
+
+// helperCommand returns the command that runs the helper process with the
+// given configuration and features.
+func helperCommand(t *testing.T, cfg helperConfig, features ...helperFeature) *exec.Cmd {
+	t.Helper()
+	for _, f := range features {
+		data, err := json.Marshal(f)
+		if err != nil {
+			t.Fatal(err)
+		}
+		cfg.Features = append(cfg.Features, featureConfig{Name: fmt.Sprintf("%T", f), Config: data})
+	}
+	data, err := json.Marshal(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cmd := exec.Command(os.Args[0], "-test.run=^$")
+	cmd.Env = append(os.Environ(), helperEnv+"="+string(data))
+	return cmd
+}
@@ -0,0 +1,184 @@
+package gotsr
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+)
+
+// Control commands and responses.  The commands are sent to the control
+// listener of the TSR process in frames: the length byte followed by the
+// payload.
+const (
+	// cmdOK checks that the process is alive, it is also the positive
+	// response and the readiness notification.
+	cmdOK = "ok"
+	// cmdExit terminates the process.
+	cmdExit = "ex"
+	// cmdFDStats requests the open file descriptor stats.
+	cmdFDStats = "fd"
+	// cmdStatus requests the status of the process.
+	cmdStatus = "status"
+	// cmdApply requests the process to apply the new configuration, the
+	// response is "ok", or respRestart, if the process must be restarted.
+	cmdApply = "apply"
+	// cmdReload requests the process to reload the configuration, the
+	// response is "ok", or the error.
+	cmdReload = "reload"
+	// cmdReady checks that the program is ready, the response is "ok", or
+	// respNotReady.
+	cmdReady = "ready"
+	// cmdAuth prefixes the control token, that the client presents before
+	// the command, the response is "ok", or the closed connection.
+	cmdAuth = "auth "
+	// cmdHandoff requests the process to start the successor, that inherits
+	// its listeners, and to exit, the response is "ok", respNoHandoff, or
+	// the error.
+	cmdHandoff = "handoff"
+	// cmdHealth requests the process to run the health checks, the response
+	// is "ok", or respUnhealthy followed by the error.
+	cmdHealth = "hc"
+
+	// respRestart is the response to the apply command, if the new
+	// configuration can't be applied without the restart.
+	respRestart = "restart"
+	// respNotReady is the response to the ready command, if the program has
+	// not reported the readiness yet.
+	respNotReady = "not ready"
+	// respStartError prefixes the start error, that the TSR process sends to
+	// the launcher instead of the readiness notification.
+	respStartError = "error: "
+	// respNoHandoff is the response to the handoff command, if the process
+	// has no listeners to hand over, or can't start the successor itself.
+	respNoHandoff = "no handoff"
+	// respUnhealthy prefixes the error of the failed health check.
+	respUnhealthy = "unhealthy: "
+	// respUnknownCommand prefixes the response to the unknown command.
+	respUnknownCommand = "unknown command: "
+	// respNotPermitted prefixes the response to the command, that the
+	// process does not serve to the unauthenticated clients.
+	respNotPermitted = "not permitted: "
+)
+
+// maxFrame is the maximum length of the frame payload.
+const maxFrame = 255
+
+var (
+	errFrameTooLong = fmt.Errorf("frame payload exceeds %d bytes", maxFrame)
+	// errInvalidResponse is returned, if the control listener responds with
+	// anything but "ok".
+	errInvalidResponse = errors.New("invalid response")
+)
+
+// writeFrame writes the payload to w, prefixed with its length.
+func writeFrame(w io.Writer, payload []byte) error {
+	if len(payload) > maxFrame {
+		return errFrameTooLong
+	}
+	buf := make([]byte, 0, len(payload)+1)
+	buf = append(buf, byte(len(payload)))
+	buf = append(buf, payload...)
+	return writeFull(w, buf)
+}
+
+// readFrame reads the length prefixed payload from r.
+func readFrame(r io.Reader) ([]byte, error) {
+	var n [1]byte
+	if _, err := io.ReadFull(r, n[:]); err != nil {
+		return nil, err
+	}
+	payload := make([]byte, n[0])
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return nil, err
+	}
+	return payload, nil
+}
+
+// isLegacy returns true if cmd is the command sent without the frame by the
+// older versions.
+func isLegacy(cmd string) bool {
+	return cmd == cmdOK || cmd == cmdExit || cmd == cmdFDStats
+}
+
+// readCommand reads the command from r.  The older versions send the two byte
+// commands without the frame, which readCommand detects by the first two
+// bytes, and reports with legacy set to true, so that the response is sent
+// in the same way.  A frame, whose length byte and the first payload byte
+// make up a legacy command, is therefore read as that command.
+func readCommand(r io.Reader) (cmd string, legacy bool, err error) {
+	var head [1]byte
+	if _, err := io.ReadFull(r, head[:]); err != nil {
+		return "", false, err
+	}
+	n := int(head[0])
+	if n == 0 {
+		return "", false, nil
+	}
+	payload := make([]byte, n)
+	if _, err := io.ReadFull(r, payload[:1]); err != nil {
+		return "", false, err
+	}
+	if pair := string([]byte{head[0], payload[0]}); isLegacy(pair) {
+		return pair, true, nil
+	}
+	if _, err := io.ReadFull(r, payload[1:]); err != nil {
+		return "", false, err
+	}
+	return string(payload), false, nil
+}
+
+// truncateFrame truncates the response to fit in the frame.
+func truncateFrame(resp string) string {
+	if len(resp) > maxFrame {
+		return resp[:maxFrame]
+	}
+	return resp
+}
+
+// request sends the command to the control listener over rw, and returns the
+// response.
+func request(rw io.ReadWriter, cmd string) (string, error) {
+	if err := writeFrame(rw, []byte(cmd)); err != nil {
+		return "", err
+	}
+	resp, err := readFrame(rw)
+	if err != nil {
+		return "", err
+	}
+	return string(resp), nil
+}
+
+// statusResponse returns the response to the status command of the process
+// started at the given time, with the control listener at addr: "ok"
+// followed by the status in JSON format.  The address is omitted, if the
+// response does not fit in the frame otherwise, i.e. for the long socket
+// paths, as the client knows the address it has connected to.
+func statusResponse(started time.Time, addr string) (string, error) {
+	st := snapshot(started, addr)
+	data, err := json.Marshal(st)
+	if err != nil {
+		return "", err
+	}
+	if len(cmdOK)+len(data) > maxFrame {
+		st.Addr = ""
+		if data, err = json.Marshal(st); err != nil {
+			return "", err
+		}
+	}
+	return cmdOK + string(data), nil
+}
+
+// parseStatus parses the response to the status command.
+func parseStatus(resp string) (*Status, error) {
+	if !strings.HasPrefix(resp, cmdOK) {
+		return nil, errInvalidResponse
+	}
+	var st Status
+	if err := json.Unmarshal([]byte(strings.TrimPrefix(resp, cmdOK)), &st); err != nil {
+		return nil, fmt.Errorf("invalid response: %w", err)
+	}
+	return &st, nil
+}
@@ -0,0 +1,230 @@
+package gotsr
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func Test_writeFrame(t *testing.T) {
+	tests := []struct {
+		name    string
+		payload []byte
+		wantErr bool
+	}{
+		{"empty", []byte{}, false},
+		{"one byte", []byte("x"), false},
+		{"command", []byte(cmdOK), false},
+		{"long command", []byte("reload"), false},
+		{"maximum", bytes.Repeat([]byte("a"), maxFrame), false},
+		{"too long", bytes.Repeat([]byte("a"), maxFrame+1), true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var buf bytes.Buffer
+			err := writeFrame(&buf, tt.payload)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("writeFrame() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+			if buf.Len() != len(tt.payload)+1 {
+				t.Errorf("frame length = %d, want %d", buf.Len(), len(tt.payload)+1)
+			}
+			got, err := readFrame(&buf)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(got, tt.payload) {
+				t.Errorf("readFrame() = %q, want %q", got, tt.payload)
+			}
+			if buf.Len() != 0 {
+				t.Errorf("%d bytes left unread", buf.Len())
+			}
+		})
+	}
+}
+
+func Test_readFrame(t *testing.T) {
+	if _, err := readFrame(strings.NewReader("")); !errors.Is(err, io.EOF) {
+		t.Errorf("readFrame() error = %v, want %v", err, io.EOF)
+	}
+	if _, err := readFrame(strings.NewReader("\x05ok")); !errors.Is(err, io.ErrUnexpectedEOF) {
+		t.Errorf("readFrame() error = %v, want %v", err, io.ErrUnexpectedEOF)
+	}
+}
+
+func Test_readCommand(t *testing.T) {
+	tests := []struct {
+		name       string
+		input      string
+		wantCmd    string
+		wantLegacy bool
+		wantErr    bool
+	}{
+		{"empty frame", "\x00", "", false, false},
+		{"framed ok", "\x02ok", cmdOK, false, false},
+		{"framed status", "\x06status", "status", false, false},
+		{"legacy ok", "ok", cmdOK, true, false},
+		{"legacy exit", "ex", cmdExit, true, false},
+		{"legacy fd", "fd", cmdFDStats, true, false},
+		{"frame with a legacy-like length", "o" + strings.Repeat("x", int('o')), strings.Repeat("x", int('o')), false, false},
+		{"truncated frame", "\x06stat", "", false, true},
+		{"nothing", "", "", false, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cmd, legacy, err := readCommand(strings.NewReader(tt.input))
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("readCommand() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if cmd != tt.wantCmd || legacy != tt.wantLegacy {
+				t.Errorf("readCommand() = %q, %v, want %q, %v", cmd, legacy, tt.wantCmd, tt.wantLegacy)
+			}
+		})
+	}
+}
+
+func Test_readCommand_shortReads(t *testing.T) {
+	tests := []struct {
+		name       string
+		input      string
+		wantCmd    string
+		wantLegacy bool
+	}{
+		{"legacy ok", "ok", cmdOK, true},
+		{"framed status", "\x06status", cmdStatus, false},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			client, server := net.Pipe()
+			done := make(chan struct{})
+			go func(input []byte) {
+				defer close(done)
+				defer client.Close()
+				// each write is received by a separate read.
+				for i := range input {
+					if _, err := client.Write(input[i : i+1]); err != nil {
+						return
+					}
+					time.Sleep(10 * time.Millisecond)
+				}
+			}([]byte(tt.input))
+			cmd, legacy, err := readCommand(server)
+			server.Close()
+			<-done
+			if err != nil {
+				t.Fatal(err)
+			}
+			if cmd != tt.wantCmd || legacy != tt.wantLegacy {
+				t.Errorf("readCommand() = %q, %v, want %q, %v", cmd, legacy, tt.wantCmd, tt.wantLegacy)
+			}
+		})
+	}
+}
+
+func Test_request(t *testing.T) {
+	var rw struct {
+		io.Reader
+		io.Writer
+	}
+	var sent bytes.Buffer
+	rw.Writer = &sent
+	rw.Reader = strings.NewReader("\x02ok")
+	resp, err := request(rw, "reload")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp != cmdOK {
+		t.Errorf("request() = %q, want %q", resp, cmdOK)
+	}
+	if sent.String() != "\x06reload" {
+		t.Errorf("sent %q, want %q", sent.String(), "\x06reload")
+	}
+}
+
+func Test_statusResponse(t *testing.T) {
+	// the start time with the longest representation.
+	started := time.Date(2023, 5, 1, 10, 20, 30, 123456789, time.FixedZone("", -(9*3600+30*60)))
+	tests := []struct {
+		name     string
+		addr     string
+		wantAddr string
+	}{
+		{"tcp", "127.0.0.1:65535", "127.0.0.1:65535"},
+		{"tcp6", "[::1]:65535", "[::1]:65535"},
+		{"long socket path", "/" + strings.Repeat("d", 100) + "/test.pid.run.sock", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resp, err := statusResponse(started, tt.addr)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(resp) > maxFrame {
+				t.Errorf("status response is %d bytes, exceeds the frame limit: %s", len(resp), resp)
+			}
+			st, err := parseStatus(resp)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !st.StartedAt.Equal(started) {
+				t.Errorf("StartedAt = %v, want %v", st.StartedAt, started)
+			}
+			if st.Uptime < time.Since(started)-time.Minute {
+				t.Errorf("Uptime = %v, want about %v", st.Uptime, time.Since(started))
+			}
+			if st.PID != os.Getpid() {
+				t.Errorf("PID = %d, want %d", st.PID, os.Getpid())
+			}
+			if st.Addr != tt.wantAddr {
+				t.Errorf("Addr = %q, want %q", st.Addr, tt.wantAddr)
+			}
+		})
+	}
+
+	if _, err := parseStatus("unknown command: status"); !errors.Is(err, errInvalidResponse) {
+		t.Errorf("parseStatus() error = %v, want %v", err, errInvalidResponse)
+	}
+}
+
+func Test_notifyError(t *testing.T) {
+	ln, err := controlListen(defaultNetwork, "", "", sInitialise)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	respc := make(chan string, 1)
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			respc <- ""
+			return
+		}
+		defer conn.Close()
+		resp, _ := readFrame(conn)
+		respc <- string(resp)
+	}()
+	long := errors.New(strings.Repeat("x", maxFrame))
+	if err := notifyError(defaultNetwork, ln.Addr().String(), long); err != nil {
+		t.Fatal(err)
+	}
+	resp := <-respc
+	if len(resp) != maxFrame {
+		t.Errorf("response is %d bytes, want %d", len(resp), maxFrame)
+	}
+	err = startError(resp)
+	if err == nil || !strings.HasPrefix(err.Error(), "xxx") {
+		t.Errorf("startError() = %v, want the truncated error", err)
+	}
+	if err := startError(cmdOK); err != nil {
+		t.Errorf("startError(%q) = %v, want nil", cmdOK, err)
+	}
+}
@@ -0,0 +1,8 @@
+//go:build linux || freebsd || openbsd || netbsd || dragonfly || solaris || aix
+
+package gotsr
+
+// underLaunchd returns false, as there is no launchd on this platform.
+func underLaunchd(p *Process) bool {
+	return false
+}
@@ -0,0 +1,18 @@
+package gotsr
+
+import "os"
+
+// underLaunchd returns true if the program should run in the launchd mode.
+func underLaunchd(p *Process) bool {
+	if p.launchd {
+		return true
+	}
+	if p.stageEnv() != "" {
+		// one of our own stages.
+		return false
+	}
+	// launchd sets XPC_SERVICE_NAME to the job label, while the terminal
+	// sessions have it set to "0".
+	svc := os.Getenv("XPC_SERVICE_NAME")
+	return os.Getppid() == 1 && svc != "" && svc != "0"
+}
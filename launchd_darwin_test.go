@@ -0,0 +1,73 @@
+package gotsr
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func init() {
+	registerHelper(new(launchdHelper))
+}
+
+// launchdHelper enables the launchd mode of the helper.
+type launchdHelper struct{}
+
+func (f *launchdHelper) apply(h *helper) error {
+	h.opts = append(h.opts, WithLaunchd(true))
+	return nil
+}
+
+func TestWithLaunchd(t *testing.T) {
+	dir := t.TempDir()
+	pidFile := filepath.Join(dir, "helper.pid")
+	stageLog := filepath.Join(dir, "stages.log")
+	cmd := helperCommand(t, helperConfig{PIDFile: pidFile, StageLog: stageLog}, &launchdHelper{})
+	if err := cmd.Start(); err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan error, 1)
+	go func() { done <- cmd.Wait() }()
+	t.Cleanup(func() { _ = cmd.Process.Kill() })
+
+	// wait for the helper to write the PID file.
+	var pid int
+	for deadline := time.Now().Add(10 * time.Second); time.Now().Before(deadline); time.Sleep(50 * time.Millisecond) {
+		if p, err := readPID(pidFile); err == nil {
+			pid = p
+			break
+		}
+	}
+	if pid != cmd.Process.Pid {
+		t.Fatalf("PID file has PID %d, want %d of the foreground process", pid, cmd.Process.Pid)
+	}
+	select {
+	case err := <-done:
+		t.Fatalf("helper exited while running in launchd mode: %v", err)
+	default:
+	}
+
+	// the foreground process skips the detach stages.
+	if data, err := os.ReadFile(stageLog); err != nil {
+		t.Fatal(err)
+	} else if string(data) != "RUN\n" {
+		t.Errorf("stages = %q, want %q", data, "RUN\n")
+	}
+
+	p, err := New(WithPIDFile(pidFile))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := p.Terminate(); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Errorf("helper exited with error: %v", err)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("helper did not exit after Terminate")
+	}
+}
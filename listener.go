@@ -0,0 +1,78 @@
+package gotsr
+
+import (
+	"errors"
+	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// handover is the state of the listener handoff to the successor of the TSR
+// process on Restart.
+type handover struct {
+	mu sync.Mutex
+	// listeners are registered with InheritListener, to be passed to the
+	// successor.
+	listeners []net.Listener
+	// inherited are the listeners inherited from the predecessor.
+	inherited []net.Listener
+	// control is the control listener of the TSR process, it's passed to the
+	// successor as well, so that the control address does not change.
+	control net.Listener
+	// pi is the PID file contents of the TSR process, it's restored, if the
+	// successor fails to start.
+	pi PIDInfo
+	// done is set once the successor has started, so that the exiting
+	// process does not remove its PID file.
+	done atomic.Bool
+}
+
+// Listeners returns the listeners that the TSR process inherited from its
+// predecessor on Restart, in the order they were registered with
+// InheritListener.  It returns nil, if the process was started afresh, so
+// the program creates the listeners itself.  It should be called after TSR
+// returns headless.
+func (p *Process) Listeners() []net.Listener {
+	p.ho.mu.Lock()
+	defer p.ho.mu.Unlock()
+	return p.ho.inherited
+}
+
+// handOver asks the running TSR process to pass its listeners to the new
+// process, started from the same executable, and to exit once the new
+// process is ready.  It returns false, if the process is not running, there's
+// nothing to hand over, or the process refuses the handoff without the control
+// token, so that the process is restarted instead.
+func (p *Process) handOver() (bool, error) {
+	resp, err := p.control(cmdHandoff)
+	if err != nil {
+		switch {
+		case errors.Is(err, ErrNotRunning):
+			return false, nil
+		case errors.Is(err, ErrNotPermitted):
+			p.logger().Printf("listener handoff needs the control token, restarting the process")
+			return false, nil
+		}
+		return false, err
+	}
+	switch {
+	case resp == cmdOK:
+		if pid, err := readPID(p.pidFile); err == nil {
+			withAttr(p.logger(), "pid", pid).Printf("listeners handed over to the process with PID: %d", pid)
+			p.startedPID = pid
+		}
+		return true, nil
+	case resp == respNoHandoff, strings.HasPrefix(resp, respUnknownCommand):
+		// the older versions do not know the command.
+		return false, nil
+	default:
+		return false, errors.New(resp)
+	}
+}
+
+// handedOver returns true if the TSR process has handed its listeners over
+// to the successor, and the PID file belongs to the successor.
+func (p *Process) handedOver() bool {
+	return p.ho.done.Load()
+}
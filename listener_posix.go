@@ -0,0 +1,246 @@
+//go:build linux || darwin || freebsd || openbsd || netbsd || dragonfly || solaris || aix
+
+package gotsr
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"os/exec"
+	"os/signal"
+	"strconv"
+	"syscall"
+	"time"
+)
+
+// Descriptors of the listeners, inherited by the successor of the TSR
+// process, they follow the descriptors of the locks.
+const (
+	// controlFd is the descriptor of the control listener.
+	controlFd = errPipeFd + 1
+	// listenFd is the descriptor of the first listener registered with
+	// InheritListener, the rest follow in the order of registration.
+	listenFd = controlFd + 1
+)
+
+// errNoHandoff is returned by startSuccessor, if the process has no
+// listeners to hand over, or is not detached, so that the successor can't
+// take its place.
+var errNoHandoff = errors.New("nothing to hand over")
+
+// InheritListener registers the listener of the TSR process, that is passed
+// to the new process on Restart, so that the clients are not refused while
+// the program is upgraded.  Restart asks the running process to start the
+// new process from its executable with the same arguments, the new
+// process recovers the listeners with Listeners, and the old process exits,
+// as it does on Terminate, once the new one is ready.  The connections
+// accepted by the old process are served by it until it exits.  The
+// listener must be *net.TCPListener or *net.UnixListener.  The handoff is not
+// available in the foreground and launchd modes, and with the notify target,
+// Restart restarts the process in this case.  It should be called in the TSR
+// process.
+func (p *Process) InheritListener(ln net.Listener) error {
+	switch ln.(type) {
+	case *net.TCPListener, *net.UnixListener:
+	default:
+		return fmt.Errorf("can't inherit the listener of type %T", ln)
+	}
+	p.ho.mu.Lock()
+	defer p.ho.mu.Unlock()
+	p.ho.listeners = append(p.ho.listeners, ln)
+	return nil
+}
+
+// listenerFile returns the duplicate of the listener descriptor.
+func listenerFile(ln net.Listener) (*os.File, error) {
+	switch l := ln.(type) {
+	case *net.TCPListener:
+		return l.File()
+	case *net.UnixListener:
+		return l.File()
+	default:
+		return nil, fmt.Errorf("can't inherit the listener of type %T", ln)
+	}
+}
+
+// recoverListeners recovers the control listener and the listeners passed by
+// the predecessor, if the TSR process is its successor.  Otherwise, it
+// returns nil.
+func (p *Process) recoverListeners(vars envVar) (net.Listener, error) {
+	sN := os.Getenv(vars.listeners())
+	if sN == "" {
+		return nil, nil
+	}
+	n, err := strconv.Atoi(sN)
+	if err != nil {
+		return nil, fmt.Errorf("invalid listener count: %q", sN)
+	}
+	ctl, err := fileListener(controlFd, "control listener")
+	if err != nil {
+		return nil, err
+	}
+	lns := make([]net.Listener, 0, n)
+	for i := 0; i < n; i++ {
+		ln, err := fileListener(listenFd+i, "listener")
+		if err != nil {
+			ctl.Close()
+			for _, ln := range lns {
+				ln.Close()
+			}
+			return nil, err
+		}
+		lns = append(lns, ln)
+	}
+	if l, ok := ctl.(*net.UnixListener); ok {
+		// the socket is removed on exit, as the predecessor would do.
+		l.SetUnlinkOnClose(true)
+	}
+	p.ho.mu.Lock()
+	p.ho.inherited = lns
+	p.ho.mu.Unlock()
+	return ctl, nil
+}
+
+// fileListener returns the listener on the inherited descriptor fd.
+func fileListener(fd int, name string) (net.Listener, error) {
+	syscall.CloseOnExec(fd)
+	f := os.NewFile(uintptr(fd), name)
+	defer f.Close()
+	ln, err := net.FileListener(f)
+	if err != nil {
+		return nil, fmt.Errorf("failed to inherit the %s: %w", name, err)
+	}
+	return ln, nil
+}
+
+// handoffResponse starts the successor of the TSR process, and returns the
+// response to the handoff command.
+func (p *Process) handoffResponse(lg Logger) string {
+	pid, err := p.startSuccessor(lg)
+	if err != nil {
+		if errors.Is(err, errNoHandoff) {
+			return respNoHandoff
+		}
+		lg.Printf("failed to hand over the listeners: %s", err)
+		return truncateFrame(respStartError + err.Error())
+	}
+	withAttr(lg, "pid", pid).Printf("listeners handed over to the process with PID: %d", pid)
+	return cmdOK
+}
+
+// startSuccessor starts the new TSR process, that inherits the locks, the
+// control listener and the listeners, registered with InheritListener, and
+// waits for it to report the readiness, as the detached process reports it
+// to the launcher.  It returns the PID of the successor.  If the successor
+// fails to start, the PID file of the process is restored, and the process
+// continues to run.
+func (p *Process) startSuccessor(lg Logger) (int, error) {
+	p.ho.mu.Lock()
+	defer p.ho.mu.Unlock()
+	if p.ho.control == nil || len(p.ho.listeners) == 0 || p.handedOver() {
+		return 0, errNoHandoff
+	}
+	image, err := p.image()
+	if err != nil {
+		return 0, err
+	}
+	vars := p.vars()
+	cmd := exec.Command(image, p.childArgs()...)
+	cmd.Env = append(os.Environ(),
+		vars.stage()+"="+sRunning.String(),
+		vars.pid()+"="+strconv.Itoa(os.Getpid()),
+		vars.key()+"="+p.envKey(),
+		vars.listeners()+"="+strconv.Itoa(len(p.ho.listeners)),
+	)
+	r, w, err := os.Pipe()
+	if err != nil {
+		return 0, err
+	}
+	defer r.Close()
+	cmd.ExtraFiles = []*os.File{pidLock, nil, w}
+	if p.singleton != "" {
+		cmd.ExtraFiles[lockFd-pidLockFd] = singletonLock
+	}
+	lns := append([]net.Listener{p.ho.control}, p.ho.listeners...)
+	for _, ln := range lns {
+		f, err := listenerFile(ln)
+		if err != nil {
+			closeFiles(cmd.ExtraFiles[controlFd-pidLockFd:])
+			w.Close()
+			return 0, err
+		}
+		cmd.ExtraFiles = append(cmd.ExtraFiles, f)
+	}
+
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, syscall.SIGUSR1)
+	defer signal.Stop(sig)
+	err = cmd.Start()
+	// the duplicates are closed, the successor holds its own.
+	w.Close()
+	closeFiles(cmd.ExtraFiles[controlFd-pidLockFd:])
+	if err != nil {
+		return 0, fmt.Errorf("failed to start the successor: %w", err)
+	}
+	errc := make(chan string, 1)
+	go func() {
+		msg, _ := io.ReadAll(r)
+		errc <- string(msg)
+	}()
+	timer := time.NewTimer(p.startTimeout)
+	defer timer.Stop()
+	for {
+		select {
+		case msg := <-errc:
+			if msg != "" {
+				_ = cmd.Wait()
+				p.restorePIDFile(lg)
+				return 0, errors.New(msg)
+			}
+			// the pipe is closed on success as well, the signal follows.
+			errc = nil
+		case <-sig:
+			if pid, err := readPID(p.pidFile); err != nil || pid != cmd.Process.Pid {
+				// not the notification of the successor.
+				continue
+			}
+			p.ho.done.Store(true)
+			for _, ln := range lns {
+				if l, ok := ln.(*net.UnixListener); ok {
+					// the socket is served by the successor.
+					l.SetUnlinkOnClose(false)
+				}
+			}
+			pid := cmd.Process.Pid
+			_ = cmd.Process.Release()
+			return pid, nil
+		case <-timer.C:
+			_ = cmd.Process.Kill()
+			_ = cmd.Wait()
+			p.restorePIDFile(lg)
+			return 0, fmt.Errorf("successor did not start in %s", p.startTimeout)
+		}
+	}
+}
+
+// restorePIDFile writes the PID file of the process, if the failed successor
+// has replaced or removed it.
+func (p *Process) restorePIDFile(lg Logger) {
+	if pid, err := readPID(p.pidFile); err == nil && pid == os.Getpid() {
+		return
+	}
+	if err := p.writePIDFile(p.ho.pi); err != nil {
+		lg.Printf("failed to restore the PID file: %s", err)
+	}
+}
+
+// closeFiles closes the files, skipping nil ones.
+func closeFiles(files []*os.File) {
+	for _, f := range files {
+		if f != nil {
+			f.Close()
+		}
+	}
+}
@@ -0,0 +1,9 @@
+package gotsr
+
+import "net"
+
+// InheritListener is not supported on Windows, as the listeners can't be
+// passed to the new process, Restart restarts the process instead.
+func (p *Process) InheritListener(ln net.Listener) error {
+	return ErrNotSupported
+}
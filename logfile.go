@@ -0,0 +1,55 @@
+package gotsr
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+)
+
+// redirectOutput redirects the standard output and the standard error to the
+// files at the given paths, the empty path leaves the stream as is.  The
+// standard logger follows the standard error.  If both paths are the same, the
+// file is opened once, so that the writes interleave correctly.
+func redirectOutput(stdout, stderr string) error {
+	var (
+		outf, errf *os.File
+		err        error
+	)
+	if stdout != "" {
+		if outf, err = openLog(stdout); err != nil {
+			return err
+		}
+	}
+	if stderr != "" {
+		if stderr == stdout {
+			errf = outf
+		} else if errf, err = openLog(stderr); err != nil {
+			if outf != nil {
+				outf.Close()
+			}
+			return err
+		}
+	}
+	if outf != nil {
+		os.Stdout = outf
+	}
+	if errf != nil {
+		os.Stderr = errf
+		log.SetOutput(errf)
+	}
+	return nil
+}
+
+// openLog opens the log file in the append mode, creating it and its parent
+// directories if necessary.
+func openLog(path string) (*os.File, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return nil, fmt.Errorf("failed to create the log directory: %w", err)
+	}
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open the log file: %w", err)
+	}
+	return f, nil
+}
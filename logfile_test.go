@@ -0,0 +1,22 @@
+package gotsr
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func Test_redirectOutput(t *testing.T) {
+	// the parent "directory" is a file.
+	parent := filepath.Join(t.TempDir(), "file")
+	if err := os.WriteFile(parent, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	stdout := os.Stdout
+	if err := redirectOutput(filepath.Join(parent, "test.log"), ""); err == nil {
+		t.Error("redirectOutput() expected an error")
+	}
+	if os.Stdout != stdout {
+		t.Error("redirectOutput() replaced the standard output on error")
+	}
+}
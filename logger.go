@@ -1,19 +1,76 @@
 package gotsr
 
+import (
+	"fmt"
+	"strings"
+	"sync"
+)
+
 type Logger interface {
 	Print(v ...interface{})
 	Printf(format string, v ...interface{})
 	Println(v ...interface{})
 }
 
-var lg Logger = nilLogger{}
+var (
+	// defLg is the package logger, used by the processes without the logger.
+	defLg   Logger = nilLogger{}
+	defLgMu sync.RWMutex
+)
 
 // SetLogger sets the logger for the package.  If not set, the package will be
-// silent.  The default logger is a nilLogger.  If TSR is initialised with
-// with WithDebug(true) option, the default logger will be set to a standard
-// Go logger.
+// silent.  The default logger is a nilLogger.  The package logger is used by
+// the processes that have no logger set with WithLogger or WithDebug.  It is
+// safe to call concurrently.
 func SetLogger(l Logger) {
-	lg = l
+	defLgMu.Lock()
+	defLg = l
+	defLgMu.Unlock()
+}
+
+// defaultLogger returns the package logger.
+func defaultLogger() Logger {
+	defLgMu.RLock()
+	defer defLgMu.RUnlock()
+	return defLg
+}
+
+// WithLogger sets the logger of the process.  If not set, the process uses
+// the package logger, set with SetLogger.
+func WithLogger(l Logger) Option {
+	return func(p *Process) {
+		p.lg = l
+	}
+}
+
+// logger returns the logger of the process, or the package logger, if it's
+// not set.
+func (p *Process) logger() Logger {
+	if p.lg != nil {
+		return p.lg
+	}
+	return defaultLogger()
+}
+
+// attrLogger is the structured Logger, that attaches the attributes to the
+// messages.
+type attrLogger interface {
+	Logger
+	withAttr(key string, value interface{}) Logger
+}
+
+// withAttr returns the logger that attaches the attribute to the messages, if
+// l is structured, or l otherwise.
+func withAttr(l Logger, key string, value interface{}) Logger {
+	if al, ok := l.(attrLogger); ok {
+		return al.withAttr(key, value)
+	}
+	return l
+}
+
+// stageLogger returns the logger that attaches the stage to the messages.
+func stageLogger(l Logger, s stage) Logger {
+	return withAttr(l, "stage", s.String())
 }
 
 type nilLogger struct{}
@@ -21,3 +78,26 @@ type nilLogger struct{}
 func (nilLogger) Print(v ...interface{})                 {}
 func (nilLogger) Printf(format string, v ...interface{}) {}
 func (nilLogger) Println(v ...interface{})               {}
+
+// infoWriter is the interface of the system log writers, such as syslog, that
+// log messages with the INFO priority.
+type infoWriter interface {
+	Info(msg string) error
+}
+
+// infoLogger adapts the infoWriter to the Logger interface.
+type infoLogger struct {
+	w infoWriter
+}
+
+func (l infoLogger) Print(v ...interface{}) {
+	_ = l.w.Info(fmt.Sprint(v...))
+}
+
+func (l infoLogger) Printf(format string, v ...interface{}) {
+	_ = l.w.Info(fmt.Sprintf(format, v...))
+}
+
+func (l infoLogger) Println(v ...interface{}) {
+	_ = l.w.Info(strings.TrimSuffix(fmt.Sprintln(v...), "\n"))
+}
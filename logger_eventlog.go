@@ -0,0 +1,10 @@
+//go:build !windows
+
+package gotsr
+
+import "errors"
+
+// EventLogLogger is only supported on Windows, it always returns an error.
+func EventLogLogger(source string) (Logger, error) {
+	return nil, errors.New("event log is only supported on windows")
+}
@@ -0,0 +1,81 @@
+package gotsr
+
+import (
+	"fmt"
+	"syscall"
+	"unsafe"
+)
+
+var (
+	advapi32                  = syscall.NewLazyDLL("advapi32.dll")
+	procRegisterEventSourceW  = advapi32.NewProc("RegisterEventSourceW")
+	procDeregisterEventSource = advapi32.NewProc("DeregisterEventSource")
+	procReportEventW          = advapi32.NewProc("ReportEventW")
+)
+
+const (
+	eventlogInformationType = 0x0004
+	eventID                 = 1
+)
+
+// eventLog is the handle of the registered event source.
+type eventLog struct {
+	h syscall.Handle
+}
+
+// EventLogLogger returns a Logger that writes messages to the Windows Event
+// Log as information events from the given source.  The returned logger can be
+// passed to SetLogger.
+func EventLogLogger(source string) (Logger, error) {
+	el, err := openEventLog(source)
+	if err != nil {
+		return nil, err
+	}
+	return infoLogger{w: el}, nil
+}
+
+// openEventLog registers the event source on the local computer.
+func openEventLog(source string) (*eventLog, error) {
+	src, err := syscall.UTF16PtrFromString(source)
+	if err != nil {
+		return nil, err
+	}
+	h, _, err := procRegisterEventSourceW.Call(0, uintptr(unsafe.Pointer(src)))
+	if h == 0 {
+		return nil, fmt.Errorf("failed to register event source %q: %w", source, err)
+	}
+	return &eventLog{h: syscall.Handle(h)}, nil
+}
+
+// Info writes an information event with the given message.
+func (el *eventLog) Info(msg string) error {
+	s, err := syscall.UTF16PtrFromString(msg)
+	if err != nil {
+		return err
+	}
+	strs := []*uint16{s}
+	r, _, err := procReportEventW.Call(
+		uintptr(el.h),
+		eventlogInformationType,
+		0, // category
+		eventID,
+		0, // user SID
+		uintptr(len(strs)),
+		0, // raw data size
+		uintptr(unsafe.Pointer(&strs[0])),
+		0, // raw data
+	)
+	if r == 0 {
+		return fmt.Errorf("failed to report event: %w", err)
+	}
+	return nil
+}
+
+// Close deregisters the event source.
+func (el *eventLog) Close() error {
+	r, _, err := procDeregisterEventSource.Call(uintptr(el.h))
+	if r == 0 {
+		return err
+	}
+	return nil
+}
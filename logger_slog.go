@@ -0,0 +1,39 @@
+//go:build go1.21
+
+package gotsr
+
+import (
+	"fmt"
+	"log/slog"
+	"strings"
+)
+
+// NewSlogLogger returns a Logger that writes messages to l with the INFO
+// level.  Each record has the "logger" attribute set to "gotsr", so that the
+// package messages can be told apart from the program ones, and the package
+// adds the "stage", "pid" and "addr" attributes, where they are known.  The
+// returned logger can be passed to SetLogger or WithLogger.
+func NewSlogLogger(l *slog.Logger) Logger {
+	return slogLogger{l: l.With(slog.String("logger", "gotsr"))}
+}
+
+// slogLogger adapts the slog.Logger to the Logger interface.
+type slogLogger struct {
+	l *slog.Logger
+}
+
+func (l slogLogger) Print(v ...interface{}) {
+	l.l.Info(fmt.Sprint(v...))
+}
+
+func (l slogLogger) Printf(format string, v ...interface{}) {
+	l.l.Info(fmt.Sprintf(format, v...))
+}
+
+func (l slogLogger) Println(v ...interface{}) {
+	l.l.Info(strings.TrimSuffix(fmt.Sprintln(v...), "\n"))
+}
+
+func (l slogLogger) withAttr(key string, value interface{}) Logger {
+	return slogLogger{l: l.l.With(key, value)}
+}
@@ -0,0 +1,103 @@
+//go:build go1.21
+
+package gotsr
+
+import (
+	"bytes"
+	"encoding/json"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func init() {
+	registerHelper(new(slogHelper))
+}
+
+func TestNewSlogLogger(t *testing.T) {
+	var buf bytes.Buffer
+	l := NewSlogLogger(slog.New(slog.NewJSONHandler(&buf, nil)))
+	l.Printf("process started with PID: %d", 1234)
+	l.Println("warning:", "PID is 0")
+	stageLogger(l, sRunning).Print("running")
+
+	dec := json.NewDecoder(&buf)
+	for _, want := range []string{"process started with PID: 1234", "warning: PID is 0", "running"} {
+		var rec map[string]interface{}
+		if err := dec.Decode(&rec); err != nil {
+			t.Fatal(err)
+		}
+		if rec["msg"] != want {
+			t.Errorf("msg = %v, want %q", rec["msg"], want)
+		}
+		if rec["level"] != "INFO" {
+			t.Errorf("level = %v, want INFO", rec["level"])
+		}
+		if rec["logger"] != "gotsr" {
+			t.Errorf("logger = %v, want gotsr", rec["logger"])
+		}
+	}
+}
+
+// slogHelper makes the helper write the log records to the file with the
+// structured logger.
+type slogHelper struct{ File string }
+
+func (f *slogHelper) apply(h *helper) error {
+	// the file stays open until the helper exits.
+	w, err := os.OpenFile(f.File, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	h.opts = append(h.opts, WithLogger(NewSlogLogger(slog.New(slog.NewJSONHandler(w, nil)))))
+	return nil
+}
+
+func TestNewSlogLogger_attrs(t *testing.T) {
+	dir := t.TempDir()
+	logFile := filepath.Join(dir, "log.json")
+	cfg := helperConfig{PIDFile: filepath.Join(dir, "test.pid")}
+	startHelper(t, cfg, &slogHelper{File: logFile})
+	pid, err := readPID(cfg.PIDFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := os.ReadFile(logFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var rec struct {
+		Msg   string `json:"msg"`
+		Stage string `json:"stage"`
+		PID   int    `json:"pid"`
+	}
+	if err := json.NewDecoder(bytes.NewReader(data)).Decode(&rec); err != nil {
+		t.Fatalf("%s: %s", err, data)
+	}
+	if rec.Stage != sInitialise.String() {
+		t.Errorf("stage = %q, want %q", rec.Stage, sInitialise)
+	}
+	if rec.PID != pid {
+		t.Errorf("pid = %d, want %d", rec.PID, pid)
+	}
+}
+
+func ExampleNewSlogLogger() {
+	h := slog.NewTextHandler(os.Stdout, &slog.HandlerOptions{
+		// drop the time, so that the output is stable.
+		ReplaceAttr: func(groups []string, a slog.Attr) slog.Attr {
+			if a.Key == slog.TimeKey && len(groups) == 0 {
+				return slog.Attr{}
+			}
+			return a
+		},
+	})
+	lg := NewSlogLogger(slog.New(h))
+	// the logger is then set for the process with WithLogger, or for the
+	// package with SetLogger.
+	lg.Printf("process started with PID: %d", 1234)
+	// Output:
+	// level=INFO msg="process started with PID: 1234" logger=gotsr
+}
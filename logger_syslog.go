@@ -0,0 +1,26 @@
+//go:build !windows && !plan9
+
+package gotsr
+
+import (
+	"fmt"
+	"log/syslog"
+)
+
+// SyslogLogger returns a Logger that writes messages to the local syslog
+// daemon with the given tag.  All messages are logged with the INFO priority
+// and the DAEMON facility.  The returned logger can be passed to SetLogger.
+func SyslogLogger(tag string) (Logger, error) {
+	return newSyslogLogger("", "", tag)
+}
+
+// newSyslogLogger returns a syslog logger, connected to the syslog daemon
+// at raddr on the given network.  If network is empty, it connects to the
+// local syslog daemon.
+func newSyslogLogger(network, raddr, tag string) (Logger, error) {
+	w, err := syslog.Dial(network, raddr, syslog.LOG_INFO|syslog.LOG_DAEMON, tag)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to syslog: %w", err)
+	}
+	return infoLogger{w: w}, nil
+}
@@ -0,0 +1,52 @@
+//go:build !windows && !plan9
+
+package gotsr
+
+import (
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func Test_syslogLogger(t *testing.T) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	l, err := newSyslogLogger("udp", conn.LocalAddr().String(), "gotsr-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name string
+		log  func()
+		want string
+	}{
+		{"Print", func() { l.Print("hello ", 42) }, "hello 42"},
+		{"Printf", func() { l.Printf("pid: %d", 1234) }, "pid: 1234"},
+		{"Println", func() { l.Println("started", "ok") }, "started ok"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.log()
+			buf := make([]byte, 1024)
+			if err := conn.SetReadDeadline(time.Now().Add(5 * time.Second)); err != nil {
+				t.Fatal(err)
+			}
+			n, _, err := conn.ReadFrom(buf)
+			if err != nil {
+				t.Fatal(err)
+			}
+			msg := string(buf[:n])
+			if !strings.Contains(msg, "gotsr-test") {
+				t.Errorf("message %q does not contain the tag", msg)
+			}
+			if !strings.HasSuffix(strings.TrimSpace(msg), tt.want) {
+				t.Errorf("message %q does not end with %q", msg, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,8 @@
+package gotsr
+
+import "errors"
+
+// SyslogLogger is not supported on Windows, it always returns an error.
+func SyslogLogger(tag string) (Logger, error) {
+	return nil, errors.New("syslog is not supported on windows")
+}
@@ -0,0 +1,109 @@
+package gotsr
+
+import (
+	"log"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeInfoWriter records the messages written to it.
+type fakeInfoWriter struct {
+	msgs []string
+}
+
+func (w *fakeInfoWriter) Info(msg string) error {
+	w.msgs = append(w.msgs, msg)
+	return nil
+}
+
+func Test_infoLogger(t *testing.T) {
+	tests := []struct {
+		name string
+		log  func(l Logger)
+		want string
+	}{
+		{"Print", func(l Logger) { l.Print("hello ", 42) }, "hello 42"},
+		{"Printf", func(l Logger) { l.Printf("pid: %d", 1234) }, "pid: 1234"},
+		{"Println", func(l Logger) { l.Println("started", "ok") }, "started ok"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := &fakeInfoWriter{}
+			tt.log(infoLogger{w: w})
+			if len(w.msgs) != 1 {
+				t.Fatalf("got %d messages, want 1", len(w.msgs))
+			}
+			if w.msgs[0] != tt.want {
+				t.Errorf("message = %q, want %q", w.msgs[0], tt.want)
+			}
+		})
+	}
+}
+
+func TestWithLogger(t *testing.T) {
+	w := &fakeInfoWriter{}
+	p, err := New(WithPIDFile("test.pid"), WithLogger(infoLogger{w: w}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.AtExitGroup("slow", time.Millisecond, func() { time.Sleep(100 * time.Millisecond) })
+	p.runAtExit()
+	if len(w.msgs) != 1 || !strings.Contains(w.msgs[0], `"slow"`) {
+		t.Errorf("messages = %q, want the slow group timeout", w.msgs)
+	}
+
+	other, err := New(WithPIDFile("test.pid"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if other.logger() != defaultLogger() {
+		t.Error("the process without the logger does not use the package logger")
+	}
+}
+
+func TestWithDebug(t *testing.T) {
+	old := defaultLogger()
+	p, err := New(WithPIDFile("test.pid"), WithDebug(true))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := p.logger().(*log.Logger); !ok {
+		t.Errorf("logger() = %T, want *log.Logger", p.logger())
+	}
+	if defaultLogger() != old {
+		t.Error("WithDebug changed the package logger")
+	}
+
+	w := &fakeInfoWriter{}
+	p, err = New(WithPIDFile("test.pid"), WithLogger(infoLogger{w: w}), WithDebug(true))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := p.logger().(infoLogger); !ok {
+		t.Errorf("logger() = %T, want the logger set with WithLogger", p.logger())
+	}
+}
+
+func TestSetLogger_concurrent(t *testing.T) {
+	old := defaultLogger()
+	t.Cleanup(func() { SetLogger(old) })
+	p, err := New(WithPIDFile("test.pid"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			SetLogger(nilLogger{})
+		}()
+		go func() {
+			defer wg.Done()
+			p.logger().Printf("message")
+		}()
+	}
+	wg.Wait()
+}
@@ -0,0 +1,72 @@
+package gotsr
+
+import (
+	"errors"
+	"net"
+	"strings"
+)
+
+// NotifyFailurePolicy defines what the TSR process does, if it fails to send
+// the readiness notification.
+type NotifyFailurePolicy int8
+
+const (
+	// NotifyContinue logs the failure, and the process continues to run.
+	NotifyContinue NotifyFailurePolicy = iota
+	// NotifyAbort makes TSR return ErrNotifyFailed in the TSR process, and
+	// remove the PID file, so that the process does not stay resident, while
+	// the launcher reports the failure.
+	NotifyAbort
+)
+
+// ErrNotifyFailed is returned by TSR in the TSR process, if it fails to send
+// the readiness notification, and the NotifyAbort policy is set.
+var ErrNotifyFailed = errors.New("failed to notify the launcher")
+
+// hasNotifyTarget returns true if the readiness notification is sent to the
+// target set with WithNotifyTarget or WithNotifyAddr, instead of the parent.
+func (p *Process) hasNotifyTarget() bool {
+	return p.notifyPID != 0 || p.notifyAddr != ""
+}
+
+// validateNotifyAddr checks the address of the readiness notification
+// listener.
+func validateNotifyAddr(network, addr string) error {
+	if network == "unix" {
+		return nil
+	}
+	if _, _, err := net.SplitHostPort(addr); err != nil {
+		return errors.New("invalid notify address: " + err.Error())
+	}
+	return nil
+}
+
+// notifyAddr sends the readiness notification to the listener at addr.
+func notifyAddr(network, addr string) error {
+	conn, err := controlDial(network, addr)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	return writeFrame(conn, []byte(cmdOK))
+}
+
+// notifyError sends the start error to the launcher listening at addr.  The
+// message is truncated to fit in the frame.
+func notifyError(network, addr string, startErr error) error {
+	conn, err := controlDial(network, addr)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	return writeFrame(conn, []byte(truncateFrame(respStartError+startErr.Error())))
+}
+
+// startError returns the start error, sent by the TSR process with
+// notifyError, or nil, if resp is the readiness notification.
+func startError(resp string) error {
+	if !strings.HasPrefix(resp, respStartError) {
+		return nil
+	}
+	return errors.New(strings.TrimPrefix(resp, respStartError))
+}
@@ -0,0 +1,443 @@
+package gotsr
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+const (
+	// metaPrefix is the prefix of the PID file keys that hold the user
+	// metadata.
+	metaPrefix = "meta."
+	// versionKey is the key of the PID file format version, it is also the
+	// signature of the gotsr PID file.
+	versionKey = "gotsr"
+	// networkKey is the key of the control listener network.
+	networkKey = "net"
+	// startedKey is the key of the start time of the process.
+	startedKey = "started"
+	// controlKey is the key of the control mode, it's present only for the
+	// ControlSocket mode.
+	controlKey = "ctl"
+	// controlSocket is the value of the control key for ControlSocket.
+	controlSocket = "socket"
+	// tokenKey is the key of the control token hash, it's present only if
+	// the token is set.
+	tokenKey = "token"
+	// secretKey is the key of the control secret, it's present only if the
+	// TSR process generated it.
+	secretKey = "secret"
+	// restartsKey and lastExitKey are the keys of the number of the restarts
+	// and the last exit status, they're present only if the process was
+	// restarted by the supervisor.
+	restartsKey = "restarts"
+	lastExitKey = "exit"
+	// exitCodeKey and signalKey are the keys of the exit code of the last
+	// crashed process and the signal that killed it, the signal is present
+	// only if the process was killed.
+	exitCodeKey = "exitcode"
+	signalKey   = "signal"
+	// pidFileVersion is the current version of the PID file format.  Version
+	// 2 adds the start time, and the control address on all platforms.
+	pidFileVersion = 2
+)
+
+// errMissingAddr is returned, if the control address is required, but the PID
+// file does not have it.
+var errMissingAddr = fmt.Errorf("%w: missing address", ErrInvalidPIDFile)
+
+// StalePIDError is returned, if the PID file exists, but the process recorded
+// in it is not running, i.e. it has crashed.  The file is safe to overwrite.
+// It matches ErrNotRunning with errors.Is.
+type StalePIDError struct {
+	// PID is the process ID recorded in the PID file.
+	PID int
+	// Addr is the control address recorded in the PID file, if any.
+	Addr string
+}
+
+func (e *StalePIDError) Error() string {
+	return fmt.Sprintf("stale PID file: process %d is not running", e.PID)
+}
+
+// Is reports whether target is ErrNotRunning.
+func (e *StalePIDError) Is(target error) bool {
+	return target == ErrNotRunning
+}
+
+// PIDInfo is the contents of the PID file.
+type PIDInfo struct {
+	// PID is the process ID of the TSR process.
+	PID int
+	// Addr is the address of the control listener, if there is one.
+	Addr string
+	// Network is the network of the control listener.  It is empty, if the
+	// file was written by the older versions, which means "tcp".
+	Network string
+	// StartedAt is the start time of the process.  It is zero, if the file
+	// was written by the older versions.
+	StartedAt time.Time
+	// Control is the control mode of the process.
+	Control ControlMode
+	// Version is the version of the PID file format.  It is zero for the
+	// files that were not written by gotsr or written by the older versions.
+	Version int
+	// Meta is the user metadata set with Process.SetMetadata.
+	Meta map[string]string
+	// Args is the command line of the process.  It's stored only in the JSON
+	// format.
+	Args []string
+	// TokenHash is the SHA-256 hash of the control token in hex, if the
+	// process requires it.
+	TokenHash string
+	// Secret is the secret, that the clients present instead of the control
+	// token.  It's generated by the TSR process with WithControlSecret, if
+	// the token is not set.
+	Secret string
+	// Restarts is the number of times the supervisor, enabled with
+	// WithSupervise, has restarted the crashed process.
+	Restarts int
+	// LastExit is the exit status of the last crashed process, i.e. "exit
+	// status 2" or "signal: killed", if the process was restarted.
+	LastExit string
+	// LastExitCode is the exit code of the last crashed process, or -1, if it
+	// was killed by LastSignal.
+	LastExitCode int
+	// LastSignal is the signal that killed the last crashed process.
+	LastSignal syscall.Signal
+}
+
+// PIDFormat is the format of the PID file.
+type PIDFormat int8
+
+const (
+	// PIDFormatLegacy is the line based format, described in readInfo, that
+	// is readable by all versions of gotsr.  It's the default.
+	PIDFormatLegacy PIDFormat = iota
+	// PIDFormatJSON is the JSON object, that also stores the command line of
+	// the process.  The versions of gotsr that predate it can't read it.
+	PIDFormatJSON
+)
+
+// WithPIDFormat sets the format of the PID file.  Both formats are detected
+// when the PID file is read, so the launcher reads the file written by the TSR
+// process in either format.
+func WithPIDFormat(format PIDFormat) Option {
+	return func(p *Process) {
+		p.pidFormat = format
+	}
+}
+
+// validatePIDFormat checks that the PID file format is known.
+func validatePIDFormat(format PIDFormat) error {
+	switch format {
+	case PIDFormatLegacy, PIDFormatJSON:
+		return nil
+	default:
+		return fmt.Errorf("invalid PID file format: %d", format)
+	}
+}
+
+// pidJSON is the PID file in the JSON format.
+type pidJSON struct {
+	Version   int               `json:"version"`
+	PID       int               `json:"pid"`
+	Addr      string            `json:"addr,omitempty"`
+	Network   string            `json:"net,omitempty"`
+	StartedAt time.Time         `json:"started_at"`
+	Control   string            `json:"ctl,omitempty"`
+	TokenHash string            `json:"token,omitempty"`
+	Secret    string            `json:"secret,omitempty"`
+	Args      []string          `json:"args,omitempty"`
+	Meta      map[string]string `json:"meta,omitempty"`
+	Restarts  int               `json:"restarts,omitempty"`
+	LastExit  string            `json:"last_exit,omitempty"`
+	ExitCode  int               `json:"last_exit_code,omitempty"`
+	Signal    int               `json:"last_signal,omitempty"`
+}
+
+// isJSON returns true if the PID file contents are in the JSON format.
+func isJSON(data []byte) bool {
+	return bytes.HasPrefix(bytes.TrimSpace(data), []byte("{"))
+}
+
+// parseInfoJSON parses the PID file in the JSON format.
+func parseInfoJSON(data []byte) (PIDInfo, error) {
+	var pj pidJSON
+	if err := json.Unmarshal(data, &pj); err != nil {
+		return PIDInfo{}, fmt.Errorf("%w: %s", ErrInvalidPIDFile, err)
+	}
+	pi := PIDInfo{
+		PID:          pj.PID,
+		Addr:         pj.Addr,
+		Network:      pj.Network,
+		StartedAt:    pj.StartedAt,
+		Version:      pj.Version,
+		Meta:         pj.Meta,
+		Args:         pj.Args,
+		TokenHash:    pj.TokenHash,
+		Secret:       pj.Secret,
+		Restarts:     pj.Restarts,
+		LastExit:     pj.LastExit,
+		LastExitCode: pj.ExitCode,
+		LastSignal:   syscall.Signal(pj.Signal),
+	}
+	if pj.Control == controlSocket {
+		pi.Control = ControlSocket
+	}
+	return pi, nil
+}
+
+// writeInfoJSON writes the PID file with the given permissions in the JSON
+// format.  The version field of pi is ignored, the current version is always
+// written.
+func writeInfoJSON(filename string, pi PIDInfo, perm os.FileMode) error {
+	pj := pidJSON{
+		Version:   pidFileVersion,
+		PID:       pi.PID,
+		Addr:      pi.Addr,
+		Network:   pi.Network,
+		StartedAt: pi.StartedAt.UTC(),
+		Args:      pi.Args,
+		Meta:      pi.Meta,
+		TokenHash: pi.TokenHash,
+		Secret:    pi.Secret,
+		Restarts:  pi.Restarts,
+		LastExit:  pi.LastExit,
+		ExitCode:  pi.LastExitCode,
+		Signal:    int(pi.LastSignal),
+	}
+	if pi.Control == ControlSocket {
+		pj.Control = controlSocket
+	}
+	data, err := json.Marshal(pj)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(filename, append(data, '\n'), perm)
+}
+
+// writePIDFile writes the PID file of the process in the format set with
+// WithPIDFormat.
+func (p *Process) writePIDFile(pi PIDInfo) error {
+	perm := p.pidFileMode
+	if pi.Secret != "" {
+		// the secret must not be readable by the other users.
+		perm &= 0600
+	}
+	if p.pidFormat == PIDFormatJSON {
+		return writeInfoJSON(p.pidFile, pi, perm)
+	}
+	return writeInfo(p.pidFile, pi, perm)
+}
+
+// readInfo reads the PID file.
+//
+// PID file format:
+//
+//	PID
+//	addr
+//	gotsr=version
+//	net=network
+//	started=time
+//	ctl=socket
+//	token=hash
+//	secret=secret
+//	restarts=count
+//	exit=status
+//	exitcode=code
+//	signal=number
+//	key1=value1
+//	...
+//	keyN=valueN
+//
+// The address line may be empty, if the process has no control listener, in
+// which case the network line is omitted.  The start time is in RFC 3339
+// format.  The control line is present only for the ControlSocket mode, and
+// the token and the secret lines only if the control token is set, or the
+// secret is generated.  The restarts, the exit and the exit code lines are
+// present only if the supervisor has restarted the process, and the signal
+// line, if the crashed process was killed by the signal.
+// Keys of the user metadata are prefixed with "meta.".  Unknown keys are
+// ignored.  The file in the JSON format, set with WithPIDFormat, is detected
+// by the opening brace.
+func readInfo(filename string) (PIDInfo, error) {
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		return PIDInfo{}, err
+	}
+	if isJSON(data) {
+		return parseInfoJSON(data)
+	}
+
+	var (
+		pi PIDInfo
+		n  int
+	)
+	s := bufio.NewScanner(bytes.NewReader(data))
+	for ; s.Scan(); n++ {
+		line := strings.TrimRight(s.Text(), "\r")
+		switch n {
+		case 0:
+			pid, err := strconv.Atoi(strings.TrimSpace(line))
+			if err != nil {
+				return PIDInfo{}, fmt.Errorf("%w: invalid PID: %s", ErrInvalidPIDFile, err)
+			}
+			pi.PID = pid
+		case 1:
+			pi.Addr = line
+		default:
+			key, value, found := strings.Cut(line, "=")
+			if !found {
+				continue
+			}
+			if key == versionKey {
+				if v, err := strconv.Atoi(value); err == nil {
+					pi.Version = v
+				}
+			} else if key == networkKey {
+				pi.Network = value
+			} else if key == startedKey {
+				if t, err := time.Parse(time.RFC3339Nano, value); err == nil {
+					pi.StartedAt = t
+				}
+			} else if key == controlKey {
+				if value == controlSocket {
+					pi.Control = ControlSocket
+				}
+			} else if key == tokenKey {
+				pi.TokenHash = value
+			} else if key == secretKey {
+				pi.Secret = value
+			} else if key == restartsKey {
+				if v, err := strconv.Atoi(value); err == nil {
+					pi.Restarts = v
+				}
+			} else if key == lastExitKey {
+				pi.LastExit = value
+			} else if key == exitCodeKey {
+				if v, err := strconv.Atoi(value); err == nil {
+					pi.LastExitCode = v
+				}
+			} else if key == signalKey {
+				if v, err := strconv.Atoi(value); err == nil {
+					pi.LastSignal = syscall.Signal(v)
+				}
+			} else if strings.HasPrefix(key, metaPrefix) {
+				if pi.Meta == nil {
+					pi.Meta = make(map[string]string)
+				}
+				pi.Meta[strings.TrimPrefix(key, metaPrefix)] = value
+			}
+		}
+	}
+	if err := s.Err(); err != nil {
+		return PIDInfo{}, err
+	}
+	if n == 0 {
+		return PIDInfo{}, fmt.Errorf("%w: empty file", ErrInvalidPIDFile)
+	}
+	return pi, nil
+}
+
+// ReadPIDInfo reads the PID file at path written by gotsr.  The optional
+// fields that are absent in the file are left zero.  For the files that
+// contain only the PID, only the PID field is set.
+func ReadPIDInfo(path string) (PIDInfo, error) {
+	return readInfo(path)
+}
+
+// writeInfo writes the PID file with the given permissions in the format
+// described in readInfo.  The version field of pi is ignored, the current
+// version is always written.
+func writeInfo(filename string, pi PIDInfo, perm os.FileMode) error {
+	data := []string{pi.Addr, versionKey + "=" + strconv.Itoa(pidFileVersion)}
+	if pi.Network != "" {
+		data = append(data, networkKey+"="+pi.Network)
+	}
+	if !pi.StartedAt.IsZero() {
+		data = append(data, startedKey+"="+pi.StartedAt.UTC().Format(time.RFC3339Nano))
+	}
+	if pi.Control == ControlSocket {
+		data = append(data, controlKey+"="+controlSocket)
+	}
+	if pi.TokenHash != "" {
+		data = append(data, tokenKey+"="+pi.TokenHash)
+	}
+	if pi.Secret != "" {
+		data = append(data, secretKey+"="+pi.Secret)
+	}
+	if pi.Restarts > 0 {
+		data = append(data, restartsKey+"="+strconv.Itoa(pi.Restarts))
+	}
+	if pi.LastExit != "" {
+		data = append(data, lastExitKey+"="+pi.LastExit)
+	}
+	if pi.Restarts > 0 {
+		data = append(data, exitCodeKey+"="+strconv.Itoa(pi.LastExitCode))
+	}
+	if pi.LastSignal != 0 {
+		data = append(data, signalKey+"="+strconv.Itoa(int(pi.LastSignal)))
+	}
+	for k, v := range pi.Meta {
+		data = append(data, metaPrefix+k+"="+v)
+	}
+	return writePID(filename, perm, pi.PID, data...)
+}
+
+// compatNote returns the note on the compatibility of the PID file, written
+// by a different version of gotsr, or an empty string, if the file is of the
+// current version.
+func compatNote(pi PIDInfo) string {
+	switch {
+	case pi.Version == pidFileVersion:
+		return ""
+	case pi.Version == 0:
+		return "PID file was written by an older gotsr version or another program: the metadata, the start time and the control address may be missing"
+	case pi.Version < pidFileVersion:
+		return fmt.Sprintf("PID file was written by an older gotsr version (format %d, current %d): the start time and the control address may be missing", pi.Version, pidFileVersion)
+	default:
+		return fmt.Sprintf("PID file was written by a newer gotsr version (format %d, current %d): the unknown fields are ignored", pi.Version, pidFileVersion)
+	}
+}
+
+// validateMeta checks that the metadata key and value can be stored in the PID
+// file.
+func validateMeta(key, value string) error {
+	if key == "" {
+		return errors.New("empty metadata key")
+	}
+	if strings.ContainsAny(key, "=\r\n") {
+		return fmt.Errorf("invalid metadata key %q: must not contain '=' or new lines", key)
+	}
+	if strings.ContainsAny(value, "\r\n") {
+		return fmt.Errorf("invalid metadata value for key %q: must not contain new lines", key)
+	}
+	return nil
+}
+
+// IsGotsrPIDFile returns true if the file at path is a PID file written by
+// gotsr.  It checks for the gotsr signature in the file, so the PID files of
+// other programs, including the files that contain only the PID, are reported
+// as foreign.  It returns an error only if the file can't be read.
+func IsGotsrPIDFile(path string) (bool, error) {
+	pi, err := readInfo(path)
+	if err != nil {
+		var pe *fs.PathError
+		if errors.As(err, &pe) {
+			return false, err
+		}
+		// not parseable, not ours.
+		return false, nil
+	}
+	return pi.Version > 0, nil
+}
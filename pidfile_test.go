@@ -0,0 +1,406 @@
+package gotsr
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func Test_readInfo(t *testing.T) {
+	tests := []struct {
+		name     string
+		contents []byte
+		want     PIDInfo
+		wantErr  bool
+	}{
+		{
+			"pid only",
+			[]byte("12345\n"),
+			PIDInfo{PID: 12345},
+			false,
+		},
+		{
+			"pid and address",
+			[]byte("12345\n127.0.0.1:6060\n"),
+			PIDInfo{PID: 12345, Addr: "127.0.0.1:6060"},
+			false,
+		},
+		{
+			"metadata without address",
+			[]byte("12345\n\nmeta.key=some value\n"),
+			PIDInfo{PID: 12345, Meta: map[string]string{"key": "some value"}},
+			false,
+		},
+		{
+			"version",
+			[]byte("12345\n127.0.0.1:6060\ngotsr=1\n"),
+			PIDInfo{PID: 12345, Addr: "127.0.0.1:6060", Version: 1},
+			false,
+		},
+		{
+			"network",
+			[]byte("12345\n127.0.0.1:6060\ngotsr=1\nnet=tcp4\n"),
+			PIDInfo{PID: 12345, Addr: "127.0.0.1:6060", Network: "tcp4", Version: 1},
+			false,
+		},
+		{
+			"start time",
+			[]byte("12345\n127.0.0.1:6060\ngotsr=1\nstarted=2023-05-01T10:20:30.5Z\n"),
+			PIDInfo{PID: 12345, Addr: "127.0.0.1:6060", StartedAt: time.Date(2023, 5, 1, 10, 20, 30, 5e8, time.UTC), Version: 1},
+			false,
+		},
+		{
+			"invalid start time is ignored",
+			[]byte("12345\n\ngotsr=1\nstarted=yesterday\n"),
+			PIDInfo{PID: 12345, Version: 1},
+			false,
+		},
+		{
+			"unknown keys are ignored",
+			[]byte("12345\n127.0.0.1:6060\nfoo=bar\nmeta.a=b=c\n"),
+			PIDInfo{PID: 12345, Addr: "127.0.0.1:6060", Meta: map[string]string{"a": "b=c"}},
+			false,
+		},
+		{
+			"empty",
+			[]byte(""),
+			PIDInfo{},
+			true,
+		},
+		{
+			"not a number",
+			[]byte("test\n"),
+			PIDInfo{},
+			true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			filename := filepath.Join(t.TempDir(), "1.pid")
+			if err := os.WriteFile(filename, tt.contents, 0666); err != nil {
+				t.Fatal(err)
+			}
+			got, err := readInfo(filename)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("readInfo() error = %v, wantErr %v", err, tt.wantErr)
+				return
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("readInfo() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_writeInfo(t *testing.T) {
+	want := PIDInfo{
+		PID:          12345,
+		Addr:         "127.0.0.1:6060",
+		Network:      "tcp4",
+		StartedAt:    time.Date(2023, 5, 1, 10, 20, 30, 5e8, time.UTC),
+		Meta:         map[string]string{"deployment": "blue green", "commit": "0badc0de"},
+		TokenHash:    hashToken("secret"),
+		Secret:       "0123456789abcdef",
+		Restarts:     2,
+		LastExit:     "exit status 1",
+		LastExitCode: 1,
+	}
+	filename := filepath.Join(t.TempDir(), "1.pid")
+	if err := writeInfo(filename, want, defaultPIDFileMode); err != nil {
+		t.Fatal(err)
+	}
+	got, err := readInfo(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want.Version = pidFileVersion
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("readInfo() = %v, want %v", got, want)
+	}
+	// legacy reader must still be able to read the PID.
+	pid, err := readPID(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pid != want.PID {
+		t.Errorf("readPID() = %v, want %v", pid, want.PID)
+	}
+}
+
+func Test_writeInfoJSON(t *testing.T) {
+	want := PIDInfo{
+		PID:          12345,
+		Addr:         "/run/test.pid.run.sock",
+		Network:      "unix",
+		StartedAt:    time.Date(2023, 5, 1, 10, 20, 30, 5e8, time.UTC),
+		Control:      ControlSocket,
+		Meta:         map[string]string{"deployment": "blue green"},
+		Args:         []string{"/usr/bin/test", "-addr", ":6060"},
+		TokenHash:    hashToken("secret"),
+		Restarts:     1,
+		LastExit:     "signal: killed",
+		LastExitCode: -1,
+		LastSignal:   syscall.SIGKILL,
+	}
+	filename := filepath.Join(t.TempDir(), "1.pid")
+	if err := writeInfoJSON(filename, want, defaultPIDFileMode); err != nil {
+		t.Fatal(err)
+	}
+	got, err := readInfo(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want.Version = pidFileVersion
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("readInfo() = %v, want %v", got, want)
+	}
+	pid, err := readPID(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pid != want.PID {
+		t.Errorf("readPID() = %v, want %v", pid, want.PID)
+	}
+	if ok, err := IsGotsrPIDFile(filename); err != nil || !ok {
+		t.Errorf("IsGotsrPIDFile() = %v, %v, want true", ok, err)
+	}
+
+	// the truncated file.
+	if err := os.WriteFile(filename, []byte(`{"version":2,"pid":`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := readInfo(filename); !errors.Is(err, ErrInvalidPIDFile) {
+		t.Errorf("readInfo() error = %v, want %v", err, ErrInvalidPIDFile)
+	}
+}
+
+func TestReadPIDInfo(t *testing.T) {
+	tests := []struct {
+		name string
+		pi   PIDInfo
+	}{
+		{
+			"all fields",
+			PIDInfo{
+				PID:     12345,
+				Addr:    "127.0.0.1:6060",
+				Network: "tcp4",
+				Meta:    map[string]string{"deployment": "blue", "commit": "0badc0de"},
+			},
+		},
+		{
+			"no address",
+			PIDInfo{PID: 12345, Meta: map[string]string{"deployment": "blue"}},
+		},
+		{
+			"no network",
+			PIDInfo{PID: 12345, Addr: "127.0.0.1:6060"},
+		},
+		{
+			"no metadata",
+			PIDInfo{PID: 12345, Addr: "/run/test.pid.run.sock", Network: "unix"},
+		},
+		{
+			"control socket",
+			PIDInfo{PID: 12345, Addr: "/run/test.pid.run.sock", Network: "unix", Control: ControlSocket},
+		},
+		{
+			"pid only",
+			PIDInfo{PID: 12345},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			filename := filepath.Join(t.TempDir(), "1.pid")
+			if err := writeInfo(filename, tt.pi, defaultPIDFileMode); err != nil {
+				t.Fatal(err)
+			}
+			got, err := ReadPIDInfo(filename)
+			if err != nil {
+				t.Fatal(err)
+			}
+			want := tt.pi
+			want.Version = pidFileVersion
+			if !reflect.DeepEqual(got, want) {
+				t.Errorf("ReadPIDInfo() = %+v, want %+v", got, want)
+			}
+		})
+	}
+	t.Run("missing", func(t *testing.T) {
+		if _, err := ReadPIDInfo(filepath.Join(t.TempDir(), "missing.pid")); !os.IsNotExist(err) {
+			t.Errorf("ReadPIDInfo() error = %v, want not exist", err)
+		}
+	})
+}
+
+func TestProcess_SetMetadata(t *testing.T) {
+	tests := []struct {
+		name    string
+		key     string
+		value   string
+		wantErr bool
+	}{
+		{"valid", "deployment", "blue", false},
+		{"value with spaces", "deployment", "blue green", false},
+		{"empty key", "", "blue", true},
+		{"key with new line", "deploy\nment", "blue", true},
+		{"key with equals", "deploy=ment", "blue", true},
+		{"value with new line", "deployment", "blue\ngreen", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var p Process
+			err := p.SetMetadata(tt.key, tt.value)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("SetMetadata() error = %v, wantErr %v", err, tt.wantErr)
+				return
+			}
+			if err == nil && p.meta[tt.key] != tt.value {
+				t.Errorf("SetMetadata() meta[%q] = %q, want %q", tt.key, p.meta[tt.key], tt.value)
+			}
+		})
+	}
+}
+
+func TestIsGotsrPIDFile(t *testing.T) {
+	tests := []struct {
+		name     string
+		contents []byte
+		want     bool
+		wantErr  bool
+	}{
+		{"gotsr", []byte("12345\n\ngotsr=1\n"), true, false},
+		{"gotsr with address", []byte("12345\n127.0.0.1:6060\ngotsr=1\n"), true, false},
+		{"bare pid", []byte("12345\n"), false, false},
+		{"legacy windows", []byte("12345\n127.0.0.1:6060\n"), false, false},
+		{"foreign", []byte("nginx: master process\n"), false, false},
+		{"empty", []byte(""), false, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			filename := filepath.Join(t.TempDir(), "1.pid")
+			if err := os.WriteFile(filename, tt.contents, 0666); err != nil {
+				t.Fatal(err)
+			}
+			got, err := IsGotsrPIDFile(filename)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("IsGotsrPIDFile() error = %v, wantErr %v", err, tt.wantErr)
+				return
+			}
+			if got != tt.want {
+				t.Errorf("IsGotsrPIDFile() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+	t.Run("written by gotsr", func(t *testing.T) {
+		filename := filepath.Join(t.TempDir(), "1.pid")
+		if err := writeInfo(filename, PIDInfo{PID: 12345}, defaultPIDFileMode); err != nil {
+			t.Fatal(err)
+		}
+		if got, err := IsGotsrPIDFile(filename); err != nil || !got {
+			t.Errorf("IsGotsrPIDFile() = %v, %v, want true, nil", got, err)
+		}
+	})
+	t.Run("missing", func(t *testing.T) {
+		if _, err := IsGotsrPIDFile(filepath.Join(t.TempDir(), "missing.pid")); err == nil {
+			t.Error("IsGotsrPIDFile() expected an error")
+		}
+	})
+}
+
+func TestProcess_Info_compat(t *testing.T) {
+	tests := []struct {
+		name     string
+		contents []byte
+		want     PIDInfo
+		wantNote string
+	}{
+		{
+			"current",
+			[]byte("12345\n127.0.0.1:6060\ngotsr=2\nnet=tcp\nstarted=2023-05-01T10:20:30Z\n"),
+			PIDInfo{PID: 12345, Addr: "127.0.0.1:6060", Network: "tcp", StartedAt: time.Date(2023, 5, 1, 10, 20, 30, 0, time.UTC), Version: 2},
+			"",
+		},
+		{
+			"version 1",
+			[]byte("12345\n127.0.0.1:6060\ngotsr=1\nnet=tcp\nmeta.a=b\n"),
+			PIDInfo{PID: 12345, Addr: "127.0.0.1:6060", Network: "tcp", Version: 1, Meta: map[string]string{"a": "b"}},
+			"older gotsr version (format 1",
+		},
+		{
+			"legacy",
+			[]byte("12345\n127.0.0.1:6060\n"),
+			PIDInfo{PID: 12345, Addr: "127.0.0.1:6060"},
+			"older gotsr version or another program",
+		},
+		{
+			"newer",
+			[]byte("12345\n127.0.0.1:6060\ngotsr=99\nfuture=field\n"),
+			PIDInfo{PID: 12345, Addr: "127.0.0.1:6060", Version: 99},
+			"newer gotsr version (format 99",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			filename := filepath.Join(t.TempDir(), "1.pid")
+			if err := os.WriteFile(filename, tt.contents, 0666); err != nil {
+				t.Fatal(err)
+			}
+			w := &fakeInfoWriter{}
+			p, err := New(WithPIDFile(filename), WithLogger(infoLogger{w: w}))
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, err := p.Info()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("Info() = %v, want %v", got, tt.want)
+			}
+			if tt.wantNote == "" {
+				if len(w.msgs) != 0 {
+					t.Errorf("unexpected note: %q", w.msgs)
+				}
+				return
+			}
+			if len(w.msgs) != 1 || !strings.Contains(w.msgs[0], tt.wantNote) {
+				t.Errorf("notes = %q, want %q", w.msgs, tt.wantNote)
+			}
+		})
+	}
+}
+
+func TestProcess_invalidPIDFile(t *testing.T) {
+	tests := []struct {
+		name     string
+		contents string
+	}{
+		{"empty", ""},
+		{"garbage", "not a pid\n"},
+		{"control socket without address", "12345\n\ngotsr=2\nnet=unix\nctl=socket\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pidFile := filepath.Join(t.TempDir(), "test.pid")
+			if err := os.WriteFile(pidFile, []byte(tt.contents), 0644); err != nil {
+				t.Fatal(err)
+			}
+			p, err := New(WithPIDFile(pidFile))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, err := p.IsRunning(); !errors.Is(err, ErrInvalidPIDFile) {
+				t.Errorf("IsRunning() error = %v, want %v", err, ErrInvalidPIDFile)
+			}
+			if err := p.Terminate(); !errors.Is(err, ErrInvalidPIDFile) {
+				t.Errorf("Terminate() error = %v, want %v", err, ErrInvalidPIDFile)
+			}
+		})
+	}
+}
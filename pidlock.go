@@ -0,0 +1,25 @@
+package gotsr
+
+import "errors"
+
+// ErrAlreadyStarting is returned by TSR, if another launcher is starting the
+// TSR process with the same PID file.
+var ErrAlreadyStarting = errors.New("already starting")
+
+// errLocked is returned by the lock functions, if the lock is held by another
+// process.
+var errLocked = errors.New("locked")
+
+// pidLockPath returns the path of the lock file of the PID file.
+func pidLockPath(pidFile string) string {
+	return pidFile + ".lock"
+}
+
+// pidLockError returns the error for the held PID file lock: ErrAlreadyRunning,
+// if the TSR process is running, or ErrAlreadyStarting otherwise.
+func pidLockError(pidFile string) error {
+	if running, err := isRunning(pidFile); err == nil && running {
+		return ErrAlreadyRunning
+	}
+	return ErrAlreadyStarting
+}
@@ -0,0 +1,64 @@
+//go:build linux || darwin || freebsd || openbsd || netbsd || dragonfly
+
+package gotsr
+
+import (
+	"errors"
+	"os"
+	"syscall"
+)
+
+// pidLock is the PID file lock held by the TSR process until it exits.
+var pidLock *os.File
+
+// lockPIDFile acquires the PID file lock.  It returns ErrAlreadyStarting or
+// ErrAlreadyRunning, if the lock is held by another process.  The lock is
+// held while the returned file, or any of its duplicates, are open, so it can
+// be passed to the child process.
+func lockPIDFile(pidFile string) (*os.File, error) {
+	f, err := flock(pidLockPath(pidFile))
+	if errors.Is(err, errLocked) {
+		return nil, pidLockError(pidFile)
+	}
+	return f, err
+}
+
+// inheritedPIDLock returns the PID file lock inherited from the parent.
+func inheritedPIDLock(pidFile string) *os.File {
+	return os.NewFile(pidLockFd, pidLockPath(pidFile))
+}
+
+// holdPIDLock makes the TSR process hold the PID file lock.  If the lock was
+// inherited from the parent, it's already held on pidLockFd, otherwise it is
+// acquired.
+func holdPIDLock(pidFile string, inherited bool) error {
+	if inherited {
+		syscall.CloseOnExec(pidLockFd)
+		pidLock = inheritedPIDLock(pidFile)
+		return nil
+	}
+	f, err := lockPIDFile(pidFile)
+	if err != nil {
+		return err
+	}
+	pidLock = f
+	return nil
+}
+
+// pidLocked returns true if the PID file lock is held by another process.
+func pidLocked(pidFile string) bool {
+	f, err := os.Open(pidLockPath(pidFile))
+	if err != nil {
+		return false
+	}
+	defer f.Close()
+	return syscall.Flock(int(f.Fd()), syscall.LOCK_EX|syscall.LOCK_NB) != nil
+}
+
+// releasePIDLock releases the PID file lock held by the TSR process.
+func releasePIDLock() {
+	if pidLock != nil {
+		pidLock.Close()
+		pidLock = nil
+	}
+}
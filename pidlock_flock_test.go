@@ -0,0 +1,117 @@
+//go:build linux || darwin || freebsd || openbsd || netbsd || dragonfly
+
+package gotsr
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func Test_lockPIDFile(t *testing.T) {
+	pidFile := filepath.Join(t.TempDir(), "test.pid")
+	lock, err := lockPIDFile(pidFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := lockPIDFile(pidFile); !errors.Is(err, ErrAlreadyStarting) {
+		t.Errorf("lockPIDFile() error = %v, want %v", err, ErrAlreadyStarting)
+	}
+	// the test process is running, so it is used instead of the TSR process.
+	if err := writeInfo(pidFile, PIDInfo{PID: os.Getpid()}, defaultPIDFileMode); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := lockPIDFile(pidFile); !errors.Is(err, ErrAlreadyRunning) {
+		t.Errorf("lockPIDFile() error = %v, want %v", err, ErrAlreadyRunning)
+	}
+	lock.Close()
+	lock, err = lockPIDFile(pidFile)
+	if err != nil {
+		t.Fatalf("lock was not released: %s", err)
+	}
+	lock.Close()
+}
+
+func Test_stageInit_locked(t *testing.T) {
+	pidFile := filepath.Join(t.TempDir(), "test.pid")
+	lock, err := lockPIDFile(pidFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer lock.Close()
+	p, err := New(WithPIDFile(pidFile))
+	if err != nil {
+		t.Fatal(err)
+	}
+	vars := p.vars()
+	if err := stageInit(context.Background(), defaultLogger(), p, vars, "/nonexistent"); !errors.Is(err, ErrAlreadyStarting) {
+		t.Errorf("stageInit() error = %v, want %v", err, ErrAlreadyStarting)
+	}
+	for _, name := range vars.all() {
+		if v, ok := os.LookupEnv(name); ok {
+			t.Errorf("%s = %q is set in the launcher", name, v)
+		}
+	}
+}
+
+func TestTSR_concurrent(t *testing.T) {
+	pidFile := filepath.Join(t.TempDir(), "helper.pid")
+
+	var (
+		wg   sync.WaitGroup
+		errs = make([]error, 2)
+		outs = make([]string, 2)
+	)
+	for i := range errs {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			cmd := helperCommand(t, helperConfig{PIDFile: pidFile})
+			out, err := cmd.CombinedOutput()
+			errs[i], outs[i] = err, string(out)
+		}(i)
+	}
+	wg.Wait()
+	t.Cleanup(func() {
+		if pid, err := readPID(pidFile); err == nil {
+			if p, err := os.FindProcess(pid); err == nil {
+				_ = p.Kill()
+			}
+		}
+	})
+
+	started := 0
+	for i, err := range errs {
+		if err == nil {
+			started++
+			continue
+		}
+		if !strings.Contains(outs[i], ErrAlreadyStarting.Error()) && !strings.Contains(outs[i], ErrAlreadyRunning.Error()) {
+			t.Errorf("helper %d output = %q, want %q or %q", i, outs[i], ErrAlreadyStarting, ErrAlreadyRunning)
+		}
+	}
+	if started != 1 {
+		t.Fatalf("%d processes started, want 1", started)
+	}
+
+	p, err := New(WithPIDFile(pidFile))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := p.Terminate(); err != nil {
+		t.Fatal(err)
+	}
+	if err := waitExit(pidFile, stopTimeout); err != nil {
+		t.Fatal(err)
+	}
+	// the lock is released before the PID file is removed.
+	lock, err := lockPIDFile(pidFile)
+	if err != nil {
+		t.Fatalf("lock was not released: %s", err)
+	}
+	lock.Close()
+}
@@ -0,0 +1,32 @@
+//go:build solaris || aix
+
+package gotsr
+
+import "os"
+
+// pidLock is always nil on this platform, as there's no flock.
+var pidLock *os.File
+
+// lockPIDFile does nothing on this platform, as there's no flock.
+func lockPIDFile(pidFile string) (*os.File, error) {
+	return nil, nil
+}
+
+// inheritedPIDLock returns nil on this platform, as there's no lock to
+// inherit.
+func inheritedPIDLock(pidFile string) *os.File {
+	return nil
+}
+
+// holdPIDLock does nothing on this platform, as there's no flock.
+func holdPIDLock(pidFile string, inherited bool) error {
+	return nil
+}
+
+// pidLocked returns false on this platform, as there's no flock.
+func pidLocked(pidFile string) bool {
+	return false
+}
+
+// releasePIDLock does nothing on this platform, as there's no flock.
+func releasePIDLock() {}
@@ -0,0 +1,81 @@
+package gotsr
+
+import (
+	"syscall"
+	"unsafe"
+)
+
+var procLockFileEx = kernel32.NewProc("LockFileEx")
+
+const (
+	lockfileFailImmediately = 0x00000001
+	lockfileExclusiveLock   = 0x00000002
+
+	errorLockViolation = 33
+)
+
+// pidLock is the handle of the PID file lock held by the TSR process until it
+// exits.
+var pidLock syscall.Handle
+
+// lockPIDFile acquires the PID file lock with LockFileEx.  It returns
+// ErrAlreadyStarting or ErrAlreadyRunning, if the lock is held by another
+// process.  The lock is held until the returned handle is closed.
+func lockPIDFile(pidFile string) (syscall.Handle, error) {
+	name, err := syscall.UTF16PtrFromString(pidLockPath(pidFile))
+	if err != nil {
+		return 0, err
+	}
+	h, err := syscall.CreateFile(name,
+		syscall.GENERIC_READ|syscall.GENERIC_WRITE,
+		syscall.FILE_SHARE_READ|syscall.FILE_SHARE_WRITE|syscall.FILE_SHARE_DELETE,
+		nil, syscall.OPEN_ALWAYS, syscall.FILE_ATTRIBUTE_NORMAL, 0)
+	if err != nil {
+		return 0, err
+	}
+	var ol syscall.Overlapped
+	r, _, err := procLockFileEx.Call(uintptr(h), lockfileExclusiveLock|lockfileFailImmediately, 0, 1, 0, uintptr(unsafe.Pointer(&ol)))
+	if r == 0 {
+		syscall.CloseHandle(h)
+		if err == syscall.Errno(errorLockViolation) {
+			return 0, pidLockError(pidFile)
+		}
+		return 0, err
+	}
+	return h, nil
+}
+
+// checkPIDLock checks that the PID file lock is not held by another process.
+// The handles can't be passed on to the TSR process, so the launcher only
+// checks the lock, and the TSR process acquires it.
+func checkPIDLock(pidFile string) error {
+	h, err := lockPIDFile(pidFile)
+	if err != nil {
+		return err
+	}
+	return syscall.CloseHandle(h)
+}
+
+// holdPIDLock makes the TSR process hold the PID file lock.
+func holdPIDLock(pidFile string) error {
+	h, err := lockPIDFile(pidFile)
+	if err != nil {
+		return err
+	}
+	pidLock = h
+	return nil
+}
+
+// pidLocked returns false, as the TSR process releases the lock before it
+// removes the PID file, and there's no supervisor on Windows.
+func pidLocked(pidFile string) bool {
+	return false
+}
+
+// releasePIDLock releases the PID file lock held by the TSR process.
+func releasePIDLock() {
+	if pidLock != 0 {
+		syscall.CloseHandle(pidLock)
+		pidLock = 0
+	}
+}
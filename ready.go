@@ -0,0 +1,50 @@
+package gotsr
+
+import (
+	"context"
+	"errors"
+	"time"
+)
+
+// SetReady reports that the program in the TSR process has initialised and is
+// ready to serve, so that WaitReadyRemote returns.  The readiness is
+// independent of the startup handshake: TSR returns, once the process is
+// running, while the program may still be initialising.
+func (p *Process) SetReady() {
+	p.ready.Store(true)
+}
+
+// WaitReadyRemote waits for the running TSR process to report that it's
+// ready with SetReady.  It polls the control listener of the process, until
+// the process is ready, or ctx is done, in which case it returns the context
+// error.  It returns ErrNotRunning, if the process is not running.
+func (p *Process) WaitReadyRemote(ctx context.Context) error {
+	tick := time.NewTicker(pollInterval)
+	defer tick.Stop()
+	for {
+		resp, err := p.control(cmdReady)
+		if err != nil {
+			return err
+		}
+		switch resp {
+		case cmdOK:
+			return nil
+		case respNotReady:
+		default:
+			return errors.New(resp)
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-tick.C:
+		}
+	}
+}
+
+// readyResponse returns the response to the ready command.
+func (p *Process) readyResponse() string {
+	if p.ready.Load() {
+		return cmdOK
+	}
+	return respNotReady
+}
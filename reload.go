@@ -0,0 +1,123 @@
+package gotsr
+
+import (
+	"errors"
+	"fmt"
+)
+
+// ErrNeedsRestart is returned by the OnReload function, if the new
+// configuration can't be applied in place, and the process must be
+// restarted.
+var ErrNeedsRestart = errors.New("restart is required to apply the configuration")
+
+// OnReload registers the function that applies the new configuration in the
+// TSR process, when it's requested with Reload or Apply, or the process
+// receives SIGHUP on POSIX.  The functions are called sequentially in the
+// order of registration, and the reloads do not overlap.  A panic in the
+// function is recovered and reported as its error, and the rest of the
+// functions are still called.  The function returns ErrNeedsRestart, if the
+// change requires the restart.  If no function is registered, the process is
+// restarted on Apply.  It should be called before TSR() is called.
+func (p *Process) OnReload(fn func() error) {
+	p.onReload = append(p.onReload, fn)
+}
+
+// Reload requests the running TSR process to reload the configuration with
+// the OnReload functions.  On POSIX, it sends SIGHUP to the process, and does
+// not wait for the reload.  On Windows, and in the ControlSocket mode, it
+// sends the reload command, waits for the reload and returns its error.
+func (p *Process) Reload() error {
+	return reload(p.pidFile, p.controlToken)
+}
+
+// Apply makes the new configuration take effect in the running TSR process.
+// It requests the process to reload the configuration in place, and if the
+// process reports that it must be restarted, Apply restarts it as Restart
+// does, if restartIfNeeded is true, or returns ErrNeedsRestart otherwise.
+// As the restart starts the program in the background, Apply should be called
+// instead of TSR, in the same way.  It returns ErrNotPermitted, if the process
+// listens on TCP, and the control token is not set.
+func (p *Process) Apply(restartIfNeeded bool) (headless bool, err error) {
+	if p.stageEnv() != "" {
+		// the detached stages of the restart.
+		return p.Restart()
+	}
+	resp, err := p.control(cmdApply)
+	if err != nil {
+		return false, err
+	}
+	switch resp {
+	case cmdOK:
+		return false, nil
+	case respRestart:
+		if !restartIfNeeded {
+			return false, ErrNeedsRestart
+		}
+		return p.Restart()
+	default:
+		return false, errors.New(resp)
+	}
+}
+
+// runReload calls the OnReload functions.  It returns ErrNeedsRestart, if any
+// of them requires the restart, or the first error otherwise.
+func (p *Process) runReload() error {
+	p.reloadMu.Lock()
+	defer p.reloadMu.Unlock()
+	var (
+		needsRestart bool
+		firstErr     error
+	)
+	for _, fn := range p.onReload {
+		err := callReload(fn)
+		switch {
+		case err == nil:
+		case errors.Is(err, ErrNeedsRestart):
+			needsRestart = true
+		default:
+			if firstErr == nil {
+				firstErr = err
+			}
+		}
+	}
+	if needsRestart {
+		return ErrNeedsRestart
+	}
+	return firstErr
+}
+
+// callReload calls the OnReload function, and returns the panic as the error.
+func callReload(fn func() error) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("reload function panicked: %v", r)
+		}
+	}()
+	return fn()
+}
+
+// applyResponse applies the new configuration, and returns the response to
+// the apply command.
+func (p *Process) applyResponse() string {
+	if len(p.onReload) == 0 {
+		return respRestart
+	}
+	if err := p.runReload(); err != nil {
+		if errors.Is(err, ErrNeedsRestart) {
+			return respRestart
+		}
+		return truncateFrame("reload failed: " + err.Error())
+	}
+	return cmdOK
+}
+
+// reloadResponse reloads the configuration, and returns the response to the
+// reload command.  The error is logged as well, as it's not seen by the
+// operator, if the client ignores it.
+func (p *Process) reloadResponse() string {
+	if err := p.runReload(); err != nil {
+		p.logger().Printf("failed to reload: %s", err)
+		return truncateFrame(err.Error())
+	}
+	return cmdOK
+}
@@ -0,0 +1,75 @@
+package gotsr
+
+import (
+	"context"
+	"strings"
+	"sync"
+)
+
+// Shutdowner is the server that can be shut down gracefully, i.e.
+// *http.Server.
+type Shutdowner interface {
+	Shutdown(ctx context.Context) error
+}
+
+// RegisterServer registers the server, that is shut down when the TSR process
+// terminates, before the AtExit functions are run.  The servers are shut down
+// concurrently, with the context that expires after the shutdown timeout, set
+// with WithShutdownTimeout, or after 10 seconds, if it's not set.  It should be
+// called before TSR() is called.
+func (p *Process) RegisterServer(s Shutdowner) {
+	p.servers = append(p.servers, s)
+}
+
+// shutdownServers shuts down the registered servers concurrently, and returns
+// the errors of all servers that failed to shut down.
+func (p *Process) shutdownServers() error {
+	if len(p.servers) == 0 {
+		return nil
+	}
+	timeout := p.shutdownTimeout
+	if timeout <= 0 {
+		timeout = stopTimeout
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	var (
+		wg   sync.WaitGroup
+		errs = make([]error, len(p.servers))
+	)
+	for i, s := range p.servers {
+		wg.Add(1)
+		go func(i int, s Shutdowner) {
+			defer wg.Done()
+			errs[i] = s.Shutdown(ctx)
+		}(i, s)
+	}
+	wg.Wait()
+
+	var failed shutdownError
+	for _, err := range errs {
+		if err != nil {
+			failed = append(failed, err)
+		}
+	}
+	if len(failed) == 0 {
+		return nil
+	}
+	return failed
+}
+
+// shutdownError is the error of the servers that failed to shut down.
+type shutdownError []error
+
+func (e shutdownError) Error() string {
+	msgs := make([]string, len(e))
+	for i, err := range e {
+		msgs[i] = err.Error()
+	}
+	return "server shutdown: " + strings.Join(msgs, "; ")
+}
+
+func (e shutdownError) Unwrap() []error {
+	return e
+}
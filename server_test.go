@@ -0,0 +1,92 @@
+package gotsr
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeServer records the deadline of the Shutdown context, and takes delay to
+// shut down.
+type fakeServer struct {
+	delay time.Duration
+	err   error
+
+	mu       sync.Mutex
+	deadline time.Time
+	called   bool
+}
+
+func (s *fakeServer) Shutdown(ctx context.Context) error {
+	s.mu.Lock()
+	s.deadline, _ = ctx.Deadline()
+	s.called = true
+	s.mu.Unlock()
+	time.Sleep(s.delay)
+	return s.err
+}
+
+func TestProcess_RegisterServer(t *testing.T) {
+	p, err := New(WithPIDFile("test.pid"), WithShutdownTimeout(time.Second))
+	if err != nil {
+		t.Fatal(err)
+	}
+	servers := []*fakeServer{{delay: 200 * time.Millisecond}, {delay: 200 * time.Millisecond}}
+	for _, s := range servers {
+		p.RegisterServer(s)
+	}
+	var atExitCalled bool
+	p.AtExit(func() {
+		for i, s := range servers {
+			s.mu.Lock()
+			if !s.called {
+				t.Errorf("server %d was not shut down before the AtExit functions", i)
+			}
+			s.mu.Unlock()
+		}
+		atExitCalled = true
+	})
+
+	start := time.Now()
+	if !p.runAtExit() {
+		t.Fatal("runAtExit() = false, want true")
+	}
+	if elapsed := time.Since(start); elapsed >= 400*time.Millisecond {
+		t.Errorf("shutdown took %s, the servers were not shut down concurrently", elapsed)
+	}
+	if !atExitCalled {
+		t.Error("AtExit function was not called")
+	}
+	d := servers[0].deadline
+	if d.IsZero() || d.Sub(start) < time.Second || d.Sub(start) > time.Second+100*time.Millisecond {
+		t.Errorf("deadline = %v, want within the shutdown timeout", d)
+	}
+	if !servers[1].deadline.Equal(d) {
+		t.Errorf("deadlines differ: %v and %v", d, servers[1].deadline)
+	}
+}
+
+func TestProcess_shutdownServers(t *testing.T) {
+	errA := errors.New("a failed")
+	errB := errors.New("b failed")
+	var p Process
+	p.RegisterServer(&fakeServer{err: errA})
+	p.RegisterServer(&fakeServer{})
+	p.RegisterServer(&fakeServer{err: errB})
+
+	err := p.shutdownServers()
+	var se shutdownError
+	if !errors.As(err, &se) {
+		t.Fatalf("shutdownServers() error = %v, want shutdownError", err)
+	}
+	if len(se) != 2 || se[0] != errA || se[1] != errB {
+		t.Errorf("shutdownServers() errors = %v, want [%v %v]", se, errA, errB)
+	}
+
+	var none Process
+	if err := none.shutdownServers(); err != nil {
+		t.Errorf("shutdownServers() error = %v, want nil", err)
+	}
+}
@@ -0,0 +1,154 @@
+package gotsr
+
+import (
+	"errors"
+	"strings"
+	"syscall"
+	"unsafe"
+)
+
+var (
+	procOpenSCManagerW     = advapi32.NewProc("OpenSCManagerW")
+	procCreateServiceW     = advapi32.NewProc("CreateServiceW")
+	procOpenServiceW       = advapi32.NewProc("OpenServiceW")
+	procDeleteService      = advapi32.NewProc("DeleteService")
+	procCloseServiceHandle = advapi32.NewProc("CloseServiceHandle")
+)
+
+var (
+	errServiceNameNotSet   = errors.New("service name is not set, see WithWindowsService")
+	errServiceExists       = errors.New("service already exists")
+	errServiceDoesNotExist = errors.New("service does not exist")
+	errServiceAccessDenied = errors.New("access to the service control manager is denied")
+)
+
+const (
+	scManagerConnect       = 0x0001
+	scManagerCreateService = 0x0002
+
+	serviceAllAccess    = 0xF01FF
+	serviceAccessDelete = 0x10000
+	serviceAutoStart    = 0x00000002
+	serviceErrorNormal  = 0x00000001
+
+	errorAccessDenied        = 5
+	errorServiceDoesNotExist = 1060
+	errorServiceExists       = 1073
+)
+
+// InstallService creates the Windows service, set with WithWindowsService,
+// that starts automatically.  The service runs the executable, set with
+// WithExecutable, with the arguments of the detached process, so the flag
+// that requests the installation should be removed with WithArgFilter.  If
+// displayName is empty, the service name is used.  It requires the
+// administrator rights.
+func (p *Process) InstallService(displayName string) error {
+	if p.serviceName == "" {
+		return errServiceNameNotSet
+	}
+	image, err := p.image()
+	if err != nil {
+		return err
+	}
+	cmdline := []string{syscall.EscapeArg(image)}
+	for _, arg := range p.childArgs() {
+		cmdline = append(cmdline, syscall.EscapeArg(arg))
+	}
+	m, err := openSCManager(scManagerConnect | scManagerCreateService)
+	if err != nil {
+		return err
+	}
+	defer closeServiceHandle(m)
+
+	name, err := syscall.UTF16PtrFromString(p.serviceName)
+	if err != nil {
+		return err
+	}
+	display, err := syscall.UTF16PtrFromString(nz(displayName, p.serviceName))
+	if err != nil {
+		return err
+	}
+	path, err := syscall.UTF16PtrFromString(strings.Join(cmdline, " "))
+	if err != nil {
+		return err
+	}
+	h, _, err := procCreateServiceW.Call(
+		m,
+		uintptr(unsafe.Pointer(name)),
+		uintptr(unsafe.Pointer(display)),
+		serviceAllAccess,
+		serviceWin32OwnProcess,
+		serviceAutoStart,
+		serviceErrorNormal,
+		uintptr(unsafe.Pointer(path)),
+		0, 0, 0, 0, 0,
+	)
+	if h == 0 {
+		return serviceError(err)
+	}
+	closeServiceHandle(h)
+	return nil
+}
+
+// RemoveService deletes the Windows service, set with WithWindowsService.  The
+// running service is deleted, once it stops.  It requires the administrator
+// rights.
+func (p *Process) RemoveService() error {
+	if p.serviceName == "" {
+		return errServiceNameNotSet
+	}
+	m, err := openSCManager(scManagerConnect)
+	if err != nil {
+		return err
+	}
+	defer closeServiceHandle(m)
+
+	name, err := syscall.UTF16PtrFromString(p.serviceName)
+	if err != nil {
+		return err
+	}
+	h, _, err := procOpenServiceW.Call(m, uintptr(unsafe.Pointer(name)), serviceAccessDelete)
+	if h == 0 {
+		return serviceError(err)
+	}
+	defer closeServiceHandle(h)
+	if r, _, err := procDeleteService.Call(h); r == 0 {
+		return serviceError(err)
+	}
+	return nil
+}
+
+// openSCManager connects to the service control manager of the local
+// computer with the given access rights.
+func openSCManager(access uint32) (uintptr, error) {
+	h, _, err := procOpenSCManagerW.Call(0, 0, uintptr(access))
+	if h == 0 {
+		return 0, serviceError(err)
+	}
+	return h, nil
+}
+
+// closeServiceHandle closes the handle of the service or the service control
+// manager.
+func closeServiceHandle(h uintptr) {
+	_, _, _ = procCloseServiceHandle.Call(h)
+}
+
+// serviceError maps the errors of the service control manager calls, that
+// the caller may handle, to the package errors.
+func serviceError(err error) error {
+	var errno syscall.Errno
+	if !errors.As(err, &errno) {
+		return err
+	}
+	switch errno {
+	case errorAccessDenied:
+		return errServiceAccessDenied
+	case errorServiceExists:
+		return errServiceExists
+	case errorServiceDoesNotExist:
+		return errServiceDoesNotExist
+	default:
+		return err
+	}
+}
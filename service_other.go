@@ -0,0 +1,15 @@
+//go:build !windows
+
+package gotsr
+
+// InstallService is not supported on this platform, as there are no Windows
+// services.
+func (p *Process) InstallService(displayName string) error {
+	return ErrNotSupported
+}
+
+// RemoveService is not supported on this platform, as there are no Windows
+// services.
+func (p *Process) RemoveService() error {
+	return ErrNotSupported
+}
@@ -0,0 +1,198 @@
+package gotsr
+
+import (
+	"errors"
+	"fmt"
+	"runtime"
+	"syscall"
+	"unsafe"
+)
+
+var (
+	procStartServiceCtrlDispatcherW  = advapi32.NewProc("StartServiceCtrlDispatcherW")
+	procRegisterServiceCtrlHandlerEx = advapi32.NewProc("RegisterServiceCtrlHandlerExW")
+	procSetServiceStatus             = advapi32.NewProc("SetServiceStatus")
+)
+
+const (
+	serviceWin32OwnProcess = 0x00000010
+
+	serviceStopped      = 0x00000001
+	serviceStartPending = 0x00000002
+	serviceStopPending  = 0x00000003
+	serviceRunning      = 0x00000004
+
+	serviceAcceptStop     = 0x00000001
+	serviceAcceptShutdown = 0x00000004
+
+	serviceControlStop        = 0x00000001
+	serviceControlInterrogate = 0x00000004
+	serviceControlShutdown    = 0x00000005
+
+	errorCallNotImplemented             = 120
+	errorFailedServiceControllerConnect = 1063
+)
+
+// serviceStatus is the SERVICE_STATUS structure.
+type serviceStatus struct {
+	ServiceType             uint32
+	CurrentState            uint32
+	ControlsAccepted        uint32
+	Win32ExitCode           uint32
+	ServiceSpecificExitCode uint32
+	CheckPoint              uint32
+	WaitHint                uint32
+}
+
+// serviceTableEntry is the SERVICE_TABLE_ENTRYW structure.
+type serviceTableEntry struct {
+	ServiceName *uint16
+	ServiceProc uintptr
+}
+
+// service is the Windows service running the TSR process.
+type service struct {
+	name string
+	// setStatus reports the service state to the SCM.
+	setStatus func(state uint32) error
+	// stop stops the TSR process.
+	stop func() error
+	// running is closed once the SCM starts the service.
+	running chan struct{}
+	// lg is the logger of the process.
+	lg Logger
+}
+
+// svc is the service of this process.  There can be only one, as the
+// callbacks passed to the SCM can't carry any context.
+var svc *service
+
+var (
+	serviceMainCallback    = syscall.NewCallback(serviceMain)
+	serviceHandlerCallback = syscall.NewCallback(serviceHandler)
+)
+
+// runService runs the process as the Windows service, if it was started by
+// the Service Control Manager.  It returns false, if the process is not
+// running as a service.  When the SCM requests the service to stop, the TSR
+// process is terminated in the same way as with Terminate.
+func runService(p *Process) (bool, error) {
+	svc = &service{
+		name:    p.serviceName,
+		stop:    func() error { return terminate(p.logger(), p.pidFile, p.controlToken) },
+		running: make(chan struct{}),
+		lg:      p.logger(),
+	}
+	dispatcherErr := make(chan error, 1)
+	go func() {
+		// StartServiceCtrlDispatcher blocks the calling thread until the
+		// service is stopped.
+		runtime.LockOSThread()
+		dispatcherErr <- startDispatcher(svc.name)
+	}()
+	select {
+	case err := <-dispatcherErr:
+		var errno syscall.Errno
+		if errors.As(err, &errno) && errno == errorFailedServiceControllerConnect {
+			// not running as a service.
+			return false, nil
+		}
+		return false, fmt.Errorf("service dispatcher: %w", err)
+	case <-svc.running:
+	}
+	// report to the SCM that the service is stopped, once the TSR process
+	// finishes the exit routine.
+	p.AtExit(func() {
+		if err := svc.setStatus(serviceStopped); err != nil {
+			svc.lg.Printf("failed to report the service stop: %s", err)
+		}
+	})
+	enterStage(sRunning)
+	if err := stageRun(stageLogger(svc.lg, sRunning), p, p.vars()); err != nil {
+		_ = svc.setStatus(serviceStopped)
+		return false, err
+	}
+	return true, nil
+}
+
+// startDispatcher connects the calling thread to the SCM.
+func startDispatcher(name string) error {
+	n, err := syscall.UTF16PtrFromString(name)
+	if err != nil {
+		return err
+	}
+	table := []serviceTableEntry{
+		{ServiceName: n, ServiceProc: serviceMainCallback},
+		{},
+	}
+	r, _, err := procStartServiceCtrlDispatcherW.Call(uintptr(unsafe.Pointer(&table[0])))
+	if r == 0 {
+		return err
+	}
+	return nil
+}
+
+// serviceMain is the ServiceMain callback, that is called by the SCM on the
+// service start.
+func serviceMain(argc uint32, argv **uint16) uintptr {
+	n, err := syscall.UTF16PtrFromString(svc.name)
+	if err != nil {
+		return 0
+	}
+	h, _, _ := procRegisterServiceCtrlHandlerEx.Call(uintptr(unsafe.Pointer(n)), serviceHandlerCallback, 0)
+	if h == 0 {
+		return 0
+	}
+	svc.setStatus = func(state uint32) error {
+		return setServiceStatus(h, state)
+	}
+	if err := svc.setStatus(serviceRunning); err != nil {
+		return 0
+	}
+	close(svc.running)
+	// the service runs until the process exits.
+	select {}
+}
+
+// serviceHandler is the HandlerEx callback, that is called by the SCM to
+// control the service.
+func serviceHandler(ctl uint32, eventType uint32, eventData uintptr, context uintptr) uintptr {
+	return svc.handle(ctl)
+}
+
+// handle handles the control request from the SCM.  Stop and shutdown
+// requests are mapped to the termination of the TSR process.
+func (s *service) handle(ctl uint32) uintptr {
+	switch ctl {
+	case serviceControlStop, serviceControlShutdown:
+		if err := s.setStatus(serviceStopPending); err != nil {
+			s.lg.Printf("failed to report the service stop pending: %s", err)
+		}
+		go func() {
+			if err := s.stop(); err != nil {
+				s.lg.Printf("failed to stop the service: %s", err)
+			}
+		}()
+		return 0
+	case serviceControlInterrogate:
+		return 0
+	default:
+		return errorCallNotImplemented
+	}
+}
+
+// setServiceStatus reports the service state to the SCM.
+func setServiceStatus(h uintptr, state uint32) error {
+	st := serviceStatus{
+		ServiceType:  serviceWin32OwnProcess,
+		CurrentState: state,
+	}
+	if state == serviceRunning {
+		st.ControlsAccepted = serviceAcceptStop | serviceAcceptShutdown
+	}
+	r, _, err := procSetServiceStatus.Call(h, uintptr(unsafe.Pointer(&st)))
+	if r == 0 {
+		return err
+	}
+	return nil
+}
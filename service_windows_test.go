@@ -0,0 +1,93 @@
+package gotsr
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func Test_service_handle(t *testing.T) {
+	tests := []struct {
+		name       string
+		ctl        uint32
+		want       uintptr
+		wantStatus []uint32
+		wantStop   bool
+	}{
+		{"stop", serviceControlStop, 0, []uint32{serviceStopPending}, true},
+		{"shutdown", serviceControlShutdown, 0, []uint32{serviceStopPending}, true},
+		{"interrogate", serviceControlInterrogate, 0, nil, false},
+		{"unsupported", 0x00000002 /* pause */, errorCallNotImplemented, nil, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var status []uint32
+			stopped := make(chan struct{})
+			s := &service{
+				setStatus: func(state uint32) error {
+					status = append(status, state)
+					return nil
+				},
+				stop: func() error {
+					close(stopped)
+					return nil
+				},
+			}
+			if got := s.handle(tt.ctl); got != tt.want {
+				t.Errorf("handle() = %v, want %v", got, tt.want)
+			}
+			if len(status) != len(tt.wantStatus) {
+				t.Fatalf("reported status = %v, want %v", status, tt.wantStatus)
+			}
+			for i := range status {
+				if status[i] != tt.wantStatus[i] {
+					t.Errorf("reported status[%d] = %v, want %v", i, status[i], tt.wantStatus[i])
+				}
+			}
+			select {
+			case <-stopped:
+				if !tt.wantStop {
+					t.Error("unexpected stop")
+				}
+			case <-time.After(time.Second):
+				if tt.wantStop {
+					t.Error("stop was not called")
+				}
+			}
+		})
+	}
+}
+
+func TestProcess_InstallService(t *testing.T) {
+	p, err := New(WithPIDFile(filepath.Join(t.TempDir(), "test.pid")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := p.InstallService(""); !errors.Is(err, errServiceNameNotSet) {
+		t.Errorf("InstallService() error = %v, want %v", err, errServiceNameNotSet)
+	}
+
+	name := fmt.Sprintf("gotsr-test-%d", os.Getpid())
+	p, err = New(WithPIDFile(filepath.Join(t.TempDir(), "test.pid")), WithWindowsService(name), WithArgs([]string{"-test.run=^$"}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := p.InstallService("gotsr test service"); err != nil {
+		if errors.Is(err, errServiceAccessDenied) {
+			t.Skip("requires the administrator rights")
+		}
+		t.Fatal(err)
+	}
+	if err := p.InstallService(""); !errors.Is(err, errServiceExists) {
+		t.Errorf("second InstallService() error = %v, want %v", err, errServiceExists)
+	}
+	if err := p.RemoveService(); err != nil {
+		t.Fatal(err)
+	}
+	if err := p.RemoveService(); !errors.Is(err, errServiceDoesNotExist) {
+		t.Errorf("second RemoveService() error = %v, want %v", err, errServiceDoesNotExist)
+	}
+}
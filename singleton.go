@@ -0,0 +1,30 @@
+package gotsr
+
+import (
+	"errors"
+	"fmt"
+	"path/filepath"
+	"strings"
+)
+
+// ErrAlreadyRunning is returned by TSR, if the machine singleton lock is held
+// by another process.
+var ErrAlreadyRunning = errors.New("already running")
+
+// lockDir is the directory of the machine singleton lock files on POSIX
+// systems.
+var lockDir = "/run/gotsr"
+
+// lockPath returns the path of the lock file of the machine singleton.
+func lockPath(name string) string {
+	return filepath.Join(lockDir, name+".lock")
+}
+
+// validateSingleton checks that the singleton name can be used as the name of
+// the lock file and the named mutex.
+func validateSingleton(name string) error {
+	if strings.ContainsAny(name, `/\`) || name == "." || name == ".." {
+		return fmt.Errorf("invalid singleton name %q: must not contain path separators", name)
+	}
+	return nil
+}
@@ -0,0 +1,63 @@
+//go:build linux || darwin || freebsd || openbsd || netbsd || dragonfly
+
+package gotsr
+
+import (
+	"errors"
+	"os"
+	"syscall"
+)
+
+// singletonLock is the machine singleton lock held by the TSR process until
+// it exits.
+var singletonLock *os.File
+
+// lockSingleton acquires the machine singleton lock.  It returns
+// ErrAlreadyRunning, if the lock is held by another process.  The lock is
+// held while the returned file, or any of its duplicates, are open, so it can
+// be passed to the child process.
+func lockSingleton(name string) (*os.File, error) {
+	if err := os.MkdirAll(lockDir, 0755); err != nil {
+		return nil, err
+	}
+	f, err := flock(lockPath(name))
+	if errors.Is(err, errLocked) {
+		return nil, ErrAlreadyRunning
+	}
+	return f, err
+}
+
+// flock opens the file at path, creating it if necessary, and acquires the
+// exclusive lock on it.  It returns errLocked, if the lock is held by another
+// process.
+func flock(path string) (*os.File, error) {
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+	if err := syscall.Flock(int(f.Fd()), syscall.LOCK_EX|syscall.LOCK_NB); err != nil {
+		f.Close()
+		if errors.Is(err, syscall.EWOULDBLOCK) {
+			return nil, errLocked
+		}
+		return nil, err
+	}
+	return f, nil
+}
+
+// holdSingleton makes the TSR process hold the machine singleton lock.  If the
+// lock was inherited from the parent, it's already held on lockFd, otherwise
+// it is acquired.
+func holdSingleton(name string, inherited bool) error {
+	if inherited {
+		syscall.CloseOnExec(lockFd)
+		singletonLock = os.NewFile(lockFd, lockPath(name))
+		return nil
+	}
+	f, err := lockSingleton(name)
+	if err != nil {
+		return err
+	}
+	singletonLock = f
+	return nil
+}
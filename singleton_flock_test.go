@@ -0,0 +1,105 @@
+//go:build linux || darwin || freebsd || openbsd || netbsd || dragonfly
+
+package gotsr
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func init() {
+	registerHelper(new(singletonHelper))
+}
+
+// singletonHelper sets the machine singleton name of the helper, with its
+// lock file in LockDir.
+type singletonHelper struct{ Name, LockDir string }
+
+func (f *singletonHelper) apply(h *helper) error {
+	lockDir = f.LockDir
+	h.opts = append(h.opts, WithMachineSingleton(f.Name))
+	return nil
+}
+
+func TestWithMachineSingleton(t *testing.T) {
+	dir := t.TempDir()
+	lockDir := filepath.Join(dir, "lock")
+	// different PID files, but the same singleton name.
+	pidFiles := []string{filepath.Join(dir, "a.pid"), filepath.Join(dir, "b.pid")}
+
+	var (
+		wg   sync.WaitGroup
+		errs = make([]error, len(pidFiles))
+		outs = make([]string, len(pidFiles))
+	)
+	for i := range pidFiles {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			cmd := helperCommand(t, helperConfig{PIDFile: pidFiles[i]}, &singletonHelper{Name: "test", LockDir: lockDir})
+			out, err := cmd.CombinedOutput()
+			errs[i], outs[i] = err, string(out)
+		}(i)
+	}
+	wg.Wait()
+
+	var winner string
+	for i, err := range errs {
+		if err == nil {
+			if winner != "" {
+				t.Fatal("both processes started")
+			}
+			winner = pidFiles[i]
+			continue
+		}
+		if !strings.Contains(outs[i], ErrAlreadyRunning.Error()) {
+			t.Errorf("helper %d output = %q, want %q", i, outs[i], ErrAlreadyRunning)
+		}
+	}
+	if winner == "" {
+		t.Fatal("no process started")
+	}
+
+	p, err := New(WithPIDFile(winner))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := p.Terminate(); err != nil {
+		t.Fatal(err)
+	}
+	if err := waitExit(winner, stopTimeout); err != nil {
+		t.Fatal(err)
+	}
+	// the lock is released once the process exits, which happens shortly
+	// after the PID file is removed.
+	var lock *os.File
+	for deadline := time.Now().Add(10 * time.Second); ; time.Sleep(pollInterval) {
+		if lock, err = lockSingletonIn(lockDir, "test"); err == nil || time.Now().After(deadline) {
+			break
+		}
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	lock.Close()
+	if _, err := New(WithMachineSingleton("../test")); err == nil {
+		t.Error("New() expected an error for invalid singleton name")
+	}
+}
+
+// lockSingletonIn acquires the machine singleton lock in the given directory.
+func lockSingletonIn(dir, name string) (*os.File, error) {
+	old := lockDir
+	lockDir = dir
+	defer func() { lockDir = old }()
+	lock, err := lockSingleton(name)
+	if errors.Is(err, ErrAlreadyRunning) {
+		return nil, errors.New("lock was not released")
+	}
+	return lock, err
+}
@@ -0,0 +1,18 @@
+//go:build solaris || aix
+
+package gotsr
+
+import "os"
+
+// singletonLock is always nil on this platform, as there's no flock.
+var singletonLock *os.File
+
+// lockSingleton is not supported on this platform, as there's no flock.
+func lockSingleton(name string) (*os.File, error) {
+	return nil, ErrNotSupported
+}
+
+// holdSingleton is not supported on this platform, as there's no flock.
+func holdSingleton(name string, inherited bool) error {
+	return ErrNotSupported
+}
@@ -0,0 +1,63 @@
+package gotsr
+
+import (
+	"syscall"
+	"unsafe"
+)
+
+var procCreateMutexW = kernel32.NewProc("CreateMutexW")
+
+const errorAlreadyExists = 183
+
+// singletonMutex is the handle of the machine singleton mutex held by the TSR
+// process until it exits.
+var singletonMutex syscall.Handle
+
+// createMutex opens the global named mutex of the machine singleton, creating
+// it if necessary.  It reports whether the mutex already existed.
+func createMutex(name string) (h syscall.Handle, exists bool, err error) {
+	n, err := syscall.UTF16PtrFromString(`Global\gotsr-` + name)
+	if err != nil {
+		return 0, false, err
+	}
+	r, _, err := procCreateMutexW.Call(0, 0, uintptr(unsafe.Pointer(n)))
+	if r == 0 {
+		return 0, false, err
+	}
+	return syscall.Handle(r), err == syscall.Errno(errorAlreadyExists), nil
+}
+
+// lockSingleton acquires the machine singleton mutex.  It returns
+// ErrAlreadyRunning, if the mutex is held by another process.  The mutex
+// exists while any process has it open.
+func lockSingleton(name string) (syscall.Handle, error) {
+	h, exists, err := createMutex(name)
+	if err != nil {
+		return 0, err
+	}
+	if exists {
+		syscall.CloseHandle(h)
+		return 0, ErrAlreadyRunning
+	}
+	return h, nil
+}
+
+// holdSingleton makes the TSR process hold the machine singleton mutex.  If
+// the mutex was acquired by the parent, the process opens it, otherwise it
+// is acquired.
+func holdSingleton(name string, inherited bool) error {
+	if !inherited {
+		h, err := lockSingleton(name)
+		if err != nil {
+			return err
+		}
+		singletonMutex = h
+		return nil
+	}
+	h, _, err := createMutex(name)
+	if err != nil {
+		return err
+	}
+	singletonMutex = h
+	return nil
+}
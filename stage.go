@@ -11,3 +11,7 @@ const (
 	sDetach                       // DETACH
 	sRunning                      // RUN
 )
+
+// enterStage is called when the process enters a stage.  It allows the tests
+// to record the sequence of the stages.
+var enterStage = func(stage) {}
@@ -0,0 +1,131 @@
+package gotsr
+
+import (
+	"encoding/json"
+	"os"
+	"runtime"
+	"sync"
+	"time"
+)
+
+// statusInterval is the default interval of the status file updates.
+const statusInterval = 10 * time.Second
+
+// healthOK is the health of the process that is able to update the status
+// file.
+const healthOK = "ok"
+
+// Status is the snapshot of the TSR process state, that is returned by
+// Process.Status, and written to the status file, set with WithStatusFile, in
+// JSON format.
+type Status struct {
+	// PID is the process ID.
+	PID int `json:"pid"`
+	// StartedAt is the start time of the process.
+	StartedAt time.Time `json:"started_at"`
+	// UpdatedAt is the time of the snapshot.
+	UpdatedAt time.Time `json:"updated_at"`
+	// Uptime is the time elapsed since the start, it's in nanoseconds in JSON.
+	Uptime time.Duration `json:"uptime"`
+	// Addr is the address of the control listener.
+	Addr string `json:"addr,omitempty"`
+	// MemAlloc is the number of bytes of the allocated heap objects.
+	MemAlloc uint64 `json:"mem_alloc"`
+	// MemSys is the number of bytes of memory obtained from the OS.
+	MemSys uint64 `json:"mem_sys"`
+	// Goroutines is the number of goroutines.
+	Goroutines int `json:"goroutines"`
+	// Health is "ok" while the process updates the status file.
+	Health string `json:"health"`
+	// Restarts is the number of times the supervisor, enabled with
+	// WithSupervise, has restarted the crashed process.
+	Restarts int `json:"restarts,omitempty"`
+	// LastExit is the exit status of the last crashed process, if the
+	// process was restarted.
+	LastExit string `json:"last_exit,omitempty"`
+}
+
+// WithStatusFile makes the TSR process write the status snapshot to the file
+// at path every interval, so that it can be monitored without the control
+// listener.  The file is replaced atomically, and removed when the process
+// exits.  Zero or negative interval sets the default of 10 seconds.
+func WithStatusFile(path string, interval time.Duration) Option {
+	return func(p *Process) {
+		if interval <= 0 {
+			interval = statusInterval
+		}
+		p.statusFile = path
+		p.statusInterval = interval
+	}
+}
+
+// startStatus starts writing the status file of the process with the control
+// listener at addr.  It returns the function that stops the writer and
+// removes the file.
+func (p *Process) startStatus(started time.Time, addr string) func() {
+	if p.statusFile == "" {
+		return func() {}
+	}
+	write := func() {
+		st := snapshot(started, addr)
+		st.Restarts, st.LastExit = p.restarts, p.lastExit
+		if err := writeStatus(p.statusFile, st); err != nil {
+			p.logger().Printf("failed to write the status file: %s", err)
+		}
+	}
+	write()
+	done := make(chan struct{})
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		tick := time.NewTicker(p.statusInterval)
+		defer tick.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-tick.C:
+				write()
+			}
+		}
+	}()
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			close(done)
+			<-stopped
+			if !p.handedOver() {
+				os.Remove(p.statusFile)
+			}
+		})
+	}
+}
+
+// snapshot returns the current status of the process started at the given
+// time, with the control listener at addr.
+func snapshot(started time.Time, addr string) Status {
+	var ms runtime.MemStats
+	runtime.ReadMemStats(&ms)
+	now := time.Now()
+	return Status{
+		PID:        os.Getpid(),
+		StartedAt:  started,
+		UpdatedAt:  now,
+		Uptime:     now.Sub(started),
+		Addr:       addr,
+		MemAlloc:   ms.Alloc,
+		MemSys:     ms.Sys,
+		Goroutines: runtime.NumGoroutine(),
+		Health:     healthOK,
+	}
+}
+
+// writeStatus writes the status to the status file.  The file is replaced
+// atomically, so that the readers never see the partially written file.
+func writeStatus(filename string, st Status) error {
+	data, err := json.Marshal(st)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(filename, data, 0644)
+}
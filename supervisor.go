@@ -0,0 +1,92 @@
+package gotsr
+
+import (
+	"errors"
+	"os"
+	"strconv"
+	"syscall"
+	"time"
+)
+
+// ErrNotRestarted is returned by LastExit, if the running TSR process has not
+// been restarted by the supervisor.
+var ErrNotRestarted = errors.New("process has not been restarted")
+
+const (
+	// minSuperviseBackoff is the minimum delay before the restart of the
+	// crashed process, so that the process, that crashes on start, does not
+	// spin.
+	minSuperviseBackoff = 500 * time.Millisecond
+	// maxSuperviseBackoff is the maximum delay, that the doubled delay
+	// reaches.
+	maxSuperviseBackoff = time.Minute
+)
+
+// WithSupervise makes the detached process restart the TSR process, if it
+// crashes, leaving its PID file behind, up to maxRestarts times, with the
+// delay, that starts at backoff, at least half a second, and doubles up to a
+// minute.  It's ignored on Windows, and in the foreground, launchd and systemd
+// modes, where the service manager supervises the process.
+func WithSupervise(maxRestarts int, backoff time.Duration) Option {
+	return func(p *Process) {
+		if backoff < minSuperviseBackoff {
+			backoff = minSuperviseBackoff
+		}
+		p.superviseMax = maxRestarts
+		p.superviseBackoff = backoff
+	}
+}
+
+// LastExit returns the exit code of the last crashed TSR process, that the
+// supervisor, enabled with WithSupervise, has restarted, and the signal that
+// killed it, in which case the code is -1.  The exit status is reset, when the
+// process is started afresh, so it returns ErrNotRestarted, if the running
+// process has not been restarted, and ErrNotRunning, if the process is not
+// running.
+func (p *Process) LastExit() (code int, signal syscall.Signal, err error) {
+	pi, err := p.Info()
+	if err != nil {
+		return 0, 0, err
+	}
+	if pi.Restarts == 0 {
+		return 0, 0, ErrNotRestarted
+	}
+	return pi.LastExitCode, pi.LastSignal, nil
+}
+
+// WithForegroundIf makes TSR run the program in the foreground, as
+// WithForeground does, if fn returns true, i.e. RunningUnderSupervisor.  fn is
+// called once by the launcher, when TSR is called.
+func WithForegroundIf(fn func() bool) Option {
+	return func(p *Process) {
+		p.foregroundIf = fn
+	}
+}
+
+// RunningUnderSupervisor returns true if the program is likely started by the
+// supervisor: by systemd, that sets INVOCATION_ID, or LISTEN_PID for the
+// socket activation, by launchd, that sets XPC_SERVICE_NAME to the job label,
+// or by the init process, i.e. in a container, where the program is PID 1, or
+// its parent is.
+func RunningUnderSupervisor() bool {
+	if os.Getenv("INVOCATION_ID") != "" {
+		return true
+	}
+	if pid, err := strconv.Atoi(os.Getenv("LISTEN_PID")); err == nil && pid == os.Getpid() {
+		return true
+	}
+	if svc := os.Getenv("XPC_SERVICE_NAME"); svc != "" && svc != "0" {
+		return true
+	}
+	return os.Getpid() == 1 || os.Getppid() == 1
+}
+
+// applyForegroundIf switches the launcher to the foreground mode, if the
+// function set with WithForegroundIf reports so.  The detached stages are
+// not checked, as they are the children of init once the parent exits.
+func (p *Process) applyForegroundIf() {
+	if p.foreground || p.foregroundIf == nil || p.stageEnv() != "" {
+		return
+	}
+	p.foreground = p.foregroundIf()
+}
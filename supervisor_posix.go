@@ -0,0 +1,97 @@
+//go:build linux || darwin || freebsd || openbsd || netbsd || dragonfly || solaris || aix
+
+package gotsr
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"strconv"
+	"syscall"
+	"time"
+)
+
+// supervise starts the TSR process with start, and restarts it, if it
+// crashes, until the restarts are exhausted.  It returns, once the process
+// exits normally.  The supervisor holds the locks in files, so that the
+// program is not started by another launcher between the restarts.  The
+// error pipe is passed to the first process only, as the launcher waits for
+// the first start.
+func (p *Process) supervise(lg Logger, vars envVar, files []*os.File, start func([]*os.File) (*exec.Cmd, error)) error {
+	cmd, err := start(files)
+	// the launcher reads the pipe until the TSR process closes it, so the
+	// supervisor must not hold it.
+	if pipe := files[errPipeFd-pidLockFd]; pipe != nil {
+		pipe.Close()
+		files[errPipeFd-pidLockFd] = nil
+	}
+	if err != nil {
+		return err
+	}
+	delay := p.superviseBackoff
+	for restarts := 1; ; restarts++ {
+		err := cmd.Wait()
+		if err == nil {
+			return nil
+		}
+		status := cmd.ProcessState.String()
+		// Terminate removes the PID file before it kills the process, so the
+		// killed process is told from the crashed one as soon as it exits.
+		// The PID file is checked again after the delay, in case the stale
+		// file of the crashed process is removed meanwhile.
+		if !p.crashed(cmd.Process.Pid) {
+			return nil
+		}
+		time.Sleep(delay)
+		if !p.crashed(cmd.Process.Pid) {
+			return nil
+		}
+		if restarts > p.superviseMax {
+			return fmt.Errorf("process crashed with %s, giving up after %d restarts", status, p.superviseMax)
+		}
+		lg.Printf("process %d crashed with %s, restarting (%d of %d)", cmd.Process.Pid, status, restarts, p.superviseMax)
+		os.Setenv(vars.restarts(), strconv.Itoa(restarts))
+		os.Setenv(vars.lastExit(), status)
+		code, sig := exitStatus(cmd.ProcessState)
+		os.Setenv(vars.exitCode(), strconv.Itoa(code))
+		os.Setenv(vars.exitSignal(), strconv.Itoa(int(sig)))
+		if cmd, err = start(files); err != nil {
+			return err
+		}
+		if delay < maxSuperviseBackoff {
+			if delay *= 2; delay > maxSuperviseBackoff {
+				delay = maxSuperviseBackoff
+			}
+		}
+	}
+}
+
+// crashed returns true if the exited process with the given PID has left its
+// PID file behind, i.e. it was not stopped, and did not fail to start.
+func (p *Process) crashed(pid int) bool {
+	cur, err := readPID(p.pidFile)
+	return err == nil && cur == pid
+}
+
+// exitStatus returns the exit code of the exited process, and the signal that
+// killed it, if any, in which case the code is -1.
+func exitStatus(ps *os.ProcessState) (int, syscall.Signal) {
+	if ws, ok := ps.Sys().(syscall.WaitStatus); ok && ws.Signaled() {
+		return -1, ws.Signal()
+	}
+	return ps.ExitCode(), 0
+}
+
+// recoverRestarts reads the number of the restarts and the last exit status,
+// passed by the supervisor.  It returns true, if the process was restarted.
+func (p *Process) recoverRestarts(vars envVar) bool {
+	n, err := strconv.Atoi(os.Getenv(vars.restarts()))
+	if err != nil || n <= 0 {
+		return false
+	}
+	p.restarts, p.lastExit = n, os.Getenv(vars.lastExit())
+	p.lastCode, _ = strconv.Atoi(os.Getenv(vars.exitCode()))
+	sig, _ := strconv.Atoi(os.Getenv(vars.exitSignal()))
+	p.lastSignal = syscall.Signal(sig)
+	return true
+}
@@ -0,0 +1,123 @@
+package gotsr
+
+import (
+	"context"
+	"net"
+	"os"
+	"strconv"
+	"time"
+)
+
+// Environment variables, set by systemd for the Type=notify services.
+const (
+	// notifySocketEnv holds the address of the notification socket.
+	notifySocketEnv = "NOTIFY_SOCKET"
+	// watchdogUsecEnv holds the watchdog timeout in microseconds.
+	watchdogUsecEnv = "WATCHDOG_USEC"
+	// watchdogPIDEnv holds the PID of the process, that must send the
+	// watchdog pings.
+	watchdogPIDEnv = "WATCHDOG_PID"
+)
+
+// WithSystemdNotify enables the systemd notify mode for the Type=notify
+// services.  If the program is started by systemd, that sets NOTIFY_SOCKET,
+// TSR does not detach the program, as systemd expects the main process to
+// stay, but otherwise runs it as the TSR process, as in the launchd mode.
+// Once the PID file is written and the control listener is up, the process
+// reports the readiness with NotifyReady, and, if the watchdog is enabled for
+// the service, sends the watchdog pings at half the watchdog timeout.  The
+// program that finishes its initialisation later should not enable it, but
+// call NotifyReady itself, running in the foreground, i.e. with
+// WithForegroundIf.  Without NOTIFY_SOCKET, the option has no effect.  It is
+// ignored on Windows.
+func WithSystemdNotify() Option {
+	return func(p *Process) {
+		p.sdNotify = true
+	}
+}
+
+// underSystemd returns true if the program should run in the systemd notify
+// mode.
+func underSystemd(p *Process) bool {
+	if !p.sdNotify || p.stageEnv() != "" {
+		return false
+	}
+	return os.Getenv(notifySocketEnv) != ""
+}
+
+// NotifyReady tells systemd that the program is ready, sending "READY=1" to
+// the notification socket.  It does nothing, if NOTIFY_SOCKET is not set, i.e.
+// the program is not started by systemd as the Type=notify service.
+func (p *Process) NotifyReady() error {
+	return sdNotify("READY=1")
+}
+
+// Watchdog sends the watchdog ping, "WATCHDOG=1", to systemd.  The program
+// must call it more often than WatchdogInterval, unless the pings are sent
+// with StartWatchdog, or by the TSR process in the mode set with
+// WithSystemdNotify.  It does nothing, if NOTIFY_SOCKET is not set.
+func (p *Process) Watchdog() error {
+	return sdNotify("WATCHDOG=1")
+}
+
+// WatchdogInterval returns the watchdog timeout of the service, set by systemd
+// in WATCHDOG_USEC, and true, if the watchdog is enabled for this process.
+func WatchdogInterval() (time.Duration, bool) {
+	usec, err := strconv.ParseInt(os.Getenv(watchdogUsecEnv), 10, 64)
+	if err != nil || usec <= 0 {
+		return 0, false
+	}
+	if sPID := os.Getenv(watchdogPIDEnv); sPID != "" {
+		if pid, err := strconv.Atoi(sPID); err != nil || pid != os.Getpid() {
+			// the pings are expected from another process.
+			return 0, false
+		}
+	}
+	return time.Duration(usec) * time.Microsecond, true
+}
+
+// StartWatchdog sends the watchdog pings to systemd at half the watchdog
+// timeout, set in WATCHDOG_USEC, until ctx is cancelled or the TSR process
+// terminates, when the pings are stopped with the AtExit functions.  It does
+// nothing, if the watchdog is not enabled for the process, see
+// WatchdogInterval.  The program running in the mode set with
+// WithSystemdNotify should not call it, as the pings are sent already.  Like
+// AtExit, it should not be called, while the process is terminating.
+func (p *Process) StartWatchdog(ctx context.Context) {
+	interval, ok := WatchdogInterval()
+	if !ok {
+		return
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	p.AtExit(cancel)
+	go func() {
+		tick := time.NewTicker(interval / 2)
+		defer tick.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-tick.C:
+				if err := p.Watchdog(); err != nil {
+					p.logger().Printf("failed to send the watchdog ping: %s", err)
+				}
+			}
+		}
+	}()
+}
+
+// sdNotify sends the state to the systemd notification socket, if it's set.
+// The address that starts with "@" is in the abstract namespace.
+func sdNotify(state string) error {
+	addr := os.Getenv(notifySocketEnv)
+	if addr == "" {
+		return nil
+	}
+	conn, err := net.Dial("unixgram", addr)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	_, err = conn.Write([]byte(state))
+	return err
+}
@@ -0,0 +1,210 @@
+//go:build linux || darwin || freebsd || openbsd || netbsd || dragonfly
+
+package gotsr
+
+import (
+	"context"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func init() {
+	registerHelper(new(systemdHelper))
+}
+
+// fakeNotifySocket listens on the fake systemd notification socket, and sets
+// NOTIFY_SOCKET for the duration of the test.
+func fakeNotifySocket(t *testing.T) *net.UnixConn {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "notify.sock")
+	conn, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: path, Net: "unixgram"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	t.Setenv(notifySocketEnv, path)
+	return conn
+}
+
+// readNotify reads the message from the fake notification socket.
+func readNotify(t *testing.T, conn *net.UnixConn, timeout time.Duration) string {
+	t.Helper()
+	if err := conn.SetReadDeadline(time.Now().Add(timeout)); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 256)
+	n, err := conn.Read(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(buf[:n])
+}
+
+func TestProcess_NotifyReady(t *testing.T) {
+	t.Run("no socket", func(t *testing.T) {
+		t.Setenv(notifySocketEnv, "")
+		if err := (&Process{}).NotifyReady(); err != nil {
+			t.Errorf("NotifyReady() error = %v, want nil", err)
+		}
+		if err := (&Process{}).Watchdog(); err != nil {
+			t.Errorf("Watchdog() error = %v, want nil", err)
+		}
+	})
+	t.Run("socket", func(t *testing.T) {
+		conn := fakeNotifySocket(t)
+		p := &Process{}
+		if err := p.NotifyReady(); err != nil {
+			t.Fatal(err)
+		}
+		if got := readNotify(t, conn, time.Second); got != "READY=1" {
+			t.Errorf("message = %q, want %q", got, "READY=1")
+		}
+		if err := p.Watchdog(); err != nil {
+			t.Fatal(err)
+		}
+		if got := readNotify(t, conn, time.Second); got != "WATCHDOG=1" {
+			t.Errorf("message = %q, want %q", got, "WATCHDOG=1")
+		}
+	})
+}
+
+func TestWatchdogInterval(t *testing.T) {
+	tests := []struct {
+		name   string
+		usec   string
+		pid    string
+		want   time.Duration
+		wantOK bool
+	}{
+		{"unset", "", "", 0, false},
+		{"invalid", "abc", "", 0, false},
+		{"set", "2000000", "", 2 * time.Second, true},
+		{"this process", "2000000", strconv.Itoa(os.Getpid()), 2 * time.Second, true},
+		{"another process", "2000000", "1", 0, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv(watchdogUsecEnv, tt.usec)
+			t.Setenv(watchdogPIDEnv, tt.pid)
+			got, ok := WatchdogInterval()
+			if got != tt.want || ok != tt.wantOK {
+				t.Errorf("WatchdogInterval() = %v, %v, want %v, %v", got, ok, tt.want, tt.wantOK)
+			}
+		})
+	}
+}
+
+func TestProcess_StartWatchdog(t *testing.T) {
+	t.Run("disabled", func(t *testing.T) {
+		fakeNotifySocket(t)
+		t.Setenv(watchdogUsecEnv, "")
+		p := &Process{}
+		p.StartWatchdog(context.Background())
+		if len(p.atExit) != 0 {
+			t.Errorf("StartWatchdog() registered %d AtExit functions, want 0", len(p.atExit))
+		}
+	})
+	t.Run("cancelled", func(t *testing.T) {
+		conn := fakeNotifySocket(t)
+		t.Setenv(watchdogUsecEnv, "100000")
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		p := &Process{}
+		p.StartWatchdog(ctx)
+		if got := readNotify(t, conn, time.Second); got != "WATCHDOG=1" {
+			t.Errorf("message = %q, want %q", got, "WATCHDOG=1")
+		}
+		cancel()
+		assertNoNotify(t, conn)
+	})
+	t.Run("at exit", func(t *testing.T) {
+		conn := fakeNotifySocket(t)
+		t.Setenv(watchdogUsecEnv, "100000")
+		p := &Process{}
+		p.StartWatchdog(context.Background())
+		if got := readNotify(t, conn, time.Second); got != "WATCHDOG=1" {
+			t.Errorf("message = %q, want %q", got, "WATCHDOG=1")
+		}
+		p.runAtExit()
+		assertNoNotify(t, conn)
+	})
+}
+
+// assertNoNotify drains the notification socket, and checks that no more
+// messages arrive.
+func assertNoNotify(t *testing.T, conn *net.UnixConn) {
+	t.Helper()
+	buf := make([]byte, 256)
+	// the ping may be in flight, when the watchdog stops.
+	if err := conn.SetReadDeadline(time.Now().Add(100 * time.Millisecond)); err != nil {
+		t.Fatal(err)
+	}
+	for {
+		if _, err := conn.Read(buf); err != nil {
+			break
+		}
+	}
+	if err := conn.SetReadDeadline(time.Now().Add(200 * time.Millisecond)); err != nil {
+		t.Fatal(err)
+	}
+	if n, err := conn.Read(buf); err == nil {
+		t.Errorf("unexpected notification %q after the watchdog stopped", buf[:n])
+	}
+}
+
+// systemdHelper enables the systemd notify mode of the helper.
+type systemdHelper struct{}
+
+func (f *systemdHelper) apply(h *helper) error {
+	h.opts = append(h.opts, WithSystemdNotify())
+	return nil
+}
+
+func TestWithSystemdNotify(t *testing.T) {
+	conn := fakeNotifySocket(t)
+	t.Setenv(watchdogUsecEnv, "200000")
+	pidFile := filepath.Join(t.TempDir(), "helper.pid")
+	// systemd expects the helper to stay in the foreground.
+	cmd := helperCommand(t, helperConfig{PIDFile: pidFile}, &systemdHelper{})
+	if err := cmd.Start(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		_ = cmd.Process.Kill()
+		_ = cmd.Wait()
+	})
+
+	if got := readNotify(t, conn, 10*time.Second); got != "READY=1" {
+		t.Errorf("message = %q, want %q", got, "READY=1")
+	}
+	if pid, err := readPID(pidFile); err != nil || pid != cmd.Process.Pid {
+		t.Errorf("PID file has PID %d, %v, want %d of the foreground process", pid, err, cmd.Process.Pid)
+	}
+	if got := readNotify(t, conn, time.Second); got != "WATCHDOG=1" {
+		t.Errorf("message = %q, want %q", got, "WATCHDOG=1")
+	}
+}
+
+func TestWithSystemdNotify_disabled(t *testing.T) {
+	conn := fakeNotifySocket(t)
+	pidFile := filepath.Join(t.TempDir(), "helper.pid")
+	// the helper detaches, and does not report the readiness.
+	startHelper(t, helperConfig{PIDFile: pidFile})
+	p, err := New(WithPIDFile(pidFile))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := conn.SetReadDeadline(time.Now().Add(200 * time.Millisecond)); err != nil {
+		t.Fatal(err)
+	}
+	if n, err := conn.Read(make([]byte, 256)); err == nil {
+		t.Errorf("unexpected notification of %d bytes", n)
+	}
+	if err := p.Terminate(); err != nil {
+		t.Fatal(err)
+	}
+}
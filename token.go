@@ -0,0 +1,173 @@
+package gotsr
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+)
+
+// ErrUnauthorized is returned, if the TSR process requires the control token,
+// set with WithControlToken, and it's missing or does not match.
+var ErrUnauthorized = errors.New("invalid control token")
+
+// ErrNotPermitted is returned, if the TSR process refuses the command, that
+// terminates or reconfigures it, as it's sent over the TCP control listener
+// without the control token.
+var ErrNotPermitted = errors.New("command is not permitted without the control token")
+
+// maxToken is the maximum length of the control token, so that it fits in the
+// frame with the auth command.
+const maxToken = maxFrame - len(cmdAuth)
+
+// WithControlToken sets the shared token, that authenticates the control
+// commands, so that the other local users can't terminate or reconfigure the
+// TSR process over the control listener.  The TSR process stores the hash of
+// the token in the PID file, and rejects the commands of the clients that do
+// not present the token, except the liveness check of IsRunning, that does
+// not act.  The launcher must be created with the same token.  The token
+// must not be longer than 250 bytes.  Without the token, the TCP control
+// listener serves only the commands that do not act, so Apply and the
+// listener handoff of Restart need the token, or the unix network.
+func WithControlToken(token string) Option {
+	return func(p *Process) {
+		p.controlToken = token
+	}
+}
+
+// validateToken checks that the token fits in the frame.
+func validateToken(token string) error {
+	if len(token) > maxToken {
+		return fmt.Errorf("control token exceeds %d bytes", maxToken)
+	}
+	return nil
+}
+
+// hashToken returns the hash of the token, that is stored in the PID file,
+// or an empty string, if there's no token.
+func hashToken(token string) string {
+	if token == "" {
+		return ""
+	}
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// tokenMatches returns true if the token matches the hash.
+func tokenMatches(token, hash string) bool {
+	return subtle.ConstantTimeCompare([]byte(hashToken(token)), []byte(hash)) == 1
+}
+
+// WithControlSecret makes the TSR process generate the random secret, that the
+// clients read from the PID file and present before the control commands, if
+// the control token is not set.  The PID file is then readable by the owner
+// only, and the older clients, that do not present the secret, can't control
+// the process.
+func WithControlSecret(b bool) Option {
+	return func(p *Process) {
+		p.useSecret = b
+	}
+}
+
+// newSecret returns the random secret, that authenticates the control commands
+// of the TSR process, if it's enabled with WithControlSecret.
+func newSecret() (string, error) {
+	var b [16]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b[:]), nil
+}
+
+// initSecret generates the control secret of the TSR process, if it's enabled,
+// and the control token is not set.
+func (p *Process) initSecret() error {
+	if !p.useSecret || p.controlToken != "" {
+		return nil
+	}
+	var err error
+	p.controlSecret, err = newSecret()
+	return err
+}
+
+// readAuthorised reads the control command from conn, checking the control
+// token or the secret of the process, if either is set.  The client presents
+// it with the auth command before the command, the response is "ok".  The
+// connection is closed without the response, if it's missing or invalid,
+// and the rejection is logged.  The liveness check does not need the control
+// token, as the clients without the token must be able to check the process,
+// while the secret is read by the clients from the PID file.
+func (p *Process) readAuthorised(lg Logger, conn net.Conn) (cmd string, legacy bool, err error) {
+	cmd, legacy, err = readCommand(conn)
+	if err != nil {
+		return "", false, err
+	}
+	hash, strict := hashToken(p.controlToken), false
+	if hash == "" {
+		hash, strict = hashToken(p.controlSecret), true
+	}
+	if hash == "" {
+		return cmd, legacy, nil
+	}
+	if strings.HasPrefix(cmd, cmdAuth) {
+		if !tokenMatches(strings.TrimPrefix(cmd, cmdAuth), hash) {
+			lg.Printf("rejected the control connection from %s: invalid token", conn.RemoteAddr())
+			return "", false, ErrUnauthorized
+		}
+		if err := writeFrame(conn, []byte(cmdOK)); err != nil {
+			return "", false, err
+		}
+		return readCommand(conn)
+	}
+	if cmd == cmdOK && !strict {
+		return cmd, legacy, nil
+	}
+	lg.Printf("rejected the unauthenticated %q command from %s", cmd, conn.RemoteAddr())
+	return "", false, ErrUnauthorized
+}
+
+// permits returns true if the process serves the command to the client, that
+// has passed readAuthorised.  The commands that terminate or reconfigure the
+// process are not served over the TCP listener, that any local user can
+// connect to, unless the clients are authenticated, while the unix socket is
+// accessible to the owner only.
+func (p *Process) permits(cmd string) bool {
+	switch cmd {
+	case cmdExit, cmdApply, cmdReload, cmdHandoff:
+		return p.controlToken != "" || p.controlSecret != "" || p.network == "unix"
+	default:
+		return true
+	}
+}
+
+// authenticate presents the secret from the PID file, or the token, to the
+// TSR process, recorded in pi, over conn, if the process requires it.  It
+// returns ErrUnauthorized without sending the token, if it does not match the
+// hash in the PID file, or if the process closes the connection.
+func authenticate(conn net.Conn, pi PIDInfo, token string) error {
+	switch {
+	case pi.Secret != "":
+		token = pi.Secret
+	case pi.TokenHash == "":
+		return nil
+	case !tokenMatches(token, pi.TokenHash):
+		return ErrUnauthorized
+	}
+	resp, err := controlRequest(conn, cmdAuth+token)
+	if err != nil {
+		if errors.Is(err, ErrUnresponsive) {
+			return err
+		}
+		return ErrUnauthorized
+	}
+	if resp != cmdOK {
+		return ErrUnauthorized
+	}
+	// the command may not be bound by the control timeout.
+	return conn.SetDeadline(time.Time{})
+}
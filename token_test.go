@@ -0,0 +1,53 @@
+package gotsr
+
+import (
+	"errors"
+	"net"
+	"testing"
+)
+
+func TestProcess_readAuthorised(t *testing.T) {
+	const secret = "0123456789abcdef"
+	tests := []struct {
+		name    string
+		p       *Process
+		pi      PIDInfo
+		token   string
+		cmd     string
+		wantErr error
+	}{
+		{"no token", &Process{}, PIDInfo{}, "", cmdExit, nil},
+		{"secret", &Process{controlSecret: secret}, PIDInfo{Secret: secret}, "", cmdExit, nil},
+		{"secret ping", &Process{controlSecret: secret}, PIDInfo{Secret: secret}, "", cmdOK, nil},
+		{"missing secret", &Process{controlSecret: secret}, PIDInfo{}, "", cmdExit, ErrUnauthorized},
+		{"missing secret ping", &Process{controlSecret: secret}, PIDInfo{}, "", cmdOK, ErrUnauthorized},
+		{"wrong secret", &Process{controlSecret: secret}, PIDInfo{Secret: "wrong"}, "", cmdExit, ErrUnauthorized},
+		{"token", &Process{controlToken: "token"}, PIDInfo{TokenHash: hashToken("token")}, "token", cmdExit, nil},
+		{"missing token", &Process{controlToken: "token"}, PIDInfo{}, "", cmdExit, ErrUnauthorized},
+		{"missing token ping", &Process{controlToken: "token"}, PIDInfo{}, "", cmdOK, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client, server := net.Pipe()
+			defer client.Close()
+			errc := make(chan error, 1)
+			go func() {
+				defer server.Close()
+				cmd, _, err := tt.p.readAuthorised(nilLogger{}, server)
+				if err == nil && cmd != tt.cmd {
+					t.Errorf("readAuthorised() = %q, want %q", cmd, tt.cmd)
+				}
+				errc <- err
+				if err == nil {
+					_ = writeFrame(server, []byte(cmdOK))
+				}
+			}()
+			if err := authenticate(client, tt.pi, tt.token); err == nil {
+				_, _ = request(client, tt.cmd)
+			}
+			if err := <-errc; !errors.Is(err, tt.wantErr) {
+				t.Errorf("readAuthorised() error = %v, want %v", err, tt.wantErr)
+			}
+		})
+	}
+}
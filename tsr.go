@@ -3,32 +3,148 @@
 package gotsr
 
 import (
+	"bytes"
+	"context"
 	"crypto/sha256"
 	"encoding/hex"
 	"errors"
 	"fmt"
 	"log"
+	"net"
 	"os"
+	"os/signal"
 	"path/filepath"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
 )
 
 const (
 	startTimeout = 60 * time.Second
+	stopTimeout  = 10 * time.Second
+	pollInterval = 50 * time.Millisecond
+	// defaultPIDFileMode is the default permissions of the PID file.
+	defaultPIDFileMode os.FileMode = 0644
 )
 
 // try on windows: https://superuser.com/questions/198525/how-can-i-execute-a-windows-command-line-in-background
 
 var (
-	ErrNoPID      = errors.New("PID unknown")
-	ErrNotRunning = errors.New("not running")
+	ErrNoPID        = errors.New("PID unknown")
+	ErrNotRunning   = errors.New("not running")
+	ErrStopTimeout  = errors.New("timed out waiting for the process to exit")
+	ErrNotSupported = errors.New("not supported on this platform")
+	// ErrUnresponsive is returned, if the TSR process accepts the control
+	// connection, but does not respond in time.
+	ErrUnresponsive = errors.New("process is not responding")
+	// ErrInvalidPIDFile is returned, if the PID file can't be parsed, or
+	// lacks the data that is required for the operation.
+	ErrInvalidPIDFile = errors.New("invalid PID file")
 )
 
 type Process struct {
 	pidFile      string
 	startTimeout time.Duration
-	atExit       []func()
+	atExit       []exitGroup
+	meta         map[string]string
+	serviceName  string
+	launchd      bool
+	postStop     func() error
+	network      string
+	keepPIDFile  bool
+	// termTimeout is the time Terminate waits for the process to exit, zero
+	// means that it does not wait.
+	termTimeout  time.Duration
+	forceKill    bool
+	singleton    string
+	stdout       string
+	stderr       string
+	workDir      string
+	pidFormat    PIDFormat
+	chdirRoot    bool
+	notifyPID    int
+	notifyAddr   string
+	args         []string
+	notifyPolicy NotifyFailurePolicy
+	// statusFile is the status file, that is updated every statusInterval.
+	statusFile     string
+	statusInterval time.Duration
+	// stopStatus stops the status file writer of the TSR process.
+	stopStatus func()
+	// shutdownTimeout bounds the time of the AtExit functions, zero means
+	// that there's no bound.
+	shutdownTimeout time.Duration
+	// lg is the logger of the process, the package logger is used if nil.
+	lg Logger
+	// servers are shut down on termination, before the AtExit functions.
+	servers []Shutdowner
+	// onReload apply the new configuration in the TSR process, reloadMu
+	// serialises the reloads.
+	onReload []func() error
+	reloadMu sync.Mutex
+	// onHealth check the health of the program in the TSR process.
+	onHealth []func() error
+	// ready is set, once the program reports the readiness with SetReady.
+	ready atomic.Bool
+	// pidFileMode is the permissions of the PID file.
+	pidFileMode os.FileMode
+	// user and group are the credentials of the TSR process.
+	user  string
+	group string
+	// umask is the umask of the TSR process, if setUmask is true.
+	umask    int
+	setUmask bool
+	// controlMode defines how the TSR process is checked and terminated.
+	controlMode ControlMode
+	// controlAddr is the address of the TCP control listener of the TSR
+	// process, a random loopback port is used, if empty.
+	controlAddr string
+	// controlToken authenticates the control commands, if set.
+	controlToken string
+	// useSecret makes the TSR process generate controlSecret, if there's no
+	// control token, and store it in the PID file.
+	useSecret     bool
+	controlSecret string
+	// foreground makes the program run in the current process.
+	foreground bool
+	// atExitErr are run after the atExit groups in the reverse order.
+	atExitErr []func() error
+	// ho is the state of the listener handoff on Restart.
+	ho handover
+	// instance is the name of the instance of the program, set with
+	// WithInstanceName.
+	instance string
+	// name is the name of the program, set with WithName.
+	name string
+	// executable is the executable file of the detached process, set with
+	// WithExecutable.
+	executable string
+	// argFilter filters the arguments of the detached process, if set.
+	argFilter func([]string) []string
+	// sdNotify enables the systemd notify mode.
+	sdNotify bool
+	// foregroundIf enables the foreground mode, if it returns true.
+	foregroundIf func() bool
+	// startedPID is the PID of the TSR process, that was started by TSR in
+	// this process, it's zero until the detachment completes.
+	startedPID int
+	// superviseMax is the maximum number of the restarts of the crashed TSR
+	// process, superviseBackoff is the delay before the first one.
+	superviseMax     int
+	superviseBackoff time.Duration
+	// restarts and lastExit are the number of the restarts and the exit
+	// status of the crashed process, passed to the restarted TSR process by
+	// the supervisor, lastCode and lastSignal are its exit code and the
+	// signal that killed it.
+	restarts   int
+	lastExit   string
+	lastCode   int
+	lastSignal syscall.Signal
+	// env are the environment variables, set with WithEnv, that are added
+	// to the environment of the detached process.
+	env map[string]string
 }
 
 type Option func(*Process)
@@ -39,45 +155,528 @@ func WithPIDFile(fullpath string) Option {
 	}
 }
 
+// WithStartTimeout sets the time that TSR waits for the detached process to
+// report back, before it returns an error.  Zero or negative duration sets the
+// default of 60 seconds.
+func WithStartTimeout(d time.Duration) Option {
+	return func(p *Process) {
+		if d <= 0 {
+			d = startTimeout
+		}
+		p.startTimeout = d
+	}
+}
+
+// WithTimeout is the same as WithStartTimeout.
+func WithTimeout(d time.Duration) Option {
+	return WithStartTimeout(d)
+}
+
+// WithWindowsService sets the name of the Windows service, that TSR runs the
+// program as, if it's started by the Service Control Manager.  It is ignored
+// on other platforms.
+func WithWindowsService(name string) Option {
+	return func(p *Process) {
+		p.serviceName = name
+	}
+}
+
+// WithLaunchd makes TSR run the program in the foreground as the TSR process
+// on macOS, as launchd expects, which is also the case if the program is
+// detected to be started by launchd.  It is ignored on other platforms.
+func WithLaunchd(b bool) Option {
+	return func(p *Process) {
+		p.launchd = b
+	}
+}
+
+// WithForeground makes TSR run the program as the TSR process in the current
+// process attached to the terminal, i.e. for debugging.  TSR reports the
+// program as headless.
+func WithForeground(b bool) Option {
+	return func(p *Process) {
+		p.foreground = b
+	}
+}
+
+// WithPostStop sets the function that Terminate calls after the TSR process
+// has exited successfully, i.e. to clean up its resources.  Terminate waits
+// for the exit for the terminate timeout, or 10 seconds, and returns
+// ErrStopTimeout if it does not exit in time.
+func WithPostStop(fn func() error) Option {
+	return func(p *Process) {
+		p.postStop = fn
+	}
+}
+
+// WithTerminateTimeout sets the time that Terminate waits for the TSR process
+// to exit, before it returns ErrStopTimeout, or kills the process with
+// WithForceKill.  By default, Terminate does not wait.
+func WithTerminateTimeout(d time.Duration) Option {
+	return func(p *Process) {
+		p.termTimeout = d
+	}
+}
+
+// WithForceKill makes Terminate kill the TSR process, and remove its PID file,
+// if it does not exit within the terminate timeout.  The AtExit functions are
+// not run for the killed process.
+func WithForceKill(b bool) Option {
+	return func(p *Process) {
+		p.forceKill = b
+	}
+}
+
+// WithMachineSingleton makes TSR return ErrAlreadyRunning, if another TSR
+// process with the given name runs on the machine, regardless of the PID file
+// path.  The name is locked with the named mutex on Windows, and the flock on
+// /run/gotsr/<name>.lock on other platforms.
+func WithMachineSingleton(name string) Option {
+	return func(p *Process) {
+		p.singleton = name
+	}
+}
+
+// WithLogFile makes the TSR process append its standard output, standard error
+// and the standard logger output to the file at path, creating it if
+// necessary.  The output written directly to the file descriptors, i.e. by a
+// panic, does not get into the file.
+func WithLogFile(path string) Option {
+	return func(p *Process) {
+		p.stdout = path
+		p.stderr = path
+	}
+}
+
+// WithStdout makes the TSR process append its standard output to the file at
+// path, in the same way as WithLogFile.
+func WithStdout(path string) Option {
+	return func(p *Process) {
+		p.stdout = path
+	}
+}
+
+// WithStderr makes the TSR process append its standard error, and the output
+// of the standard logger, to the file at path, in the same way as WithLogFile.
+func WithStderr(path string) Option {
+	return func(p *Process) {
+		p.stderr = path
+	}
+}
+
+// WithInstanceName sets the name of the instance of the program, that is
+// appended to the inferred PID file name, i.e. "foo-a.pid", and to the names
+// of the environment variables, so that several instances run independently.
+// The name must not contain the path separators.
+func WithInstanceName(name string) Option {
+	return func(p *Process) {
+		p.instance = name
+	}
+}
+
+// WithName sets the name of the program, that the PID file name and the names
+// of the environment variables are derived from instead of the executable, so
+// that one executable can run several programs.  The name must not contain the
+// path separators.
+func WithName(name string) Option {
+	return func(p *Process) {
+		p.name = name
+	}
+}
+
+// WithWorkingDir sets the working directory of the TSR process, i.e. "/" for
+// the classic daemon behaviour, after the relative paths are resolved.  New
+// returns an error, if the directory does not exist.
+func WithWorkingDir(dir string) Option {
+	return func(p *Process) {
+		p.workDir = dir
+	}
+}
+
+// WithChdirRoot makes the TSR process change the working directory to the root
+// directory, or the root of the current drive on Windows, if it's not set with
+// WithWorkingDir.
+func WithChdirRoot(b bool) Option {
+	return func(p *Process) {
+		p.chdirRoot = b
+	}
+}
+
+// WithExecutable sets the executable file, that the detached process is
+// started from, i.e. if the launcher is run through a wrapper or a symlink,
+// that must not be followed.  By default, it's the executable of the launcher.
+func WithExecutable(path string) Option {
+	return func(p *Process) {
+		p.executable = path
+	}
+}
+
+// WithArgs sets the command line arguments, without the program name, that the
+// detached process is started with.  If args is nil, the arguments of the
+// launcher are used.
+func WithArgs(args []string) Option {
+	return func(p *Process) {
+		if args == nil {
+			p.args = nil
+			return
+		}
+		p.args = append([]string{}, args...)
+	}
+}
+
+// WithArgFilter sets the function, that filters a copy of the command line
+// arguments of the detached process on every stage transition, i.e. to strip
+// "-stop".  The function must be idempotent.
+func WithArgFilter(fn func(args []string) []string) Option {
+	return func(p *Process) {
+		p.argFilter = fn
+	}
+}
+
+// WithNotifyTarget makes the TSR process send the readiness notification,
+// SIGUSR1, to the process with the given PID instead of the parent, that does
+// not wait for it then.  It is not supported on Windows.
+func WithNotifyTarget(pid int) Option {
+	return func(p *Process) {
+		p.notifyPID = pid
+	}
+}
+
+// WithNotifyAddr makes the TSR process send the "ok" frame to the listener at
+// addr on the control network instead of notifying the parent, that does not
+// wait for it then.
+func WithNotifyAddr(addr string) Option {
+	return func(p *Process) {
+		p.notifyAddr = addr
+	}
+}
+
+// WithNotifyFailurePolicy sets what the TSR process does, if it fails to send
+// the readiness notification.  The default is NotifyContinue, with
+// NotifyAbort, TSR returns ErrNotifyFailed in the TSR process.
+func WithNotifyFailurePolicy(policy NotifyFailurePolicy) Option {
+	return func(p *Process) {
+		p.notifyPolicy = policy
+	}
+}
+
+// WithEnv adds the environment variables to the environment of the detached
+// process, overriding the ones of the launcher, but not the ones that TSR uses
+// to pass the state between the stages.  The names must not be empty, or
+// contain '=' or NUL.
+func WithEnv(kv map[string]string) Option {
+	return func(p *Process) {
+		p.env = make(map[string]string, len(kv))
+		for k, v := range kv {
+			p.env[k] = v
+		}
+	}
+}
+
+// WithControlNetwork sets the network of the control listener, that is stored
+// in the PID file: "tcp", "tcp4", "tcp6" or "unix" for the owner-only socket
+// next to the PID file.  The default is "unix" on POSIX, unless the TCP
+// address is set, and "tcp" on Windows.
+func WithControlNetwork(network string) Option {
+	return func(p *Process) {
+		p.network = network
+	}
+}
+
+// WithKeepPIDFileOnExit makes the TSR process leave the PID file in place when
+// it exits, i.e. for the post-mortem.  IsRunning reports false for the
+// lingering PID file.
+func WithKeepPIDFileOnExit() Option {
+	return func(p *Process) {
+		p.keepPIDFile = true
+	}
+}
+
+// WithPIDFileMode sets the permissions of the PID file regardless of umask,
+// i.e. 0600 to hide the control address from other users.  The default is
+// 0644.
+func WithPIDFileMode(mode os.FileMode) Option {
+	return func(p *Process) {
+		p.pidFileMode = mode.Perm()
+	}
+}
+
+// WithUmask sets the umask of the TSR process, so that the permissions of the
+// files it creates do not depend on the launching shell.  It's ignored on
+// Windows.
+func WithUmask(mask int) Option {
+	return func(p *Process) {
+		p.umask = mask & 0777
+		p.setUmask = true
+	}
+}
+
+// WithShutdownTimeout limits the time that the TSR process spends running the
+// AtExit functions, after which it exits with the status 1 anyway.  Zero or
+// negative duration, the default, means no limit.
+func WithShutdownTimeout(d time.Duration) Option {
+	return func(p *Process) {
+		p.shutdownTimeout = d
+	}
+}
+
+// WithDebug makes the process log to the standard error with the standard Go
+// logger, unless the logger is set with WithLogger.  The package logger, set
+// with SetLogger, is not changed, so the other processes are not affected.
 func WithDebug(b bool) Option {
 	return func(p *Process) {
-		if b {
-			SetLogger(log.New(os.Stderr, "", log.LstdFlags))
+		if b && p.lg == nil {
+			p.lg = log.New(os.Stderr, "", log.LstdFlags)
 		}
 	}
 }
 
 // New returns new Process.  If caller does not set the PID file path and name
-// explicitely with WithPIDFile option, it is inferred from the executable file
-// name.  So that the PID file for "foo.exe" will be "foo.pid".
+// explicitely with WithPIDFile option, it is inferred from the name, set with
+// WithName, or the executable file name.  So that the PID file for "foo.exe"
+// will be "foo.pid".  The symlinks
+// to the executable are resolved, so the program has the same PID file,
+// whichever name it's started with.
 func New(opts ...Option) (*Process, error) {
 	var p = Process{
 		startTimeout: startTimeout,
+		pidFileMode:  defaultPIDFileMode,
 	}
 	for _, opt := range opts {
 		opt(&p)
 	}
+	if p.network == "" {
+		p.network = p.resolveNetwork()
+	}
+	if err := validateNetwork(p.network); err != nil {
+		return nil, err
+	}
+	if err := validateControlMode(p.controlMode, p.network); err != nil {
+		return nil, err
+	}
+	if err := validateControlAddr(p.controlAddr, p.network); err != nil {
+		return nil, err
+	}
+	if err := validateToken(p.controlToken); err != nil {
+		return nil, err
+	}
+	if err := validatePIDFormat(p.pidFormat); err != nil {
+		return nil, err
+	}
+	if err := validateInstanceName(p.instance); err != nil {
+		return nil, err
+	}
+	if err := validateName(p.name); err != nil {
+		return nil, err
+	}
+	if err := validateEnv(p.env); err != nil {
+		return nil, err
+	}
+	if err := validateSingleton(p.singleton); err != nil {
+		return nil, err
+	}
+	if err := validateCredential(p.user, p.group); err != nil {
+		return nil, err
+	}
+	if p.notifyPID != 0 {
+		if err := validateNotifyTarget(p.notifyPID); err != nil {
+			return nil, err
+		}
+	}
+	if p.notifyAddr != "" {
+		if err := validateNotifyAddr(p.network, p.notifyAddr); err != nil {
+			return nil, err
+		}
+	}
+	if p.executable != "" {
+		var err error
+		if p.executable, err = filepath.Abs(p.executable); err != nil {
+			return nil, err
+		}
+	}
 	if p.pidFile == "" {
-		exe, err := os.Executable()
-		if err != nil {
+		if p.name != "" {
+			p.pidFile = p.name + ".pid"
+		} else {
+			exe, err := p.image()
+			if err != nil {
+				return nil, err
+			}
+			p.pidFile = pidFromExe(resolveSymlinks(exe))
+		}
+		if p.instance != "" {
+			p.pidFile = instancePIDFile(p.pidFile, p.instance)
+		}
+	}
+	if p.workDir == "" && p.chdirRoot {
+		p.workDir = string(filepath.Separator)
+	}
+	if p.workDir != "" {
+		if err := p.resolvePaths(); err != nil {
 			return nil, err
 		}
-		p.pidFile = pidFromExe(exe)
 	}
 
 	return &p, nil
 }
 
+// resolvePaths resolves the working directory, and checks that it exists.  It
+// also resolves the PID file, output and status file paths, as they must point
+// to the same files after the change of the directory.
+func (p *Process) resolvePaths() error {
+	dir, err := filepath.Abs(p.workDir)
+	if err != nil {
+		return err
+	}
+	fi, err := os.Stat(dir)
+	if err != nil {
+		return fmt.Errorf("invalid working directory: %w", err)
+	}
+	if !fi.IsDir() {
+		return fmt.Errorf("invalid working directory: %s is not a directory", dir)
+	}
+	p.workDir = dir
+	if p.pidFile, err = filepath.Abs(p.pidFile); err != nil {
+		return err
+	}
+	for _, path := range []*string{&p.stdout, &p.stderr, &p.statusFile} {
+		if *path == "" {
+			continue
+		}
+		if *path, err = filepath.Abs(*path); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// image returns the executable file of the detached process.
+func (p *Process) image() (string, error) {
+	if p.executable != "" {
+		return p.executable, nil
+	}
+	return os.Executable()
+}
+
+// childArgs returns the command line arguments of the detached process.
+func (p *Process) childArgs() []string {
+	args := p.args
+	if args == nil {
+		args = os.Args[1:]
+	}
+	if p.argFilter != nil {
+		return p.argFilter(append([]string{}, args...))
+	}
+	return args
+}
+
 // pidFromExe returns the PID file name based on the executable file name.
+// Both separators are stripped, so that the Windows path gives the same name
+// on any system.
 func pidFromExe(executable string) string {
 	base := filepath.Base(executable)
-	ext := filepath.Ext(executable)
+	if i := strings.LastIndexAny(base, `/\`); i >= 0 {
+		base = base[i+1:]
+	}
+	ext := filepath.Ext(base)
 	return base[0:len(base)-len(ext)] + ".pid"
 }
 
-// TSR starts the program in the background.
+// resolveSymlinks returns the path with the symlinks resolved.  The path is
+// returned as is, if it can't be resolved, i.e. the file does not exist.
+func resolveSymlinks(path string) string {
+	if resolved, err := filepath.EvalSymlinks(path); err == nil {
+		return resolved
+	}
+	return path
+}
+
+// instancePIDFile returns the PID file name of the instance, that has the
+// instance name appended to the base name of the PID file.
+func instancePIDFile(pidFile, name string) string {
+	ext := filepath.Ext(pidFile)
+	return pidFile[0:len(pidFile)-len(ext)] + "-" + name + ext
+}
+
+// validateInstanceName checks that the instance name can be a part of the
+// file name.
+func validateInstanceName(name string) error {
+	if strings.ContainsAny(name, `/\`+"\x00") {
+		return fmt.Errorf("invalid instance name %q: must not contain path separators", name)
+	}
+	return nil
+}
+
+// validateName checks that the name of the program can be the name of the
+// PID file.
+func validateName(name string) error {
+	if strings.ContainsAny(name, `/\`+"\x00") || name == "." || name == ".." {
+		return fmt.Errorf("invalid name %q: must not contain path separators", name)
+	}
+	return nil
+}
+
+// TSR starts the program in the background.  The launcher and the TSR process
+// hold the lock on the PID file path with the ".lock" suffix, and TSR returns
+// ErrAlreadyStarting or ErrAlreadyRunning, if it's held by another process.
 func (p *Process) TSR() (headless bool, err error) {
-	return tsr(p.pidFile, p.startTimeout, p.atExit...)
+	return p.TSRContext(context.Background())
+}
+
+// TSRContext starts the program in the background, as TSR does.  If ctx is
+// cancelled while the launcher waits for the detached process to start, the
+// process is killed, and TSRContext returns the error that wraps ctx.Err().
+// ctx only affects the launcher.
+func (p *Process) TSRContext(ctx context.Context) (headless bool, err error) {
+	return tsr(ctx, p)
+}
+
+// Restart terminates the running TSR process, waits for it to exit, and then
+// starts the program in the background, as TSR does.  It returns an error, if
+// the old process does not exit within the start timeout, so that two
+// processes never run at the same time.  If the process is not running, it
+// behaves as TSR.  It should be called instead of TSR, in the same way.
+//
+// Restart returns headless as TSR does, rather than just the error, as the new
+// process is the same program, started again: it reaches the Restart call in
+// its detached stages, where Restart returns true, so that the program runs
+// its daemon code, while the launcher gets false and should exit.
+//
+// If the running process has registered the listeners with InheritListener,
+// it starts the new process itself, passing the listeners on, and exits once
+// the new process is ready, see InheritListener.  Restart returns, once the
+// new process is ready, or with the error of the new process, in which case
+// the old one continues to run.
+func (p *Process) Restart() (headless bool, err error) {
+	if p.stageEnv() == "" {
+		// only the launcher stops the old process, the detached stages
+		// just proceed.
+		if handedOver, err := p.handOver(); err != nil || handedOver {
+			return false, err
+		}
+		if err := p.stopOld(); err != nil {
+			return false, err
+		}
+	}
+	return p.TSR()
+}
+
+// stopOld terminates the running TSR process, if any, and waits for it to
+// exit.  It removes the PID file, if the old process left it behind.
+func (p *Process) stopOld() error {
+	running, err := isRunning(p.pidFile)
+	if err != nil {
+		return err
+	}
+	if running {
+		if err := terminate(p.logger(), p.pidFile, p.controlToken); err != nil {
+			return err
+		}
+		if err := waitExit(p.pidFile, p.startTimeout); err != nil {
+			return fmt.Errorf("old process did not exit: %w", err)
+		}
+	}
+	return removeStale(p.pidFile)
 }
 
 // PID returns the PID of the TSR process if it's running.
@@ -85,10 +684,287 @@ func (p *Process) PID() (int, error) {
 	return readPID(p.pidFile)
 }
 
+// ChildPID returns the PID of the TSR process, that was started by TSR or
+// Restart in this process.  The TSR process writes the PID file before it
+// reports the readiness, and the launcher waits for the report, so the PID is
+// available once TSR returns, without reading the PID file.  It returns
+// ErrNoPID if the detachment hasn't completed, or if the TSR process was not
+// started by this process, i.e. in the TSR process, in the foreground mode, or
+// with the notify target.
+func (p *Process) ChildPID() (int, error) {
+	if p.startedPID == 0 {
+		return 0, ErrNoPID
+	}
+	return p.startedPID, nil
+}
+
 // AtExit appends the function to the list of functions that will be executed
 // when the TSR process terminates.  It should be called before TSR() is called.
 func (p *Process) AtExit(fn func()) {
-	p.atExit = append(p.atExit, fn)
+	p.atExit = append(p.atExit, exitGroup{fns: []func(){fn}})
+}
+
+// AtExitGroup appends the function to the named group of functions that will
+// be executed when the TSR process terminates.  The groups and the AtExit
+// functions run in the order of registration, and each group is bounded by
+// its own timeout, set when the group is registered first, so that a slow
+// group does not prevent the following ones from running.  Zero or negative
+// timeout means no limit.  It should be called before TSR() is called.
+func (p *Process) AtExitGroup(name string, timeout time.Duration, fn func()) {
+	for i := range p.atExit {
+		if name != "" && p.atExit[i].name == name {
+			p.atExit[i].fns = append(p.atExit[i].fns, fn)
+			return
+		}
+	}
+	p.atExit = append(p.atExit, exitGroup{name: name, timeout: timeout, fns: []func(){fn}})
+}
+
+// AtExitErr appends the function, that may fail, to the list of functions
+// that will be executed when the TSR process terminates.  The functions run
+// after the AtExit functions and groups, in the reverse order of
+// registration, like the deferred calls.  All of them run, even if some
+// fail, and the errors are logged.  It should be called before TSR() is
+// called.
+func (p *Process) AtExitErr(fn func() error) {
+	p.atExitErr = append(p.atExitErr, fn)
+}
+
+// exitGroup is the group of the AtExit functions.  The AtExit functions
+// registered with AtExit are in the unnamed groups without the timeout.
+type exitGroup struct {
+	name    string
+	timeout time.Duration
+	fns     []func()
+}
+
+// run runs the functions of the group.  It returns false, if they did not
+// complete within the group timeout.
+func (g exitGroup) run() bool {
+	return runBounded(g.timeout, func() {
+		for _, fn := range g.fns {
+			fn()
+		}
+	})
+}
+
+// runAtExit shuts down the registered servers, and runs the AtExit
+// functions.  It returns false, if they did not complete within the shutdown
+// timeout, in which case they are left running.
+func (p *Process) runAtExit() bool {
+	return runBounded(p.shutdownTimeout, func() {
+		if err := p.shutdownServers(); err != nil {
+			p.logger().Printf("%s", err)
+		}
+		for _, g := range p.atExit {
+			if !g.run() {
+				p.logger().Printf("AtExit group %q did not complete in %s", g.name, g.timeout)
+			}
+		}
+		if err := p.runAtExitErr(); err != nil {
+			p.logger().Printf("%s", err)
+		}
+	})
+}
+
+// runAtExitErr runs the AtExitErr functions in the reverse order, and
+// returns their errors.
+func (p *Process) runAtExitErr() error {
+	var failed atExitError
+	for i := len(p.atExitErr) - 1; i >= 0; i-- {
+		if err := p.atExitErr[i](); err != nil {
+			failed = append(failed, err)
+		}
+	}
+	if len(failed) == 0 {
+		return nil
+	}
+	return failed
+}
+
+// atExitError is the error of the AtExitErr functions that failed.
+type atExitError []error
+
+func (e atExitError) Error() string {
+	msgs := make([]string, len(e))
+	for i, err := range e {
+		msgs[i] = err.Error()
+	}
+	return "AtExit: " + strings.Join(msgs, "; ")
+}
+
+func (e atExitError) Unwrap() []error {
+	return e
+}
+
+// runBounded runs fn, and waits for it to complete for at most d.  It returns
+// false if fn did not complete in time, in which case it is left running.
+// Zero or negative d means no limit.
+func runBounded(d time.Duration, fn func()) bool {
+	if d <= 0 {
+		fn()
+		return true
+	}
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		fn()
+	}()
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-done:
+		return true
+	case <-t.C:
+		return false
+	}
+}
+
+// SetMetadata sets the metadata key to the given value.  Metadata is written
+// to the PID file by the TSR process and can be read with Info.  Keys must not
+// be empty or contain "=" or new lines, values must not contain new lines.  It
+// should be called before TSR() is called.
+func (p *Process) SetMetadata(key, value string) error {
+	if err := validateMeta(key, value); err != nil {
+		return err
+	}
+	if p.meta == nil {
+		p.meta = make(map[string]string)
+	}
+	p.meta[key] = value
+	return nil
+}
+
+// Info returns the information stored in the PID file of the TSR process.  It
+// returns ErrNotRunning if the PID file does not exist.  The PID file written
+// by a different version of gotsr is read as far as possible, and the
+// compatibility note is logged.
+func (p *Process) Info() (PIDInfo, error) {
+	pi, err := readInfo(p.pidFile)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return PIDInfo{}, ErrNotRunning
+		}
+		return PIDInfo{}, err
+	}
+	if note := compatNote(pi); note != "" {
+		p.logger().Printf("%s: %s", p.pidFile, note)
+	}
+	return pi, nil
+}
+
+// StartTime returns the time when the TSR process started.  It returns
+// ErrNotRunning if the process is not running.
+func (p *Process) StartTime() (time.Time, error) {
+	running, err := p.IsRunning()
+	if err != nil {
+		return time.Time{}, err
+	}
+	if !running {
+		return time.Time{}, ErrNotRunning
+	}
+	pi, err := p.Info()
+	if err != nil {
+		return time.Time{}, err
+	}
+	if pi.StartedAt.IsZero() {
+		return time.Time{}, errors.New("start time is missing in the PID file")
+	}
+	return pi.StartedAt, nil
+}
+
+// Uptime returns the time elapsed since the TSR process started.  It returns
+// ErrNotRunning if the process is not running.
+func (p *Process) Uptime() (time.Duration, error) {
+	started, err := p.StartTime()
+	if err != nil {
+		return 0, err
+	}
+	return time.Since(started), nil
+}
+
+// Status requests the status of the TSR process over the control listener.
+// It returns ErrNotRunning if the process does not answer.  The restarts of
+// the supervised process are read from the PID file, as they don't fit in the
+// response.
+func (p *Process) Status() (*Status, error) {
+	resp, err := p.control(cmdStatus)
+	if err != nil {
+		return nil, err
+	}
+	st, err := parseStatus(resp)
+	if err != nil {
+		return nil, err
+	}
+	if pi, err := p.Info(); err == nil {
+		if st.Addr == "" {
+			// the address did not fit in the response.
+			st.Addr = pi.Addr
+		}
+		st.Restarts, st.LastExit = pi.Restarts, pi.LastExit
+	}
+	return st, nil
+}
+
+// control sends the command to the control listener of the TSR process, and
+// returns the response.  It returns ErrNotRunning if the process does not
+// answer, and ErrNotPermitted, if the process refuses the command.
+func (p *Process) control(cmd string) (string, error) {
+	pi, err := p.Info()
+	if err != nil {
+		return "", err
+	}
+	if pi.Addr == "" {
+		// the process was started by the older version without the control
+		// listener.
+		return "", ErrNotRunning
+	}
+	conn, err := controlDial(pi.Network, pi.Addr)
+	if err != nil {
+		return "", ErrNotRunning
+	}
+	defer conn.Close()
+	if err := authenticate(conn, pi, p.controlToken); err != nil {
+		return "", err
+	}
+	resp, err := request(conn, cmd)
+	if err != nil {
+		return "", err
+	}
+	if strings.HasPrefix(resp, respNotPermitted) {
+		return "", ErrNotPermitted
+	}
+	return resp, nil
+}
+
+// Addr returns the address of the control listener of the TSR process,
+// *net.TCPAddr or *net.UnixAddr, depending on the control network.  It
+// returns ErrNotRunning if the PID file does not exist or has no address.
+func (p *Process) Addr() (net.Addr, error) {
+	pi, err := p.Info()
+	if err != nil {
+		return nil, err
+	}
+	if pi.Addr == "" {
+		return nil, ErrNotRunning
+	}
+	return resolveAddr(pi.Network, pi.Addr)
+}
+
+// ControlAddr returns the address of the control listener of the TSR process,
+// as stored in the PID file: "host:port" for the TCP listener, or the path of
+// the control socket.  It returns ErrNotRunning if the PID file does not
+// exist, and ErrInvalidPIDFile, if the file has no address, i.e. it was
+// written by the older version or another program.
+func (p *Process) ControlAddr() (string, error) {
+	pi, err := p.Info()
+	if err != nil {
+		return "", err
+	}
+	if pi.Addr == "" {
+		return "", errMissingAddr
+	}
+	return pi.Addr, nil
 }
 
 // IsRunning returns true if the TSR process is running.
@@ -96,32 +972,320 @@ func (p *Process) IsRunning() (bool, error) {
 	return isRunning(p.pidFile)
 }
 
+// Wait blocks until the TSR process exits.  It returns ErrNotRunning, if the
+// process is not running when it's called.  The process is polled, so the
+// exit is noticed with a small delay.  The successor, that the listeners are
+// handed over to on Restart, is waited for as well.
+func (p *Process) Wait() error {
+	return p.WaitContext(context.Background())
+}
+
+// WaitContext blocks until the TSR process exits, or ctx is done, in which
+// case it returns the context error.  It returns ErrNotRunning, if the
+// process is not running when it's called.
+func (p *Process) WaitContext(ctx context.Context) error {
+	running, err := p.IsRunning()
+	if err != nil {
+		return err
+	}
+	if !running {
+		return ErrNotRunning
+	}
+	if err := waitExitContext(ctx, p.pidFile); err != nil {
+		if errors.Is(err, ErrStopTimeout) {
+			return ctx.Err()
+		}
+		return err
+	}
+	return nil
+}
+
 // Terminate instructs the TSR process to terminate if it's running.
 func (p *Process) Terminate() error {
-	return terminate(p.pidFile)
+	if err := terminate(p.logger(), p.pidFile, p.controlToken); err != nil {
+		return err
+	}
+	timeout := p.termTimeout
+	if timeout <= 0 {
+		if p.postStop == nil {
+			return nil
+		}
+		timeout = stopTimeout
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	if err := p.awaitExit(ctx, p.forceKill); err != nil {
+		return err
+	}
+	if p.postStop == nil {
+		return nil
+	}
+	return p.postStop()
+}
+
+// Signal sends the signal to the TSR process, i.e. SIGUSR1 or SIGUSR2 for the
+// application defined purposes.  The process must handle the signal, or it is
+// terminated by the default action.  On Windows, where the signals can't be
+// sent to the other processes, os.Interrupt and SIGTERM terminate the process
+// as Terminate does, but without waiting, SIGHUP reloads it as Reload does,
+// os.Kill kills it, and the other signals return ErrNotSupported.  It returns
+// ErrNotRunning, if the PID file does not exist.
+func (p *Process) Signal(sig os.Signal) error {
+	return signalProcess(p.logger(), p.pidFile, p.controlToken, sig)
+}
+
+// Shutdown stops the TSR process: it instructs the process to terminate, and
+// waits for it to exit until ctx is done.  If the process is still running,
+// it returns ErrStopTimeout, or kills the process, if WithForceKill is set.
+// Once the process has exited, Shutdown removes the PID file, if the process
+// left it behind, and calls the WithPostStop function.  It returns
+// ErrNotRunning, if the process is not running.
+func (p *Process) Shutdown(ctx context.Context) error {
+	running, err := isRunning(p.pidFile)
+	if err != nil {
+		return err
+	}
+	if !running {
+		if err := removeStale(p.pidFile); err != nil {
+			return err
+		}
+		return ErrNotRunning
+	}
+	if err := terminate(p.logger(), p.pidFile, p.controlToken); err != nil {
+		return err
+	}
+	if err := p.awaitExit(ctx, p.forceKill); err != nil {
+		return err
+	}
+	if err := removeStale(p.pidFile); err != nil {
+		return err
+	}
+	if p.postStop == nil {
+		return nil
+	}
+	return p.postStop()
+}
+
+// TerminateTimeout instructs the TSR process to terminate, and waits for it to
+// exit for the duration d.  If the process is still running, it is killed,
+// regardless of WithForceKill, and its PID file is removed, as the process
+// can't remove it.  It calls the WithPostStop function, once the process has
+// exited.
+func (p *Process) TerminateTimeout(d time.Duration) error {
+	if err := terminate(p.logger(), p.pidFile, p.controlToken); err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), d)
+	defer cancel()
+	if err := p.awaitExit(ctx, true); err != nil {
+		return err
+	}
+	if err := removeStale(p.pidFile); err != nil {
+		return err
+	}
+	if p.postStop == nil {
+		return nil
+	}
+	return p.postStop()
+}
+
+// awaitExit waits for the TSR process to exit until ctx is done.  If the
+// process is still running, it returns ErrStopTimeout, or kills the process,
+// if force is true, and waits for the killed process to exit.
+func (p *Process) awaitExit(ctx context.Context, force bool) error {
+	err := waitExitContext(ctx, p.pidFile)
+	if !errors.Is(err, ErrStopTimeout) || !force {
+		return err
+	}
+	p.logger().Printf("process did not exit in time, killing it")
+	pid, err := kill(p.pidFile)
+	if err != nil {
+		return err
+	}
+	if err := waitKilled(pid, stopTimeout); err != nil {
+		return err
+	}
+	// the supervisor of the killed process releases the lock, once it exits.
+	return waitExit(p.pidFile, stopTimeout)
+}
+
+// removeStale removes the PID file left behind by the process that has
+// exited.
+func removeStale(pidFile string) error {
+	if err := os.Remove(pidFile); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// kill kills the TSR process, and returns its PID.  The PID file is removed
+// before the process is killed, as the process can't remove it, and so that
+// the supervisor, that sees the killed process exit, does not restart it.
+// The PID file is restored, if the process can't be killed.
+func kill(pidFile string) (int, error) {
+	pid, err := readPID(pidFile)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return 0, ErrNotRunning
+		}
+		return 0, err
+	} else if pid == 0 {
+		return 0, ErrNoPID
+	}
+	p, err := os.FindProcess(pid)
+	if err != nil {
+		return 0, err
+	}
+	fi, err := os.Stat(pidFile)
+	if err != nil {
+		return 0, err
+	}
+	data, err := os.ReadFile(pidFile)
+	if err != nil {
+		return 0, err
+	}
+	if err := removeStale(pidFile); err != nil {
+		return 0, err
+	}
+	if err := p.Kill(); err != nil {
+		if werr := writeFileAtomic(pidFile, data, fi.Mode().Perm()); werr != nil {
+			return 0, fmt.Errorf("%w, and failed to restore the PID file: %s", err, werr)
+		}
+		return 0, err
+	}
+	return pid, nil
+}
+
+// startupContext returns the context of the parent's wait for the TSR process
+// to start, derived from parent.  It expires after the start timeout, and is
+// cancelled, if the parent receives SIGTERM or an interrupt, so that the
+// parent can clean up the half-started process instead of leaving it
+// orphaned.
+func startupContext(parent context.Context, timeout time.Duration) (context.Context, context.CancelFunc) {
+	ctx, cancel := context.WithTimeout(parent, timeout)
+	ctx, stop := signal.NotifyContext(ctx, syscall.SIGTERM, os.Interrupt)
+	return ctx, func() {
+		stop()
+		cancel()
+	}
+}
+
+// startTimedOut returns true if the startup context, derived from parent,
+// expired because of the start timeout, rather than was cancelled.
+func startTimedOut(parent, ctx context.Context) bool {
+	return parent.Err() == nil && errors.Is(ctx.Err(), context.DeadlineExceeded)
+}
+
+// abortStart cleans up after the interrupted start: it removes the PID file,
+// if the TSR process managed to write it before it was killed.
+func abortStart(lg Logger, pidFile string) {
+	ctx, cancel := context.WithTimeout(context.Background(), stopTimeout)
+	defer cancel()
+	// the launcher holds the PID file lock itself.
+	if err := pollExit(ctx, pidFile, false); err != nil {
+		lg.Printf("failed to wait for the process to exit: %s", err)
+		return
+	}
+	if err := removeStale(pidFile); err != nil {
+		lg.Printf("failed to remove the PID file: %s", err)
+	}
+}
+
+// waitExit waits for the TSR process to exit.  It returns ErrStopTimeout if
+// the process is still running after the timeout.
+func waitExit(pidFile string, timeout time.Duration) error {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	return waitExitContext(ctx, pidFile)
+}
+
+// waitExitContext waits for the TSR process to exit until ctx is done, and for
+// the PID file lock to be released, as the supervisor holds it until it sees
+// the process exit, so that the process can be started again once it returns.
+// It returns ErrStopTimeout if the process is still running after the
+// deadline, or the context error, if ctx is cancelled.
+func waitExitContext(ctx context.Context, pidFile string) error {
+	return pollExit(ctx, pidFile, true)
+}
+
+// pollExit polls the TSR process until it exits, and, if unlocked is true, the
+// PID file lock is released, or ctx is done.
+func pollExit(ctx context.Context, pidFile string, unlocked bool) error {
+	t := time.NewTicker(pollInterval)
+	defer t.Stop()
+	for {
+		running, err := isRunning(pidFile)
+		if err != nil {
+			return err
+		}
+		if !running && !(unlocked && pidLocked(pidFile)) {
+			return nil
+		}
+		select {
+		case <-ctx.Done():
+			if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+				return ErrStopTimeout
+			}
+			return ctx.Err()
+		case <-t.C:
+		}
+	}
+}
+
+// RemoteFDStats returns the number of open file descriptors of the TSR
+// process, and its soft and hard RLIMIT_NOFILE limits, which helps to
+// diagnose descriptor leaks.  On Linux, the stats are read from /proc.  On
+// Windows, the process reports its open handle count, and the limits are
+// zero.  On other platforms, it returns ErrNotSupported.
+func (p *Process) RemoteFDStats() (open int, soft, hard uint64, err error) {
+	return remoteFDStats(p.pidFile, p.controlToken)
+}
+
+// EnvVars returns the names of the environment variables that TSR uses to pass
+// the state between the stages of the process.  The names are derived from the
+// PID file name.
+func (p *Process) EnvVars() []string {
+	return p.vars().all()
 }
 
 // Close removes the PID file.
 func (p *Process) Close() error {
-	_ = os.Remove(p.pidFile)
+	if p.stopStatus != nil {
+		p.stopStatus()
+	}
+	releasePIDLock()
+	if !p.handedOver() {
+		// the PID file belongs to the successor otherwise.
+		_ = os.Remove(p.pidFile)
+	}
 	return nil
 }
 
 // readPID reads the PID from the PID file.
 // PID File format:
-//   PID
-//   data1
-//   ...
-//   dataN
+//
+//	PID
+//	data1
+//	...
+//	dataN
+//
+// The data lines are not read from the file in the JSON format.
 func readPID(filename string, data ...*string) (int, error) {
-	f, err := os.Open(filename)
+	b, err := os.ReadFile(filename)
 	if err != nil {
 		return -1, err
 	}
-	defer f.Close()
+	if isJSON(b) {
+		pi, err := parseInfoJSON(b)
+		if err != nil {
+			return 0, err
+		}
+		return pi.PID, nil
+	}
+	f := bytes.NewReader(b)
 	var pid int
-	if _, err := fmt.Fscanf(f, "%d", &pid); err != nil {
-		return 0, err
+	if _, err := fmt.Fscanf(f, "%d\n", &pid); err != nil {
+		return 0, fmt.Errorf("%w: %s", ErrInvalidPIDFile, err)
 	}
 
 	// read any additional data stored in the file, if given any
@@ -133,19 +1297,43 @@ func readPID(filename string, data ...*string) (int, error) {
 	return pid, nil
 }
 
-func writePID(filename string, PID int, data ...string) error {
-	f, err := os.Create(filename)
+// writePID writes the PID and the data lines to the PID file with the given
+// permissions.  The file is replaced atomically, so that the readers never see
+// the partially written file.
+func writePID(filename string, perm os.FileMode, PID int, data ...string) error {
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "%d\n", PID)
+	for _, s := range data {
+		fmt.Fprintln(&buf, s)
+	}
+	return writeFileAtomic(filename, buf.Bytes(), perm)
+}
+
+// writeFileAtomic writes data to the temporary file next to filename, and
+// renames it to filename.  The temporary file is given the permissions perm
+// before the rename.
+func writeFileAtomic(filename string, data []byte, perm os.FileMode) error {
+	f, err := os.CreateTemp(filepath.Dir(filename), filepath.Base(filename)+".*.tmp")
 	if err != nil {
 		return err
 	}
-	defer f.Close()
-	if _, err := fmt.Fprintf(f, "%d\n", PID); err != nil {
+	if err := f.Chmod(perm); err != nil {
+		f.Close()
+		os.Remove(f.Name())
 		return err
 	}
-	for _, s := range data {
-		if _, err := fmt.Fprintln(f, s); err != nil {
-			return err
-		}
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return err
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(f.Name())
+		return err
+	}
+	if err := os.Rename(f.Name(), filename); err != nil {
+		os.Remove(f.Name())
+		return err
 	}
 	return nil
 }
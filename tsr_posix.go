@@ -3,8 +3,11 @@
 package gotsr
 
 import (
+	"context"
 	"errors"
 	"fmt"
+	"io"
+	"net"
 	"os"
 	"os/exec"
 	"os/signal"
@@ -13,14 +16,37 @@ import (
 	"time"
 )
 
+// Descriptors of the locks, inherited by the detached process as the extra
+// files.
+const (
+	// pidLockFd is the descriptor of the PID file lock.
+	pidLockFd = 3
+	// lockFd is the descriptor of the machine singleton lock.
+	lockFd = 4
+	// errPipeFd is the descriptor of the pipe, over which the TSR process
+	// reports the start error to the parent.
+	errPipeFd = 5
+)
+
+// listenNetwork is the network of the control listener, if neither the
+// network nor the TCP address is set.  The unix socket is accessible to the
+// owner only, unlike the loopback TCP port.
+const listenNetwork = "unix"
+
 var (
 	errInvalidStage = errors.New("invalid stage")
 	errTimeout      = errors.New("stage 1 process timeout")
 )
 
 // tsr is the main function that starts the program in the detached mode.
-func tsr(pidFile string, timeout time.Duration, atExit ...func()) (bool, error) {
-	stg, err := summon(pidFile, timeout, atExit...)
+func tsr(ctx context.Context, p *Process) (bool, error) {
+	p.applyForegroundIf()
+	if p.foreground || underLaunchd(p) || underSystemd(p) {
+		// launchd and systemd expect the program to stay in the foreground.
+		enterStage(sRunning)
+		return true, stageRun(stageLogger(p.logger(), sRunning), p, p.vars())
+	}
+	stg, err := summon(ctx, p)
 	return stg == sRunning, err
 }
 
@@ -36,155 +62,549 @@ func tsr(pidFile string, timeout time.Duration, atExit ...func()) (bool, error)
 //  3. Running: the program is running in the background.
 //
 // It identifies the current stage by reading the STAGE environment variable.
-func summon(pidFile string, timeout time.Duration, atExit ...func()) (stage, error) {
-	image, err := os.Executable()
+func summon(ctx context.Context, p *Process) (stage, error) {
+	image, err := p.image()
 	if err != nil {
 		return sUnknown, err
 	}
 
-	vars := newEnvVar(pidFile) // initialise environment variable base name from pidFile.
-	stage := os.Getenv(vars.stage())
+	vars := p.vars() // initialise environment variable base name from pidFile.
+	lg := p.logger()
+	stage := p.stageEnv()
 	switch stage {
 	default:
 		return sUnknown, errInvalidStage
 	case "": // initial setup and preparing for detachment
-		return sInitialise, stageInit(pidFile, vars, image, timeout)
+		p.clearForeignEnv(lg)
+		enterStage(sInitialise)
+		return sInitialise, stageInit(ctx, stageLogger(lg, sInitialise), p, vars, image)
 	case sDetach.String(): // releasing handles, clean start
-		return sDetach, stageDetach(vars, image)
+		enterStage(sDetach)
+		return sDetach, stageDetach(stageLogger(lg, sDetach), p, vars, image)
 	case sRunning.String(): // running TSR program
-		return sRunning, stageRun(pidFile, vars, atExit)
+		enterStage(sRunning)
+		return sRunning, stageRun(stageLogger(lg, sRunning), p, vars)
 	}
 	// unreachable
 }
 
 // stageInit is the first stage that starts a new detached instance of the
 // program in a new session.
-func stageInit(pidFile string, vars envVar, image string, timeout time.Duration) error {
+func stageInit(parent context.Context, lg Logger, p *Process, vars envVar, image string) error {
 	sig := make(chan os.Signal, 1)
 	signal.Notify(sig, syscall.SIGUSR1)
+	ctx, cancel := startupContext(parent, p.startTimeout)
+	defer cancel()
 
-	os.Setenv(vars.stage(), sDetach.String())
-	os.Setenv(vars.pid(), strconv.Itoa(os.Getpid()))
-
-	cmd := exec.Command(image, os.Args[1:]...)
-	cmd.Env = os.Environ()
+	cmd := exec.Command(image, p.childArgs()...)
+	// the stage variables are passed to the detached process only, so that
+	// the launcher's environment is left intact, if it fails to start.
+	cmd.Env = append(p.childEnv(),
+		vars.stage()+"="+sDetach.String(),
+		vars.pid()+"="+strconv.Itoa(os.Getpid()),
+		vars.key()+"="+p.envKey(),
+	)
 	cmd.Stderr = nil
 	cmd.Stdout = nil
 	cmd.Stdin = nil
 	cmd.SysProcAttr = &syscall.SysProcAttr{Setsid: true}
+	// the detached process inherits the locks and holds them until it exits.
+	plock, err := lockPIDFile(p.pidFile)
+	if err != nil {
+		return err
+	}
+	if plock != nil {
+		defer plock.Close()
+	}
+	// the missing files are passed as nil, so that the descriptors stay the
+	// same.
+	cmd.ExtraFiles = []*os.File{plock, nil, nil}
+	if p.singleton != "" {
+		lock, err := lockSingleton(p.singleton)
+		if err != nil {
+			return err
+		}
+		defer lock.Close()
+		cmd.ExtraFiles[lockFd-pidLockFd] = lock
+	}
+	var errPipe *os.File
+	if !p.hasNotifyTarget() {
+		r, w, err := os.Pipe()
+		if err != nil {
+			return err
+		}
+		defer r.Close()
+		errPipe = r
+		cmd.ExtraFiles[errPipeFd-pidLockFd] = w
+	}
 
-	err := cmd.Start()
+	err = cmd.Start()
+	// the parent's end of the pipe is closed, so that the pipe is closed, once
+	// the detached processes close theirs.
+	if w := cmd.ExtraFiles[errPipeFd-pidLockFd]; w != nil {
+		w.Close()
+	}
 	if err != nil {
 		return fmt.Errorf("failed to initialise the process: %s", err)
 	}
-	timer := time.After(timeout)
-	select {
-	case <-sig:
-		pid, err := readPID(pidFile)
-		if err != nil {
-			lg.Printf("process started, but PID file is missing: %s", err)
-		} else if pid == 0 {
-			lg.Println("warning: process started, but PID is 0")
-		} else {
-			lg.Printf("process started with PID: %d", pid)
+	if p.hasNotifyTarget() {
+		// the readiness notification goes to the target.
+		return nil
+	}
+	errc := make(chan string, 1)
+	go func() {
+		msg, _ := io.ReadAll(errPipe)
+		errc <- string(msg)
+	}()
+	for {
+		select {
+		case msg := <-errc:
+			if msg != "" {
+				return errors.New(msg)
+			}
+			// the pipe is closed on success as well, the signal follows.
+			errc = nil
+		case <-sig:
+			// the TSR process writes the PID file before it sends the
+			// signal, so the PID file holds its PID.
+			pid, err := readPID(p.pidFile)
+			if err != nil {
+				lg.Printf("process started, but PID file is missing: %s", err)
+			} else if pid == 0 {
+				lg.Println("warning: process started, but PID is 0")
+			} else {
+				p.startedPID = pid
+				withAttr(lg, "pid", pid).Printf("process started with PID: %d", pid)
+			}
+			return nil
+		case <-ctx.Done():
+			if startTimedOut(parent, ctx) {
+				return errTimeout
+			}
+			// the detached processes share the new session's process group,
+			// the group is killed, so that the RUN stage process is not
+			// orphaned.
+			if err := syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL); err != nil {
+				lg.Printf("failed to kill the process group: %s", err)
+			}
+			_ = cmd.Wait()
+			abortStart(lg, p.pidFile)
+			return fmt.Errorf("start interrupted: %w", ctx.Err())
 		}
-	case <-timer:
-		return errTimeout
 	}
-	return nil
 }
 
 // stageDetach starts a new process with the same arguments and environment.
-func stageDetach(vars envVar, image string) error {
+// With WithSupervise, it stays to restart the process, if it crashes.
+func stageDetach(lg Logger, p *Process, vars envVar, image string) error {
 	os.Setenv(vars.stage(), sRunning.String())
 
-	cmd := exec.Command(image, os.Args[1:]...)
+	cred, err := credential(p.user, p.group)
+	if err != nil {
+		return err
+	}
 
-	cmd.Env = os.Environ()
-	cmd.Stdin = nil
-	cmd.Stdout = nil
-	cmd.Stderr = nil
+	// pass on the locks and the error pipe.
+	files := []*os.File{inheritedPIDLock(p.pidFile), nil, nil}
+	if p.singleton != "" {
+		files[lockFd-pidLockFd] = os.NewFile(lockFd, lockPath(p.singleton))
+	}
+	if !p.hasNotifyTarget() {
+		files[errPipeFd-pidLockFd] = os.NewFile(errPipeFd, "error pipe")
+	}
+	start := func(files []*os.File) (*exec.Cmd, error) {
+		cmd := exec.Command(image, p.childArgs()...)
 
-	return cmd.Start()
+		cmd.Env = os.Environ()
+		cmd.Stdin = nil
+		cmd.Stdout = nil
+		cmd.Stderr = nil
+		if cred != nil {
+			// drop the privileges.
+			cmd.SysProcAttr = &syscall.SysProcAttr{Credential: cred}
+		}
+		cmd.ExtraFiles = files
+		return cmd, cmd.Start()
+	}
+	if p.superviseMax > 0 {
+		return p.supervise(lg, vars, files, start)
+	}
+	_, err = start(files)
+	return err
 }
 
-// stageRun runs the main program.
-func stageRun(pidFile string, vars envVar, atExit []func()) error {
-	pid := os.Getpid()
-	if err := writePID(pidFile, pid); err != nil {
+// stageRun runs the main program.  If it fails, the detached process reports
+// the error to the parent.
+func stageRun(lg Logger, p *Process, vars envVar) (err error) {
+	// in the launchd mode, the process is not detached, and there's no
+	// parent to inherit the lock from or to notify.
+	detached := p.stageEnv() == sRunning.String()
+	// the restarted process does not report to the launcher, that waited
+	// only for the first start.
+	restarted := detached && p.recoverRestarts(vars)
+	var errPipe *os.File
+	if detached && !p.hasNotifyTarget() && !restarted {
+		syscall.CloseOnExec(errPipeFd)
+		errPipe = os.NewFile(errPipeFd, "error pipe")
+		defer func() {
+			if errPipe == nil {
+				// closed on success.
+				return
+			}
+			if err != nil {
+				if _, werr := io.WriteString(errPipe, err.Error()); werr != nil {
+					lg.Printf("failed to report the error to the parent process: %s", werr)
+				}
+			}
+			errPipe.Close()
+		}()
+	}
+	if p.setUmask {
+		syscall.Umask(p.umask)
+	}
+	if p.workDir != "" && !p.foreground {
+		if err := os.Chdir(p.workDir); err != nil {
+			return err
+		}
+	}
+	if err := redirectOutput(p.stdout, p.stderr); err != nil {
+		return err
+	}
+	if err := holdPIDLock(p.pidFile, detached); err != nil {
+		return err
+	}
+	if p.singleton != "" {
+		if err := holdSingleton(p.singleton, detached); err != nil {
+			return err
+		}
+	}
+	// the successor inherits the control listener of the predecessor.
+	ln, err := p.recoverListeners(vars)
+	if err != nil {
+		return err
+	}
+	if ln == nil {
+		if ln, err = controlListen(p.network, p.controlAddr, p.pidFile, sRunning); err != nil {
+			return err
+		}
+	}
+	lg = withAttr(withAttr(lg, "pid", os.Getpid()), "addr", ln.Addr().String())
+	if err := p.initSecret(); err != nil {
+		ln.Close()
+		return err
+	}
+	started := time.Now()
+	p.stopStatus = p.startStatus(started, ln.Addr().String())
+	// the handler must be in place before the PID file is written, otherwise
+	// an early SIGTERM kills the process and leaves the PID file behind.
+	quit := make(chan os.Signal, 1)
+	go func() {
+		<-quit
+		code := 0
+		if !p.runAtExit() {
+			lg.Printf("AtExit functions did not complete in %s, exiting", p.shutdownTimeout)
+			code = 1
+		}
+		p.stopStatus()
+		ln.Close()
+		// the lock is released before the PID file is removed, so that the
+		// process can be started again, once the PID file is gone.
+		releasePIDLock()
+		if !p.keepPIDFile && !p.handedOver() {
+			os.Remove(p.pidFile)
+		}
+		os.Exit(code)
+	}()
+	signal.Notify(quit, syscall.SIGTERM, os.Interrupt)
+	// SIGHUP reloads the configuration instead of terminating the process.
+	hup := make(chan os.Signal, 1)
+	go func() {
+		for range hup {
+			if err := p.runReload(); err != nil {
+				lg.Printf("failed to reload: %s", err)
+			}
+		}
+	}()
+	signal.Notify(hup, syscall.SIGHUP)
+
+	pi := PIDInfo{PID: os.Getpid(), StartedAt: started, Addr: ln.Addr().String(), Network: p.network, Control: p.controlMode, Meta: p.meta, Args: os.Args, TokenHash: hashToken(p.controlToken), Secret: p.controlSecret, Restarts: p.restarts, LastExit: p.lastExit, LastExitCode: p.lastCode, LastSignal: p.lastSignal}
+	if err := p.writePIDFile(pi); err != nil {
+		signal.Stop(quit)
+		stopReload(hup)
+		p.stopStatus()
+		ln.Close()
 		return err
 	}
 
-	_ = notifySuccess(vars)
+	if detached && !p.hasNotifyTarget() {
+		// only the detached process, that reports the readiness to its
+		// parent, can hand its listeners over to the successor.
+		p.ho.mu.Lock()
+		p.ho.control, p.ho.pi = ln, pi
+		p.ho.mu.Unlock()
+	}
+	if errPipe != nil {
+		// the pipe is closed before the notification, so that the program
+		// does not see the extra descriptor once the parent returns.
+		errPipe.Close()
+		errPipe = nil
+	}
+	if (detached || p.hasNotifyTarget()) && !restarted {
+		if err := notifySuccess(p, vars); err != nil {
+			if p.notifyPolicy == NotifyAbort {
+				signal.Stop(quit)
+				stopReload(hup)
+				p.stopStatus()
+				ln.Close()
+				os.Remove(p.pidFile)
+				return fmt.Errorf("%w: %s", ErrNotifyFailed, err)
+			}
+			lg.Printf("failed to notify the parent process: %s", err)
+		}
+	}
+	if p.sdNotify {
+		if err := p.NotifyReady(); err != nil {
+			lg.Printf("failed to notify systemd: %s", err)
+		}
+		p.StartWatchdog(context.Background())
+	}
 	// unset the environment variables once the program is running.
-	for _, envVar := range []string{vars.stage(), vars.pid()} {
+	for _, envVar := range vars.all() {
 		os.Unsetenv(envVar)
 	}
 
-	quit := make(chan os.Signal, 1)
 	go func() {
-		<-quit
-		for _, fn := range atExit {
-			fn()
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go serveControl(lg, p, conn, started, quit)
 		}
-		os.Remove(pidFile)
-		os.Exit(0)
 	}()
-	signal.Notify(quit, syscall.SIGTERM, os.Interrupt)
 	return nil
 }
 
-// notifySuccess notifies the parent process that the program has started.
-func notifySuccess(vars envVar) error {
-	sPID := os.Getenv(vars.pid())
-	if pid, err := strconv.Atoi(sPID); err != nil {
-		return fmt.Errorf("invalid pid value: %q, error: %w", sPID, err)
-	} else {
-		p, err := os.FindProcess(pid)
-		if err != nil {
-			return fmt.Errorf("parent process not found: %d: %w", p, err)
+// serveControl handles the control command received over conn, started is
+// the start time of the process.  The exit command is sent to quit as
+// SIGTERM.  The response to the legacy command is sent without the frame.
+// The commands, that the process does not permit, are refused with
+// respNotPermitted.
+func serveControl(lg Logger, p *Process, conn net.Conn, started time.Time, quit chan<- os.Signal) {
+	defer conn.Close()
+	cmd, legacy, err := p.readAuthorised(lg, conn)
+	if err != nil {
+		return
+	}
+	stop := func() {
+		select {
+		case quit <- syscall.SIGTERM:
+		default:
+			// the process is already terminating.
 		}
-		if err := p.Signal(syscall.SIGUSR1); err != nil {
-			return fmt.Errorf("failed to notify parent with PID=%d: %w", pid, err)
+	}
+	var resp string
+	switch {
+	case !p.permits(cmd):
+		lg.Printf("refused the unauthenticated %q command from %s", cmd, conn.RemoteAddr())
+		resp = respNotPermitted + cmd
+	case cmd == cmdOK:
+		resp = cmdOK
+	case cmd == cmdStatus:
+		if resp, err = statusResponse(started, conn.LocalAddr().String()); err != nil {
+			lg.Printf("failed to get the status: %s", err)
+			return
+		}
+	case cmd == cmdApply:
+		resp = p.applyResponse()
+	case cmd == cmdReady:
+		resp = p.readyResponse()
+	case cmd == cmdReload:
+		resp = p.reloadResponse()
+	case cmd == cmdHealth:
+		resp = p.healthResponse()
+	case cmd == cmdHandoff:
+		// the process exits, once the successor has started.
+		if resp = p.handoffResponse(lg); resp == cmdOK {
+			defer stop()
+		}
+	case cmd == cmdExit:
+		resp = cmdOK
+		defer stop()
+	default:
+		resp = respUnknownCommand + cmd
+	}
+	if legacy {
+		err = writeFull(conn, []byte(resp))
+	} else {
+		err = writeFrame(conn, []byte(resp))
+	}
+	if err != nil {
+		lg.Printf("failed to respond to %q: %s", cmd, err)
+	}
+}
+
+// stopReload stops the reloads on SIGHUP.
+func stopReload(hup chan os.Signal) {
+	signal.Stop(hup)
+	close(hup)
+}
+
+// notifySuccess notifies the parent process, or the notify target, that the
+// program has started.
+func notifySuccess(p *Process, vars envVar) error {
+	if p.notifyAddr != "" {
+		return notifyAddr(p.network, p.notifyAddr)
+	}
+	pid := p.notifyPID
+	if pid == 0 {
+		sPID := os.Getenv(vars.pid())
+		var err error
+		if pid, err = strconv.Atoi(sPID); err != nil {
+			return fmt.Errorf("invalid pid value: %q, error: %w", sPID, err)
 		}
 	}
+	proc, err := os.FindProcess(pid)
+	if err != nil {
+		return fmt.Errorf("parent process not found: %d: %w", pid, err)
+	}
+	if err := proc.Signal(syscall.SIGUSR1); err != nil {
+		return fmt.Errorf("failed to notify parent with PID=%d: %w", pid, err)
+	}
 	return nil
 }
 
-// isRunning checks if the process with the given PID is running.
+// validateNotifyTarget checks that the process with the given PID exists.
+func validateNotifyTarget(pid int) error {
+	proc, err := os.FindProcess(pid)
+	if err == nil {
+		err = proc.Signal(syscall.Signal(0))
+	}
+	if err != nil {
+		return fmt.Errorf("invalid notify target %d: %w", pid, err)
+	}
+	return nil
+}
+
+// isRunning checks if the process with the given PID is running.  The
+// process in the ControlSocket mode is checked over the control socket.
 func isRunning(pidFile string) (bool, error) {
-	pid, err := readPID(pidFile)
+	pi, err := readInfo(pidFile)
 	if err != nil {
 		if os.IsNotExist(err) {
 			return false, nil
 		}
 		return false, err
 	}
-	p, err := os.FindProcess(pid)
+	if pi.Control == ControlSocket {
+		return pingControl(pi)
+	}
+	p, err := os.FindProcess(pi.PID)
 	if err != nil {
 		return false, nil
 	}
-	if err := p.Signal(syscall.SIGUSR2); err != nil {
+	// signal 0 only checks that the process exists, SIGUSR2 would kill the
+	// process that does not handle it.
+	if err := p.Signal(syscall.Signal(0)); err != nil {
 		return false, nil
 	}
 	return true, nil
 }
 
-// terminate sends a SIGTERM signal to the process with the given PID.
-func terminate(pidFile string) error {
-	pid, err := readPID(pidFile)
+// waitKilled waits for the killed process with the given PID to exit.  It
+// returns ErrStopTimeout, if the process still exists after the timeout.
+func waitKilled(pid int, timeout time.Duration) error {
+	p, err := os.FindProcess(pid)
+	if err != nil {
+		return nil
+	}
+	for deadline := time.Now().Add(timeout); p.Signal(syscall.Signal(0)) == nil; time.Sleep(pollInterval) {
+		if time.Now().After(deadline) {
+			return ErrStopTimeout
+		}
+	}
+	return nil
+}
+
+// terminate sends a SIGTERM signal to the process with the given PID, or the
+// exit command with the control token, if the process is in the ControlSocket
+// mode.
+func terminate(_ Logger, pidFile, token string) error {
+	pi, err := readInfo(pidFile)
 	if err != nil {
 		if os.IsNotExist(err) {
 			return ErrNotRunning
 		}
 		return err
-	} else if pid == 0 {
+	}
+	if useSocket(pi) {
+		return exitControl(pi, token)
+	}
+	return sendSignal(pidFile, syscall.SIGTERM)
+}
+
+// reload sends a SIGHUP signal to the process with the given PID, or the
+// reload command with the control token, if the process is in the
+// ControlSocket mode.
+func reload(pidFile, token string) error {
+	pi, err := readInfo(pidFile)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return ErrNotRunning
+		}
+		return err
+	}
+	if useSocket(pi) {
+		return reloadControl(pi, token)
+	}
+	return sendSignal(pidFile, syscall.SIGHUP)
+}
+
+// useSocket returns true if the process, recorded in pi, is controlled over
+// the control socket.  If the socket file has been removed, i.e. by the
+// cleaner of the temporary files, while the process is running, the signals
+// are used instead.  The socket of the crashed process is left in place, so
+// the recycled PID is not signalled.
+func useSocket(pi PIDInfo) bool {
+	if pi.Control != ControlSocket {
+		return false
+	}
+	if pi.Addr == "" {
+		// reported as the invalid PID file.
+		return true
+	}
+	_, err := os.Stat(pi.Addr)
+	return !os.IsNotExist(err)
+}
+
+// signalProcess sends the signal to the process with the given PID, the token
+// is not needed for the signal.
+func signalProcess(_ Logger, pidFile, _ string, sig os.Signal) error {
+	return sendSignal(pidFile, sig)
+}
+
+// sendSignal sends the signal to the process with the given PID.  It returns
+// StalePIDError, if the process has exited.
+func sendSignal(pidFile string, sig os.Signal) error {
+	pi, err := readInfo(pidFile)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return ErrNotRunning
+		}
+		return err
+	} else if pi.PID == 0 {
 		return ErrNoPID
 	}
 
-	p, err := os.FindProcess(pid)
+	p, err := os.FindProcess(pi.PID)
 	if err != nil {
 		return err
 	}
-	return p.Signal(syscall.SIGTERM)
+	if err := p.Signal(sig); err != nil {
+		if errors.Is(err, os.ErrProcessDone) || errors.Is(err, syscall.ESRCH) {
+			return &StalePIDError{PID: pi.PID, Addr: pi.Addr}
+		}
+		return err
+	}
+	return nil
 }
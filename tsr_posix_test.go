@@ -0,0 +1,2494 @@
+//go:build linux || darwin || freebsd || openbsd || netbsd || dragonfly || solaris || aix
+
+package gotsr
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func init() {
+	registerHelper(
+		new(metaHelper),
+		new(readyFileHelper),
+		new(crashHelper),
+		new(unhealthyHelper),
+		new(pidFileModeHelper),
+		new(pidFormatHelper),
+		new(umaskHelper),
+		new(stdioHelper),
+		new(controlSecretHelper),
+		new(foregroundHelper),
+		new(workDirHelper),
+		new(foregroundIfHelper),
+		new(controlAddrHelper),
+		new(cancelHelper),
+		new(applyHelper),
+		new(printPIDHelper),
+		new(envHelper),
+		new(keepPIDFileHelper),
+		new(statusFileHelper),
+		new(shutdownTimeoutHelper),
+		new(instanceHelper),
+		new(listenHelper),
+		new(notifyHelper),
+		new(argsHelper),
+		new(executableHelper),
+	)
+}
+
+// metaHelper sets the metadata of the helper.
+type metaHelper struct{ Meta map[string]string }
+
+func (f *metaHelper) apply(h *helper) error {
+	h.setup = append(h.setup, func(p *Process) error {
+		for k, v := range f.Meta {
+			if err := p.SetMetadata(k, v); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	return nil
+}
+
+func TestProcess_Info(t *testing.T) {
+	pidFile := filepath.Join(t.TempDir(), "helper.pid")
+	meta := map[string]string{"deployment": "blue", "commit": "0badc0de"}
+	startHelper(t, helperConfig{PIDFile: pidFile}, &metaHelper{Meta: meta})
+
+	p, err := New(WithPIDFile(pidFile))
+	if err != nil {
+		t.Fatal(err)
+	}
+	pi, err := p.Info()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pi.PID == 0 {
+		t.Error("Info() returned zero PID")
+	}
+	for k, v := range meta {
+		if pi.Meta[k] != v {
+			t.Errorf("Info().Meta[%q] = %q, want %q", k, pi.Meta[k], v)
+		}
+	}
+	if err := p.Terminate(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestProcess_StartTime(t *testing.T) {
+	pidFile := filepath.Join(t.TempDir(), "test.pid")
+	p, err := New(WithPIDFile(pidFile))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := p.StartTime(); !errors.Is(err, ErrNotRunning) {
+		t.Errorf("StartTime() error = %v, want %v", err, ErrNotRunning)
+	}
+	if _, err := p.Uptime(); !errors.Is(err, ErrNotRunning) {
+		t.Errorf("Uptime() error = %v, want %v", err, ErrNotRunning)
+	}
+
+	// the test process is running, so it is used instead of the TSR process.
+	if err := writeInfo(pidFile, PIDInfo{PID: os.Getpid()}, defaultPIDFileMode); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := p.StartTime(); err == nil {
+		t.Error("StartTime() expected an error for the missing start time")
+	}
+
+	started := time.Now().Add(-time.Hour).Truncate(time.Second)
+	if err := writeInfo(pidFile, PIDInfo{PID: os.Getpid(), StartedAt: started}, defaultPIDFileMode); err != nil {
+		t.Fatal(err)
+	}
+	got, err := p.StartTime()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !got.Equal(started) {
+		t.Errorf("StartTime() = %v, want %v", got, started)
+	}
+	uptime, err := p.Uptime()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if uptime < time.Hour || uptime > time.Hour+time.Minute {
+		t.Errorf("Uptime() = %v, want about %v", uptime, time.Hour)
+	}
+}
+
+func TestTSR_interrupted(t *testing.T) {
+	dir := t.TempDir()
+	pidFile := filepath.Join(dir, "helper.pid")
+	stageLog := filepath.Join(dir, "stages.log")
+	cmd := helperCommand(t, helperConfig{PIDFile: pidFile, StageLog: stageLog, StartDelay: time.Second})
+	var out strings.Builder
+	cmd.Stdout = &out
+	cmd.Stderr = &out
+	if err := cmd.Start(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = cmd.Process.Kill() })
+	done := make(chan error, 1)
+	go func() { done <- cmd.Wait() }()
+
+	// the parent waits for the readiness notification, once the process in
+	// the DETACH stage is started.
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		if data, _ := os.ReadFile(stageLog); strings.Contains(string(data), "DETACH") {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("helper did not reach the DETACH stage")
+		}
+		time.Sleep(pollInterval)
+	}
+	if err := cmd.Process.Signal(syscall.SIGTERM); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case err := <-done:
+		if err == nil {
+			t.Fatal("parent exited without an error")
+		}
+		if !strings.Contains(out.String(), context.Canceled.Error()) {
+			t.Errorf("parent output = %q, want %q", out.String(), context.Canceled)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("parent did not exit on SIGTERM")
+	}
+
+	// the RUN stage process would have written the PID file after the delay.
+	time.Sleep(2 * time.Second)
+	if _, err := os.Stat(pidFile); !os.IsNotExist(err) {
+		t.Errorf("the detached process was not killed, PID file: %v", err)
+	}
+	data, err := os.ReadFile(stageLog)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(data), "RUN") {
+		t.Errorf("stages = %q, the RUN stage was entered", data)
+	}
+}
+
+func TestProcess_Status(t *testing.T) {
+	pidFile := filepath.Join(t.TempDir(), "helper.pid")
+	startHelper(t, helperConfig{PIDFile: pidFile})
+
+	p, err := New(WithPIDFile(pidFile))
+	if err != nil {
+		t.Fatal(err)
+	}
+	st, err := p.Status()
+	if err != nil {
+		t.Fatal(err)
+	}
+	pi, err := p.Info()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if st.PID != pi.PID {
+		t.Errorf("Status().PID = %d, want %d", st.PID, pi.PID)
+	}
+	if !st.StartedAt.Equal(pi.StartedAt) {
+		t.Errorf("Status().StartedAt = %v, want %v", st.StartedAt, pi.StartedAt)
+	}
+	if st.Uptime <= 0 || st.Uptime > time.Minute {
+		t.Errorf("Status().Uptime = %v", st.Uptime)
+	}
+	if st.Addr != pi.Addr {
+		t.Errorf("Status().Addr = %q, want %q", st.Addr, pi.Addr)
+	}
+
+	if err := p.Terminate(); err != nil {
+		t.Fatal(err)
+	}
+	if err := waitExit(pidFile, stopTimeout); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := p.Status(); !errors.Is(err, ErrNotRunning) {
+		t.Errorf("Status() error = %v, want %v", err, ErrNotRunning)
+	}
+}
+
+// readyFileHelper makes the detached helper report the readiness, once the
+// file is created.
+type readyFileHelper struct{ File string }
+
+func (f *readyFileHelper) apply(h *helper) error {
+	h.running = append(h.running, func(p *Process) error {
+		go func() {
+			for {
+				if _, err := os.Stat(f.File); err == nil {
+					p.SetReady()
+					return
+				}
+				time.Sleep(pollInterval)
+			}
+		}()
+		return nil
+	})
+	return nil
+}
+
+func TestProcess_WaitReadyRemote(t *testing.T) {
+	dir := t.TempDir()
+	pidFile := filepath.Join(dir, "helper.pid")
+	readyFile := filepath.Join(dir, "ready")
+	startHelper(t, helperConfig{PIDFile: pidFile}, &readyFileHelper{File: readyFile})
+
+	p, err := New(WithPIDFile(pidFile))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the process is running, but not ready yet.
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	if err := p.WaitReadyRemote(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("WaitReadyRemote() error = %v, want %v", err, context.DeadlineExceeded)
+	}
+
+	if err := os.WriteFile(readyFile, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel = context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if err := p.WaitReadyRemote(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := p.Terminate(); err != nil {
+		t.Fatal(err)
+	}
+	if err := waitExit(pidFile, stopTimeout); err != nil {
+		t.Fatal(err)
+	}
+	if err := p.WaitReadyRemote(context.Background()); !errors.Is(err, ErrNotRunning) {
+		t.Errorf("WaitReadyRemote() error = %v, want %v", err, ErrNotRunning)
+	}
+}
+
+func TestProcess_Wait(t *testing.T) {
+	pidFile := filepath.Join(t.TempDir(), "helper.pid")
+	p, err := New(WithPIDFile(pidFile))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := p.Wait(); !errors.Is(err, ErrNotRunning) {
+		t.Fatalf("Wait() error = %v, want %v", err, ErrNotRunning)
+	}
+	startHelper(t, helperConfig{PIDFile: pidFile})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	if err := p.WaitContext(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("WaitContext() error = %v, want %v", err, context.DeadlineExceeded)
+	}
+
+	errc := make(chan error, 1)
+	go func() { errc <- p.Wait() }()
+	time.AfterFunc(200*time.Millisecond, func() { _ = terminate(defaultLogger(), pidFile, "") })
+	select {
+	case err := <-errc:
+		if err != nil {
+			t.Errorf("Wait() error = %v, want nil", err)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("Wait() did not return after the process exited")
+	}
+	if running, err := p.IsRunning(); err != nil || running {
+		t.Errorf("IsRunning() = %v, %v, want false", running, err)
+	}
+}
+
+func TestWithSupervise_crash(t *testing.T) {
+	pidFile := filepath.Join(t.TempDir(), "helper.pid")
+	startHelper(t, helperConfig{PIDFile: pidFile, Supervise: 2})
+	p, err := New(WithPIDFile(pidFile))
+	if err != nil {
+		t.Fatal(err)
+	}
+	crashed, err := p.PID()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := syscall.Kill(crashed, syscall.SIGKILL); err != nil {
+		t.Fatal(err)
+	}
+	var pid int
+	for deadline := time.Now().Add(10 * time.Second); time.Now().Before(deadline); time.Sleep(pollInterval) {
+		if pid, err = p.PID(); err == nil && pid != crashed {
+			break
+		}
+	}
+	if pid == crashed {
+		t.Fatalf("crashed process %d was not restarted", crashed)
+	}
+	st, err := p.Status()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if st.PID != pid {
+		t.Errorf("Status().PID = %d, want %d", st.PID, pid)
+	}
+	if st.Restarts != 1 || st.LastExit != "signal: killed" {
+		t.Errorf("Status() restarts = %d, %q, want 1, %q", st.Restarts, st.LastExit, "signal: killed")
+	}
+	if code, sig, err := p.LastExit(); err != nil || code != -1 || sig != syscall.SIGKILL {
+		t.Errorf("LastExit() = %d, %v, %v, want -1, %v, nil", code, sig, err, syscall.SIGKILL)
+	}
+
+	// the terminated process is not restarted.
+	if err := p.Terminate(); err != nil {
+		t.Fatal(err)
+	}
+	if err := waitExit(pidFile, stopTimeout); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(2 * minSuperviseBackoff)
+	if _, err := os.Stat(pidFile); !os.IsNotExist(err) {
+		t.Errorf("terminated process was restarted, PID file exists: %v", err)
+	}
+}
+
+// crashHelper makes the detached helper, that has not been restarted by the
+// supervisor, exit with the code once it's running.
+type crashHelper struct{ Code int }
+
+func (f *crashHelper) apply(h *helper) error {
+	h.running = append(h.running, func(p *Process) error {
+		if pi, err := p.Info(); err == nil && pi.Restarts == 0 {
+			os.Exit(f.Code)
+		}
+		return nil
+	})
+	return nil
+}
+
+func TestProcess_LastExit(t *testing.T) {
+	pidFile := filepath.Join(t.TempDir(), "helper.pid")
+	startHelper(t, helperConfig{PIDFile: pidFile, Supervise: 2}, &crashHelper{Code: 3})
+	p, err := New(WithPIDFile(pidFile))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var pi PIDInfo
+	for deadline := time.Now().Add(10 * time.Second); time.Now().Before(deadline); time.Sleep(pollInterval) {
+		if pi, err = p.Info(); err == nil && pi.Restarts > 0 {
+			break
+		}
+	}
+	if pi.Restarts != 1 {
+		t.Fatalf("crashed process was not restarted: %v", err)
+	}
+	if code, sig, err := p.LastExit(); err != nil || code != 3 || sig != 0 {
+		t.Errorf("LastExit() = %d, %v, %v, want 3, 0, nil", code, sig, err)
+	}
+	if err := p.Terminate(); err != nil {
+		t.Fatal(err)
+	}
+	if err := waitExit(pidFile, stopTimeout); err != nil {
+		t.Fatal(err)
+	}
+
+	// the exit status is reset on the fresh start.
+	startHelper(t, helperConfig{PIDFile: pidFile, Supervise: 2})
+	if _, _, err := p.LastExit(); !errors.Is(err, ErrNotRestarted) {
+		t.Errorf("LastExit() error = %v, want %v", err, ErrNotRestarted)
+	}
+	if err := p.Terminate(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestWithSupervise_restart(t *testing.T) {
+	pidFile := filepath.Join(t.TempDir(), "helper.pid")
+	startHelper(t, helperConfig{PIDFile: pidFile, Supervise: 2})
+	oldPID, err := readPID(pidFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the supervisor of the old process holds the lock, until it sees the
+	// process exit.
+	startHelper(t, helperConfig{PIDFile: pidFile, Supervise: 2, Restart: true})
+	pid, err := readPID(pidFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pid == oldPID {
+		t.Errorf("PID = %d, want a new process", pid)
+	}
+	p, err := New(WithPIDFile(pidFile))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := p.Terminate(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestWithSupervise_forceKill(t *testing.T) {
+	pidFile := filepath.Join(t.TempDir(), "helper.pid")
+	startHelper(t, helperConfig{PIDFile: pidFile, Supervise: 2, HangOnExit: true})
+	p, err := New(WithPIDFile(pidFile), WithTerminateTimeout(200*time.Millisecond), WithForceKill(true))
+	if err != nil {
+		t.Fatal(err)
+	}
+	killed, err := p.PID()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := p.Terminate(); err != nil {
+		t.Fatal(err)
+	}
+	// the restart would follow the minimum backoff.
+	time.Sleep(2 * minSuperviseBackoff)
+	if pid, err := readPID(pidFile); !os.IsNotExist(err) {
+		t.Errorf("killed process %d was restarted as %d: %v", killed, pid, err)
+	}
+}
+
+// unhealthyHelper registers the OnHealth function of the helper, that fails
+// with the reason, after the one that succeeds.
+type unhealthyHelper struct{ Reason string }
+
+func (f *unhealthyHelper) apply(h *helper) error {
+	h.setup = append(h.setup, func(p *Process) error {
+		p.OnHealth(func() error { return nil })
+		p.OnHealth(func() error { return errors.New(f.Reason) })
+		return nil
+	})
+	return nil
+}
+
+func TestProcess_Health(t *testing.T) {
+	t.Run("healthy", func(t *testing.T) {
+		pidFile := filepath.Join(t.TempDir(), "helper.pid")
+		startHelper(t, helperConfig{PIDFile: pidFile})
+		p, err := New(WithPIDFile(pidFile))
+		if err != nil {
+			t.Fatal(err)
+		}
+		// no health check is registered.
+		if err := p.Health(); err != nil {
+			t.Errorf("Health() error = %v, want nil", err)
+		}
+		if err := p.Terminate(); err != nil {
+			t.Fatal(err)
+		}
+		if err := waitExit(pidFile, stopTimeout); err != nil {
+			t.Fatal(err)
+		}
+		if err := p.Health(); !errors.Is(err, ErrNotRunning) {
+			t.Errorf("Health() error = %v, want %v", err, ErrNotRunning)
+		}
+	})
+	t.Run("unhealthy", func(t *testing.T) {
+		pidFile := filepath.Join(t.TempDir(), "helper.pid")
+		const reason = "database is unreachable"
+		startHelper(t, helperConfig{PIDFile: pidFile}, &unhealthyHelper{Reason: reason})
+		p, err := New(WithPIDFile(pidFile))
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = p.Health()
+		if !errors.Is(err, ErrUnhealthy) {
+			t.Errorf("Health() error = %v, want %v", err, ErrUnhealthy)
+		}
+		if err == nil || !strings.HasSuffix(err.Error(), reason) {
+			t.Errorf("Health() error = %v, want the check error %q", err, reason)
+		}
+		if err := p.Terminate(); err != nil {
+			t.Fatal(err)
+		}
+	})
+}
+
+// pidFileModeHelper sets the permissions of the helper PID file, unless the
+// mode is zero.
+type pidFileModeHelper struct{ Mode os.FileMode }
+
+func (f *pidFileModeHelper) apply(h *helper) error {
+	if f.Mode != 0 {
+		h.opts = append(h.opts, WithPIDFileMode(f.Mode))
+	}
+	return nil
+}
+
+func TestWithPIDFileMode(t *testing.T) {
+	tests := []struct {
+		name string
+		mode os.FileMode
+		want os.FileMode
+	}{
+		{"default", 0, defaultPIDFileMode},
+		{"owner only", 0600, 0600},
+		{"group readable", 0640, 0640},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pidFile := filepath.Join(t.TempDir(), "helper.pid")
+			startHelper(t, helperConfig{PIDFile: pidFile}, &pidFileModeHelper{Mode: tt.mode})
+			fi, err := os.Stat(pidFile)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := fi.Mode().Perm(); got != tt.want {
+				t.Errorf("PID file mode = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+// pidFormatHelper sets the format of the helper PID file.
+type pidFormatHelper struct{ Format PIDFormat }
+
+func (f *pidFormatHelper) apply(h *helper) error {
+	h.opts = append(h.opts, WithPIDFormat(f.Format))
+	return nil
+}
+
+func TestWithPIDFormat(t *testing.T) {
+	if _, err := New(WithPIDFile("test.pid"), WithPIDFormat(PIDFormat(42))); err == nil {
+		t.Error("New() expected an error for the unknown format")
+	}
+
+	pidFile := filepath.Join(t.TempDir(), "helper.pid")
+	startHelper(t, helperConfig{PIDFile: pidFile}, &pidFormatHelper{Format: PIDFormatJSON})
+	data, err := os.ReadFile(pidFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !json.Valid(data) {
+		t.Fatalf("PID file is not in the JSON format: %s", data)
+	}
+	p, err := New(WithPIDFile(pidFile))
+	if err != nil {
+		t.Fatal(err)
+	}
+	pi, err := p.Info()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pi.PID == 0 || pi.Addr == "" || pi.StartedAt.IsZero() || len(pi.Args) == 0 {
+		t.Errorf("Info() = %+v, want all fields set", pi)
+	}
+	if running, err := p.IsRunning(); err != nil || !running {
+		t.Fatalf("IsRunning() = %v, %v, want true", running, err)
+	}
+	if err := p.Terminate(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// umaskHelper sets the umask of the detached helper.
+type umaskHelper struct{ Umask int }
+
+func (f *umaskHelper) apply(h *helper) error {
+	h.opts = append(h.opts, WithUmask(f.Umask))
+	return nil
+}
+
+// stdioHelper sets the standard output and error files of the helper.  The
+// detached helper writes helperLogLine to the standard output, and
+// helperErrLine to the standard error.
+type stdioHelper struct{ Stdout, Stderr string }
+
+func (f *stdioHelper) apply(h *helper) error {
+	if f.Stdout != "" {
+		h.opts = append(h.opts, WithStdout(f.Stdout))
+	}
+	if f.Stderr != "" {
+		h.opts = append(h.opts, WithStderr(f.Stderr))
+	}
+	return nil
+}
+
+func TestWithUmask(t *testing.T) {
+	dir := t.TempDir()
+	pidFile := filepath.Join(dir, "helper.pid")
+	stdout := filepath.Join(dir, "stdout.log")
+	umask := 027
+	startHelper(t, helperConfig{PIDFile: pidFile}, &stdioHelper{Stdout: stdout}, &umaskHelper{Umask: umask}, &pidFileModeHelper{Mode: 0644})
+	// the log file is created by the detached helper with 0644.
+	fi, err := os.Stat(stdout)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := fi.Mode().Perm(), os.FileMode(0640); got != want {
+		t.Errorf("log file mode = %v, want %v", got, want)
+	}
+	// the PID file mode does not depend on the umask.
+	if fi, err = os.Stat(pidFile); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := fi.Mode().Perm(), os.FileMode(0644); got != want {
+		t.Errorf("PID file mode = %v, want %v", got, want)
+	}
+}
+
+func TestProcess_Reload(t *testing.T) {
+	dir := t.TempDir()
+	pidFile := filepath.Join(dir, "helper.pid")
+	reloadLog := filepath.Join(dir, "reload.log")
+	startHelper(t, helperConfig{PIDFile: pidFile, ReloadLog: reloadLog})
+
+	p, err := New(WithPIDFile(pidFile))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 1; i <= 2; i++ {
+		if err := p.Reload(); err != nil {
+			t.Fatal(err)
+		}
+		var lines []string
+		for deadline := time.Now().Add(10 * time.Second); time.Now().Before(deadline); time.Sleep(pollInterval) {
+			data, _ := os.ReadFile(reloadLog)
+			if lines = strings.Fields(string(data)); len(lines) >= i {
+				break
+			}
+		}
+		if len(lines) != i {
+			t.Fatalf("reloaded %d times, want %d", len(lines), i)
+		}
+	}
+	// SIGHUP does not terminate the process.
+	if running, err := p.IsRunning(); err != nil || !running {
+		t.Fatalf("IsRunning() = %v, %v, want true", running, err)
+	}
+	if err := p.Terminate(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestProcess_Signal(t *testing.T) {
+	dir := t.TempDir()
+	pidFile := filepath.Join(dir, "helper.pid")
+	p, err := New(WithPIDFile(pidFile))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := p.Signal(syscall.SIGUSR2); !errors.Is(err, ErrNotRunning) {
+		t.Fatalf("Signal() error = %v, want %v", err, ErrNotRunning)
+	}
+
+	reloadLog := filepath.Join(dir, "reload.log")
+	startHelper(t, helperConfig{PIDFile: pidFile, ReloadLog: reloadLog})
+	// the helper reloads on SIGHUP.
+	if err := p.Signal(syscall.SIGHUP); err != nil {
+		t.Fatal(err)
+	}
+	var data []byte
+	for deadline := time.Now().Add(10 * time.Second); time.Now().Before(deadline) && len(data) == 0; time.Sleep(pollInterval) {
+		data, _ = os.ReadFile(reloadLog)
+	}
+	if len(data) == 0 {
+		t.Fatal("the process has not received SIGHUP")
+	}
+	if err := p.Signal(syscall.SIGTERM); err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if err := p.awaitExit(ctx, false); err != nil {
+		t.Fatalf("the process has not exited on SIGTERM: %s", err)
+	}
+}
+
+func TestWithControlSocket(t *testing.T) {
+	if _, err := New(WithPIDFile("test.pid"), WithControlSocket(ControlSocket), WithControlNetwork("tcp")); err == nil {
+		t.Error("New() expected an error for the control socket over tcp")
+	}
+
+	pidFile := filepath.Join(t.TempDir(), "helper.pid")
+	// the socket left by a crashed process.
+	stale, err := net.ListenUnix("unix", &net.UnixAddr{Name: sockPath(pidFile, sRunning), Net: "unix"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	stale.SetUnlinkOnClose(false)
+	stale.Close()
+
+	startHelper(t, helperConfig{PIDFile: pidFile, ControlSocket: true})
+	p, err := New(WithPIDFile(pidFile))
+	if err != nil {
+		t.Fatal(err)
+	}
+	pi, err := p.Info()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pi.Control != ControlSocket || pi.Network != "unix" {
+		t.Fatalf("PID file control = %v, network = %q, want the control socket", pi.Control, pi.Network)
+	}
+	if running, err := p.IsRunning(); err != nil || !running {
+		t.Fatalf("IsRunning() = %v, %v, want true", running, err)
+	}
+	st, err := p.Status()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if st.PID != pi.PID {
+		t.Errorf("Status().PID = %d, want %d", st.PID, pi.PID)
+	}
+	if err := p.Terminate(); err != nil {
+		t.Fatal(err)
+	}
+	if err := waitExit(pidFile, stopTimeout); err != nil {
+		t.Fatal(err)
+	}
+	// the process stops serving the socket before it removes the PID file.
+	for deadline := time.Now().Add(10 * time.Second); time.Now().Before(deadline); time.Sleep(pollInterval) {
+		if _, err := os.Stat(pidFile); os.IsNotExist(err) {
+			break
+		}
+	}
+	if _, err := os.Stat(pidFile); !os.IsNotExist(err) {
+		t.Errorf("PID file exists after Terminate: %v", err)
+	}
+	if _, err := os.Stat(pi.Addr); !os.IsNotExist(err) {
+		t.Errorf("control socket exists after Terminate: %v", err)
+	}
+}
+
+func TestServeControl_legacy(t *testing.T) {
+	// the older clients send the two byte commands without the frame, and
+	// read the two byte response.
+	pidFile := filepath.Join(t.TempDir(), "helper.pid")
+	startHelper(t, helperConfig{PIDFile: pidFile, ControlSocket: true})
+	pi, err := readInfo(pidFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, cmd := range []string{cmdOK, cmdExit} {
+		conn, err := controlDial(pi.Network, pi.Addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := conn.Write([]byte(cmd)); err != nil {
+			t.Fatal(err)
+		}
+		buf := make([]byte, 2)
+		if _, err := io.ReadFull(conn, buf); err != nil {
+			t.Fatalf("%q: %s", cmd, err)
+		}
+		conn.Close()
+		if string(buf) != cmdOK {
+			t.Errorf("response to %q = %q, want %q", cmd, buf, cmdOK)
+		}
+	}
+	if err := waitExit(pidFile, stopTimeout); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestServeControl_notPermitted(t *testing.T) {
+	pidFile := filepath.Join(t.TempDir(), "helper.pid")
+	startHelper(t, helperConfig{PIDFile: pidFile, Network: "tcp"})
+	pi, err := readInfo(pidFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn, err := controlDial(pi.Network, pi.Addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	resp, err := controlRequest(conn, cmdExit)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := respNotPermitted + cmdExit; resp != want {
+		t.Errorf("response = %q, want %q", resp, want)
+	}
+	p, err := New(WithPIDFile(pidFile))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if running, err := p.IsRunning(); err != nil || !running {
+		t.Errorf("IsRunning() = %v, %v, want true, nil", running, err)
+	}
+	if err := p.Terminate(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestNew_defaultNetwork(t *testing.T) {
+	tests := []struct {
+		name string
+		opts []Option
+		want string
+	}{
+		{"default", nil, "unix"},
+		{"control addr", []Option{WithControlAddr("127.0.0.1:7000")}, "tcp"},
+		{"notify addr", []Option{WithNotifyAddr("127.0.0.1:7000")}, "tcp"},
+		{"explicit", []Option{WithControlNetwork("tcp4")}, "tcp4"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p, err := New(append([]Option{WithPIDFile("test.pid")}, tt.opts...)...)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if p.network != tt.want {
+				t.Errorf("network = %q, want %q", p.network, tt.want)
+			}
+		})
+	}
+}
+
+func TestControlListen_socketMode(t *testing.T) {
+	pidFile := filepath.Join(t.TempDir(), "test.pid")
+	ln, err := controlListen("unix", "", pidFile, sRunning)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	fi, err := os.Stat(sockPath(pidFile, sRunning))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if mode := fi.Mode().Perm(); mode != 0600 {
+		t.Errorf("socket mode = %o, want %o", mode, 0600)
+	}
+}
+
+// controlSecretHelper enables the control secret of the helper.
+type controlSecretHelper struct{}
+
+func (f *controlSecretHelper) apply(h *helper) error {
+	h.opts = append(h.opts, WithControlSecret(true))
+	return nil
+}
+
+func TestWithControlSecret(t *testing.T) {
+	pidFile := filepath.Join(t.TempDir(), "helper.pid")
+	startHelper(t, helperConfig{PIDFile: pidFile}, &controlSecretHelper{})
+	pi, err := readInfo(pidFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pi.Secret == "" {
+		t.Fatal("PID file has no secret")
+	}
+	fi, err := os.Stat(pidFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if mode := fi.Mode().Perm(); mode != 0600 {
+		t.Errorf("PID file mode = %o, want %o", mode, 0600)
+	}
+	if running, err := pingControl(pi); err != nil || !running {
+		t.Errorf("pingControl() = %v, %v, want true, nil", running, err)
+	}
+	// the client without the secret is refused.
+	pi.Secret = ""
+	if running, err := pingControl(pi); err == nil && running {
+		t.Error("pingControl() without the secret = true, want refused")
+	}
+	p, err := New(WithPIDFile(pidFile))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := p.Terminate(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestWithControlToken(t *testing.T) {
+	if _, err := New(WithPIDFile("test.pid"), WithControlToken(strings.Repeat("x", maxToken+1))); err == nil {
+		t.Error("New() expected an error for the long token")
+	}
+
+	const token = "secret"
+	pidFile := filepath.Join(t.TempDir(), "helper.pid")
+	startHelper(t, helperConfig{PIDFile: pidFile, ControlSocket: true, ControlToken: token})
+	pi, err := readInfo(pidFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pi.TokenHash != hashToken(token) {
+		t.Fatalf("PID file token hash = %q, want %q", pi.TokenHash, hashToken(token))
+	}
+
+	// the connections with the commands without the token or with the wrong
+	// one are closed.
+	for _, cmd := range []string{cmdExit, cmdAuth + "wrong"} {
+		conn, err := controlDial(pi.Network, pi.Addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp, err := controlRequest(conn, cmd)
+		conn.Close()
+		if err == nil {
+			t.Errorf("response to %q = %q, want the closed connection", cmd, resp)
+		}
+	}
+	wrong, err := New(WithPIDFile(pidFile), WithControlToken("wrong"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := wrong.Terminate(); !errors.Is(err, ErrUnauthorized) {
+		t.Errorf("Terminate() error = %v, want %v", err, ErrUnauthorized)
+	}
+	if _, err := wrong.Status(); !errors.Is(err, ErrUnauthorized) {
+		t.Errorf("Status() error = %v, want %v", err, ErrUnauthorized)
+	}
+	// the liveness check does not need the token.
+	if running, err := wrong.IsRunning(); err != nil || !running {
+		t.Fatalf("IsRunning() = %v, %v, want true", running, err)
+	}
+
+	p, err := New(WithPIDFile(pidFile), WithControlToken(token))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := p.Status(); err != nil {
+		t.Fatal(err)
+	}
+	if err := p.Terminate(); err != nil {
+		t.Fatal(err)
+	}
+	if err := waitExit(pidFile, stopTimeout); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestWithControlSocket_fallback(t *testing.T) {
+	dir := t.TempDir()
+	pidFile := filepath.Join(dir, "helper.pid")
+	reloadLog := filepath.Join(dir, "reload.log")
+	startHelper(t, helperConfig{PIDFile: pidFile, ControlSocket: true, ReloadLog: reloadLog})
+	p, err := New(WithPIDFile(pidFile))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the reload command waits for the reload, and returns the error of the
+	// panicking function of the helper.
+	if err := p.Reload(); err == nil || !strings.Contains(err.Error(), "panicked") {
+		t.Fatalf("Reload() error = %v, want the reload error", err)
+	}
+	if data, err := os.ReadFile(reloadLog); err != nil || len(strings.Fields(string(data))) != 1 {
+		t.Fatalf("reload log = %q, %v, want one reload", data, err)
+	}
+
+	// the socket is removed by the cleaner, the signal is used instead.
+	if err := os.Remove(sockPath(pidFile, sRunning)); err != nil {
+		t.Fatal(err)
+	}
+	if err := p.Terminate(); err != nil {
+		t.Fatal(err)
+	}
+	for deadline := time.Now().Add(10 * time.Second); time.Now().Before(deadline); time.Sleep(pollInterval) {
+		if _, err := os.Stat(pidFile); os.IsNotExist(err) {
+			return
+		}
+	}
+	t.Error("the process has not exited on SIGTERM")
+}
+
+func TestWithControlSocket_recycledPID(t *testing.T) {
+	// the PID of the crashed process now belongs to the test process.
+	pidFile := filepath.Join(t.TempDir(), "test.pid")
+	pi := PIDInfo{PID: os.Getpid(), Addr: sockPath(pidFile, sRunning), Network: "unix", Control: ControlSocket}
+	if err := writeInfo(pidFile, pi, defaultPIDFileMode); err != nil {
+		t.Fatal(err)
+	}
+	running, err := isRunning(pidFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if running {
+		t.Error("isRunning() = true for the recycled PID")
+	}
+}
+
+// foregroundHelper makes the helper run in the foreground.
+type foregroundHelper struct{}
+
+func (f *foregroundHelper) apply(h *helper) error {
+	h.opts = append(h.opts, WithForeground(true))
+	return nil
+}
+
+// workDirHelper sets the working directory of the helper.  The detached
+// helper stores its working directory in the "cwd" metadata key.
+type workDirHelper struct{ Dir string }
+
+func (f *workDirHelper) apply(h *helper) error {
+	h.opts = append(h.opts, WithWorkingDir(f.Dir))
+	h.running = append(h.running, func(p *Process) error {
+		cwd, err := os.Getwd()
+		if err != nil {
+			return err
+		}
+		return addMeta(p, "cwd", cwd)
+	})
+	return nil
+}
+
+func TestWithForeground(t *testing.T) {
+	dir := t.TempDir()
+	pidFile := filepath.Join(dir, "helper.pid")
+	stageLog := filepath.Join(dir, "stages.log")
+	exitLog := filepath.Join(dir, "exit.log")
+	// the working directory is not changed in the foreground.
+	cmd := helperCommand(t, helperConfig{PIDFile: pidFile, StageLog: stageLog, ExitLog: exitLog}, &foregroundHelper{}, &workDirHelper{Dir: dir})
+	if err := cmd.Start(); err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan error, 1)
+	go func() { done <- cmd.Wait() }()
+	t.Cleanup(func() { _ = cmd.Process.Kill() })
+
+	// wait for the helper to write the PID file.
+	var pid int
+	for deadline := time.Now().Add(10 * time.Second); time.Now().Before(deadline); time.Sleep(pollInterval) {
+		if p, err := readPID(pidFile); err == nil {
+			pid = p
+			break
+		}
+	}
+	if pid != cmd.Process.Pid {
+		t.Fatalf("PID file has PID %d, want %d of the foreground process", pid, cmd.Process.Pid)
+	}
+	if data, err := os.ReadFile(stageLog); err != nil {
+		t.Fatal(err)
+	} else if string(data) != "RUN\n" {
+		t.Errorf("stages = %q, want %q", data, "RUN\n")
+	}
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var cwd string
+	for deadline := time.Now().Add(10 * time.Second); time.Now().Before(deadline) && cwd == ""; time.Sleep(pollInterval) {
+		if pi, err := readInfo(pidFile); err == nil {
+			cwd = pi.Meta["cwd"]
+		}
+	}
+	if cwd != wd {
+		t.Errorf("working directory = %q, want %q", cwd, wd)
+	}
+
+	// Ctrl-C.
+	if err := cmd.Process.Signal(os.Interrupt); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Errorf("helper exited with error: %v", err)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("helper did not exit on interrupt")
+	}
+	if data, err := os.ReadFile(exitLog); err != nil || string(data) != "exit\n" {
+		t.Errorf("exit log = %q, %v, want the AtExit function called", data, err)
+	}
+	if _, err := os.Stat(pidFile); !os.IsNotExist(err) {
+		t.Errorf("PID file exists after exit: %v", err)
+	}
+}
+
+// foregroundIfHelper makes the helper run in the foreground, if
+// RunningUnderSupervisor reports so.
+type foregroundIfHelper struct{}
+
+func (f *foregroundIfHelper) apply(h *helper) error {
+	h.opts = append(h.opts, WithForegroundIf(RunningUnderSupervisor))
+	return nil
+}
+
+func TestWithForegroundIf(t *testing.T) {
+	dir := t.TempDir()
+	pidFile := filepath.Join(dir, "helper.pid")
+	stageLog := filepath.Join(dir, "stages.log")
+	// the helper is started by systemd.
+	t.Setenv("INVOCATION_ID", "0123456789abcdef")
+	cmd := helperCommand(t, helperConfig{PIDFile: pidFile, StageLog: stageLog}, &foregroundIfHelper{})
+	if err := cmd.Start(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		_ = cmd.Process.Kill()
+		_ = cmd.Wait()
+	})
+
+	var pid int
+	for deadline := time.Now().Add(10 * time.Second); time.Now().Before(deadline); time.Sleep(pollInterval) {
+		if p, err := readPID(pidFile); err == nil {
+			pid = p
+			break
+		}
+	}
+	if pid != cmd.Process.Pid {
+		t.Fatalf("PID file has PID %d, want %d of the foreground process", pid, cmd.Process.Pid)
+	}
+	if data, err := os.ReadFile(stageLog); err != nil {
+		t.Fatal(err)
+	} else if string(data) != "RUN\n" {
+		t.Errorf("stages = %q, want %q", data, "RUN\n")
+	}
+}
+
+func TestTSR_startError(t *testing.T) {
+	// the path of the control socket next to the PID file exceeds the limit,
+	// so the detached helper fails to listen.
+	dir := filepath.Join(t.TempDir(), strings.Repeat("d", 120))
+	if err := os.Mkdir(dir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	pidFile := filepath.Join(dir, "helper.pid")
+	cmd := helperCommand(t, helperConfig{PIDFile: pidFile, Network: "unix", StartTimeout: 30 * time.Second})
+	start := time.Now()
+	out, err := cmd.CombinedOutput()
+	if err == nil {
+		t.Fatalf("helper succeeded, want an error: %s", out)
+	}
+	if elapsed := time.Since(start); elapsed > 10*time.Second {
+		t.Errorf("helper failed after %v, want the error before the timeout", elapsed)
+	}
+	if !strings.Contains(string(out), "listen unix") {
+		t.Errorf("helper output = %q, want the listen error", out)
+	}
+	if _, err := os.Stat(pidFile); !os.IsNotExist(err) {
+		t.Errorf("PID file exists after the failed start: %v", err)
+	}
+}
+
+// controlAddrHelper sets the address of the helper control listener.
+type controlAddrHelper struct{ Addr string }
+
+func (f *controlAddrHelper) apply(h *helper) error {
+	h.opts = append(h.opts, WithControlAddr(f.Addr))
+	return nil
+}
+
+func TestWithControlAddr_detached(t *testing.T) {
+	busy, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := busy.Addr().String()
+
+	pidFile := filepath.Join(t.TempDir(), "helper.pid")
+	cmd := helperCommand(t, helperConfig{PIDFile: pidFile}, &controlAddrHelper{Addr: addr})
+	out, err := cmd.CombinedOutput()
+	if err == nil {
+		t.Fatalf("helper succeeded, want an error: %s", out)
+	}
+	if !strings.Contains(string(out), addr) {
+		t.Errorf("helper output = %q, want the listen error", out)
+	}
+
+	// the port is free now.
+	busy.Close()
+	startHelper(t, helperConfig{PIDFile: pidFile}, &controlAddrHelper{Addr: addr})
+	p, err := New(WithPIDFile(pidFile))
+	if err != nil {
+		t.Fatal(err)
+	}
+	pi, err := p.Info()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pi.Addr != addr {
+		t.Errorf("PID file address = %q, want %q", pi.Addr, addr)
+	}
+	if err := p.Terminate(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// cancelHelper makes the helper call TSRContext, and cancel the context after
+// the duration.
+type cancelHelper struct{ After time.Duration }
+
+func (f *cancelHelper) apply(h *helper) error {
+	h.start = func(p *Process) (bool, error) {
+		ctx, cancel := context.WithCancel(context.Background())
+		time.AfterFunc(f.After, cancel)
+		return p.TSRContext(ctx)
+	}
+	return nil
+}
+
+func TestProcess_TSRContext(t *testing.T) {
+	dir := t.TempDir()
+	pidFile := filepath.Join(dir, "helper.pid")
+	stageLog := filepath.Join(dir, "stages.log")
+	// the detached helper starts after the context is cancelled.
+	cmd := helperCommand(t, helperConfig{PIDFile: pidFile, StageLog: stageLog, StartDelay: time.Second}, &cancelHelper{After: 200 * time.Millisecond})
+	out, err := cmd.CombinedOutput()
+	if err == nil {
+		t.Fatalf("helper succeeded, want an error: %s", out)
+	}
+	if !strings.Contains(string(out), context.Canceled.Error()) {
+		t.Errorf("helper output = %q, want %q", out, context.Canceled)
+	}
+
+	time.Sleep(2 * time.Second)
+	if _, err := os.Stat(pidFile); !os.IsNotExist(err) {
+		t.Errorf("the detached process was not killed, PID file: %v", err)
+	}
+	data, err := os.ReadFile(stageLog)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(data), "RUN") {
+		t.Errorf("stages = %q, the RUN stage was entered", data)
+	}
+}
+
+// applyHelper makes the OnReload function of the helper return
+// ErrNeedsRestart, and the helper call Apply instead of TSR, if Apply is set.
+type applyHelper struct{ Apply bool }
+
+func (f *applyHelper) apply(h *helper) error {
+	h.setup = append(h.setup, func(p *Process) error {
+		p.OnReload(func() error { return ErrNeedsRestart })
+		return nil
+	})
+	if f.Apply {
+		h.start = func(p *Process) (bool, error) { return p.Apply(true) }
+	}
+	return nil
+}
+
+func TestProcess_Apply(t *testing.T) {
+	t.Run("reload", func(t *testing.T) {
+		pidFile := filepath.Join(t.TempDir(), "helper.pid")
+		startHelper(t, helperConfig{PIDFile: pidFile, ControlToken: "secret"})
+		pid, err := readPID(pidFile)
+		if err != nil {
+			t.Fatal(err)
+		}
+		p, err := New(WithPIDFile(pidFile), WithControlToken("secret"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if headless, err := p.Apply(true); err != nil || headless {
+			t.Fatalf("Apply() = %v, %v, want false, nil", headless, err)
+		}
+		if got, err := readPID(pidFile); err != nil || got != pid {
+			t.Errorf("PID = %d, %v, want %d, the process was restarted", got, err, pid)
+		}
+		if err := p.Terminate(); err != nil {
+			t.Fatal(err)
+		}
+	})
+	t.Run("needs restart", func(t *testing.T) {
+		pidFile := filepath.Join(t.TempDir(), "helper.pid")
+		cfg := helperConfig{PIDFile: pidFile, ControlToken: "secret"}
+		startHelper(t, cfg, &applyHelper{})
+		pid, err := readPID(pidFile)
+		if err != nil {
+			t.Fatal(err)
+		}
+		p, err := New(WithPIDFile(pidFile), WithControlToken("secret"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := p.Apply(false); !errors.Is(err, ErrNeedsRestart) {
+			t.Errorf("Apply(false) error = %v, want %v", err, ErrNeedsRestart)
+		}
+
+		if out, err := helperCommand(t, cfg, &applyHelper{Apply: true}).CombinedOutput(); err != nil {
+			t.Fatalf("helper failed: %s: %s", err, out)
+		}
+		newPID, err := readPID(pidFile)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if newPID == pid {
+			t.Error("the process was not restarted")
+		}
+		if running, err := p.IsRunning(); err != nil || !running {
+			t.Errorf("IsRunning() = %v, %v, want true, nil", running, err)
+		}
+		if err := p.Terminate(); err != nil {
+			t.Fatal(err)
+		}
+	})
+	t.Run("not permitted", func(t *testing.T) {
+		pidFile := filepath.Join(t.TempDir(), "helper.pid")
+		startHelper(t, helperConfig{PIDFile: pidFile, Network: "tcp"})
+		p, err := New(WithPIDFile(pidFile))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := p.Apply(true); !errors.Is(err, ErrNotPermitted) {
+			t.Errorf("Apply() error = %v, want %v", err, ErrNotPermitted)
+		}
+		if err := p.Terminate(); err != nil {
+			t.Fatal(err)
+		}
+	})
+}
+
+func TestWithPostStop(t *testing.T) {
+	pidFile := filepath.Join(t.TempDir(), "helper.pid")
+	startHelper(t, helperConfig{PIDFile: pidFile})
+
+	var calls int
+	var p *Process
+	p, err := New(WithPIDFile(pidFile), WithPostStop(func() error {
+		calls++
+		if running, err := p.IsRunning(); err != nil || running {
+			t.Errorf("post-stop hook called while running = %v, err = %v", running, err)
+		}
+		return nil
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := p.Terminate(); err != nil {
+		t.Fatal(err)
+	}
+	if calls != 1 {
+		t.Errorf("post-stop hook called %d times, want 1", calls)
+	}
+	// not running, the hook must not be called.
+	if err := p.Terminate(); !errors.Is(err, ErrNotRunning) {
+		t.Errorf("Terminate() error = %v, want %v", err, ErrNotRunning)
+	}
+	if calls != 1 {
+		t.Errorf("post-stop hook called %d times, want 1", calls)
+	}
+}
+
+// printPIDHelper makes the launcher print the PID of the detached helper.
+type printPIDHelper struct{}
+
+func (f *printPIDHelper) apply(h *helper) error {
+	h.launched = append(h.launched, func(p *Process) error {
+		pid, err := p.ChildPID()
+		if err != nil {
+			return err
+		}
+		fmt.Println(pid)
+		return nil
+	})
+	return nil
+}
+
+func TestProcess_ChildPID(t *testing.T) {
+	pidFile := filepath.Join(t.TempDir(), "helper.pid")
+	out, err := helperCommand(t, helperConfig{PIDFile: pidFile}, &printPIDHelper{}).Output()
+	if err != nil {
+		t.Fatalf("helper failed: %s", err)
+	}
+	p, err := New(WithPIDFile(pidFile))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = p.Terminate() })
+	pid, err := p.PID()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := strings.TrimSpace(string(out)); got != fmt.Sprint(pid) {
+		t.Errorf("ChildPID() = %s, want %d", got, pid)
+	}
+	if _, err := p.ChildPID(); !errors.Is(err, ErrNoPID) {
+		t.Errorf("ChildPID() error = %v in the process that did not start it, want %v", err, ErrNoPID)
+	}
+}
+
+// envHelper sets the environment of the detached helper, it stores the
+// variable Name in the "env" metadata key.
+type envHelper struct {
+	Env  map[string]string
+	Name string
+}
+
+func (f *envHelper) apply(h *helper) error {
+	h.opts = append(h.opts, WithEnv(f.Env))
+	h.setup = append(h.setup, func(p *Process) error {
+		// only the detached helper writes the metadata to the PID file.
+		return p.SetMetadata("env", os.Getenv(f.Name))
+	})
+	return nil
+}
+
+func TestWithEnv(t *testing.T) {
+	pidFile := filepath.Join(t.TempDir(), "helper.pid")
+	const name = "GOTSR_TEST_FLAG"
+	t.Setenv(name, "off")
+	// the stage variable of the helper can't be overridden.
+	env := map[string]string{name: "on", newEnvVar(pidFile).stage(): "bogus"}
+	startHelper(t, helperConfig{PIDFile: pidFile}, &envHelper{Env: env, Name: name})
+
+	p, err := New(WithPIDFile(pidFile))
+	if err != nil {
+		t.Fatal(err)
+	}
+	pi, err := p.Info()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := pi.Meta["env"]; got != "on" {
+		t.Errorf("detached process %s = %q, want %q", name, got, "on")
+	}
+	if err := p.Terminate(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// keepPIDFileHelper makes the helper leave the PID file on exit.
+type keepPIDFileHelper struct{}
+
+func (f *keepPIDFileHelper) apply(h *helper) error {
+	h.opts = append(h.opts, WithKeepPIDFileOnExit())
+	return nil
+}
+
+func TestWithKeepPIDFileOnExit(t *testing.T) {
+	pidFile := filepath.Join(t.TempDir(), "helper.pid")
+	startHelper(t, helperConfig{PIDFile: pidFile}, &keepPIDFileHelper{})
+
+	p, err := New(WithPIDFile(pidFile))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := p.Terminate(); err != nil {
+		t.Fatal(err)
+	}
+	if err := waitExit(pidFile, stopTimeout); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(pidFile); err != nil {
+		t.Errorf("PID file was not kept: %s", err)
+	}
+	if running, err := p.IsRunning(); err != nil || running {
+		t.Errorf("IsRunning() = %v, %v, want false, nil", running, err)
+	}
+}
+
+// statusFileHelper sets the status file of the helper, updated every
+// Interval.
+type statusFileHelper struct {
+	File     string
+	Interval time.Duration
+}
+
+func (f *statusFileHelper) apply(h *helper) error {
+	h.opts = append(h.opts, WithStatusFile(f.File, f.Interval))
+	return nil
+}
+
+func TestWithStatusFile(t *testing.T) {
+	dir := t.TempDir()
+	pidFile := filepath.Join(dir, "helper.pid")
+	statusFile := filepath.Join(dir, "helper.status")
+	startHelper(t, helperConfig{PIDFile: pidFile}, &statusFileHelper{File: statusFile, Interval: 50 * time.Millisecond})
+
+	readStatus := func() Status {
+		t.Helper()
+		data, err := os.ReadFile(statusFile)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var st Status
+		if err := json.Unmarshal(data, &st); err != nil {
+			t.Fatalf("invalid status file: %s: %q", err, data)
+		}
+		return st
+	}
+	first := readStatus()
+	pid, err := readPID(pidFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if first.PID != pid {
+		t.Errorf("status PID = %d, want %d", first.PID, pid)
+	}
+	if first.Health != healthOK || first.Goroutines == 0 || first.MemSys == 0 {
+		t.Errorf("incomplete status: %+v", first)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		if st := readStatus(); st.UpdatedAt.After(first.UpdatedAt) {
+			if st.Uptime <= first.Uptime {
+				t.Errorf("uptime = %v, want more than %v", st.Uptime, first.Uptime)
+			}
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("status file was not updated")
+		}
+		time.Sleep(pollInterval)
+	}
+
+	p, err := New(WithPIDFile(pidFile))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := p.Terminate(); err != nil {
+		t.Fatal(err)
+	}
+	if err := waitExit(pidFile, stopTimeout); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(statusFile); !os.IsNotExist(err) {
+		t.Errorf("status file was not removed: %v", err)
+	}
+}
+
+// shutdownTimeoutHelper sets the shutdown timeout of the helper.
+type shutdownTimeoutHelper struct{ Timeout time.Duration }
+
+func (f *shutdownTimeoutHelper) apply(h *helper) error {
+	h.opts = append(h.opts, WithShutdownTimeout(f.Timeout))
+	return nil
+}
+
+func TestWithShutdownTimeout(t *testing.T) {
+	pidFile := filepath.Join(t.TempDir(), "helper.pid")
+	startHelper(t, helperConfig{PIDFile: pidFile, HangOnExit: true}, &shutdownTimeoutHelper{Timeout: 200 * time.Millisecond})
+
+	p, err := New(WithPIDFile(pidFile))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := p.Terminate(); err != nil {
+		t.Fatal(err)
+	}
+	// the AtExit function hangs for helperLifetime.
+	if err := waitExit(pidFile, 5*time.Second); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(pidFile); !os.IsNotExist(err) {
+		t.Errorf("PID file was not removed: %v", err)
+	}
+}
+
+func TestWithTerminateTimeout(t *testing.T) {
+	t.Run("timeout", func(t *testing.T) {
+		pidFile := filepath.Join(t.TempDir(), "helper.pid")
+		startHelper(t, helperConfig{PIDFile: pidFile, HangOnExit: true})
+
+		p, err := New(WithPIDFile(pidFile), WithTerminateTimeout(200*time.Millisecond))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := p.Terminate(); !errors.Is(err, ErrStopTimeout) {
+			t.Errorf("Terminate() error = %v, want %v", err, ErrStopTimeout)
+		}
+		if running, err := p.IsRunning(); err != nil || !running {
+			t.Errorf("IsRunning() = %v, %v, want true, nil", running, err)
+		}
+	})
+	t.Run("force kill", func(t *testing.T) {
+		pidFile := filepath.Join(t.TempDir(), "helper.pid")
+		startHelper(t, helperConfig{PIDFile: pidFile, HangOnExit: true})
+
+		p, err := New(WithPIDFile(pidFile), WithTerminateTimeout(200*time.Millisecond), WithForceKill(true))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := p.Terminate(); err != nil {
+			t.Fatal(err)
+		}
+		if running, err := p.IsRunning(); err != nil || running {
+			t.Errorf("IsRunning() = %v, %v, want false, nil", running, err)
+		}
+		if _, err := os.Stat(pidFile); !os.IsNotExist(err) {
+			t.Errorf("PID file was not removed: %v", err)
+		}
+	})
+}
+
+func TestWithStartTimeout_exceeded(t *testing.T) {
+	pidFile := filepath.Join(t.TempDir(), "helper.pid")
+	cmd := helperCommand(t, helperConfig{
+		PIDFile:      pidFile,
+		StartTimeout: 200 * time.Millisecond,
+		StartDelay:   time.Second,
+	})
+	out, err := cmd.CombinedOutput()
+	if err == nil {
+		t.Error("helper expected to fail")
+	}
+	if !strings.Contains(string(out), errTimeout.Error()) {
+		t.Errorf("helper output = %q, want %q", out, errTimeout)
+	}
+	// the detached process starts eventually, stop it.
+	if err := waitPIDFile(pidFile); err != nil {
+		t.Fatal(err)
+	}
+	p, err := New(WithPIDFile(pidFile))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := p.Terminate(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestWithStartTimeout_late(t *testing.T) {
+	pidFile := filepath.Join(t.TempDir(), "helper.pid")
+	// starts late, but within the timeout.
+	startHelper(t, helperConfig{
+		PIDFile:      pidFile,
+		StartTimeout: 5 * time.Second,
+		StartDelay:   time.Second,
+	})
+	p, err := New(WithPIDFile(pidFile))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if running, err := p.IsRunning(); err != nil || !running {
+		t.Errorf("IsRunning() = %v, %v, want true, nil", running, err)
+	}
+	if err := p.Terminate(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// waitPIDFile waits for the PID file to appear.
+func waitPIDFile(pidFile string) error {
+	deadline := time.Now().Add(10 * time.Second)
+	for {
+		if _, err := readPID(pidFile); err == nil {
+			return nil
+		} else if time.Now().After(deadline) {
+			return err
+		}
+		time.Sleep(pollInterval)
+	}
+}
+
+func TestWithLogFile(t *testing.T) {
+	dir := t.TempDir()
+	pidFile := filepath.Join(dir, "helper.pid")
+	logFile := filepath.Join(dir, "log", "helper.log")
+	// the existing contents must be preserved.
+	if err := os.MkdirAll(filepath.Dir(logFile), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(logFile, []byte("previous run\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	startHelper(t, helperConfig{PIDFile: pidFile, LogFile: logFile})
+
+	p, err := New(WithPIDFile(pidFile), WithTerminateTimeout(stopTimeout))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var data []byte
+	for deadline := time.Now().Add(10 * time.Second); time.Now().Before(deadline); time.Sleep(pollInterval) {
+		if data, err = os.ReadFile(logFile); err != nil {
+			t.Fatal(err)
+		}
+		if strings.Contains(string(data), helperErrLine) {
+			break
+		}
+	}
+	if want := "previous run\n" + helperLogLine + "\n" + helperErrLine + "\n"; string(data) != want {
+		t.Errorf("log file contents = %q, want %q", data, want)
+	}
+	if err := p.Terminate(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestWithWorkingDir_detached(t *testing.T) {
+	dir := t.TempDir()
+	workDir, err := filepath.EvalSymlinks(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	pidFile := filepath.Join(dir, "helper.pid")
+	startHelper(t, helperConfig{PIDFile: pidFile}, &workDirHelper{Dir: workDir})
+
+	p, err := New(WithPIDFile(pidFile))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var cwd string
+	for deadline := time.Now().Add(10 * time.Second); time.Now().Before(deadline); time.Sleep(pollInterval) {
+		pi, err := p.Info()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if cwd = pi.Meta["cwd"]; cwd != "" {
+			break
+		}
+	}
+	if cwd != workDir {
+		t.Errorf("working directory = %q, want %q", cwd, workDir)
+	}
+	if err := p.Terminate(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// instanceHelper sets the instance name of the helper.
+type instanceHelper struct{ Name string }
+
+func (f *instanceHelper) apply(h *helper) error {
+	h.opts = append(h.opts, WithInstanceName(f.Name))
+	return nil
+}
+
+func TestWithInstanceName_detached(t *testing.T) {
+	dir := t.TempDir()
+	exe, err := os.Executable()
+	if err != nil {
+		t.Fatal(err)
+	}
+	names := []string{"a", "b"}
+	// the instances are started concurrently, with the PID files inferred
+	// from the executable in the working directory.
+	errc := make(chan error, len(names))
+	for _, name := range names {
+		cmd := helperCommand(t, helperConfig{}, &instanceHelper{Name: name})
+		cmd.Dir = dir
+		go func() {
+			out, err := cmd.CombinedOutput()
+			if err != nil {
+				err = fmt.Errorf("%s: %s", err, out)
+			}
+			errc <- err
+		}()
+	}
+	for range names {
+		if err := <-errc; err != nil {
+			t.Fatalf("helper failed: %s", err)
+		}
+	}
+	var (
+		procs []*Process
+		pids  = make(map[int]bool)
+	)
+	for _, name := range names {
+		pidFile := filepath.Join(dir, instancePIDFile(pidFromExe(exe), name))
+		t.Cleanup(func() {
+			if pid, err := readPID(pidFile); err == nil {
+				if p, err := os.FindProcess(pid); err == nil {
+					_ = p.Kill()
+				}
+			}
+		})
+		p, err := New(WithPIDFile(pidFile), WithInstanceName(name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if running, err := p.IsRunning(); err != nil || !running {
+			t.Fatalf("instance %s: IsRunning() = %v, %v, want true, nil", name, running, err)
+		}
+		pid, err := p.PID()
+		if err != nil {
+			t.Fatal(err)
+		}
+		pids[pid] = true
+		procs = append(procs, p)
+	}
+	if len(pids) != len(names) {
+		t.Errorf("instances share the process: %v", pids)
+	}
+	// terminating one instance leaves the other running.
+	a, b := procs[0], procs[1]
+	if err := a.Terminate(); err != nil {
+		t.Fatal(err)
+	}
+	if err := waitExit(a.pidFile, 5*time.Second); err != nil {
+		t.Fatal(err)
+	}
+	if running, err := b.IsRunning(); err != nil || !running {
+		t.Errorf("instance b: IsRunning() = %v, %v, want true, nil", running, err)
+	}
+	if err := b.Terminate(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// listenHelper makes the detached helper serve the listener, inherited from
+// its predecessor, or a new one, and register it with InheritListener.  The
+// listener responds with the PID of the helper, its address is stored in the
+// "listen" metadata key.
+type listenHelper struct{}
+
+func (f *listenHelper) apply(h *helper) error {
+	h.running = append(h.running, serveInherited)
+	return nil
+}
+
+// serveInherited serves the first listener inherited from the predecessor,
+// or a new one, responding with the PID of the process, and registers it
+// with InheritListener.  The address is stored in the "listen" metadata key.
+func serveInherited(p *Process) error {
+	var ln net.Listener
+	if lns := p.Listeners(); len(lns) > 0 {
+		ln = lns[0]
+	} else {
+		var err error
+		if ln, err = net.Listen("tcp", "127.0.0.1:0"); err != nil {
+			return err
+		}
+	}
+	if err := p.InheritListener(ln); err != nil {
+		return err
+	}
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			fmt.Fprintln(conn, os.Getpid())
+			conn.Close()
+		}
+	}()
+	return addMeta(p, "listen", ln.Addr().String())
+}
+
+func TestProcess_Restart(t *testing.T) {
+	t.Run("running", func(t *testing.T) {
+		pidFile := filepath.Join(t.TempDir(), "helper.pid")
+		startHelper(t, helperConfig{PIDFile: pidFile})
+		oldPID, err := readPID(pidFile)
+		if err != nil {
+			t.Fatal(err)
+		}
+		startHelper(t, helperConfig{PIDFile: pidFile, Restart: true})
+
+		p, err := New(WithPIDFile(pidFile))
+		if err != nil {
+			t.Fatal(err)
+		}
+		pid, err := p.PID()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if pid == oldPID {
+			t.Errorf("PID = %d, want a new process", pid)
+		}
+		if running, err := p.IsRunning(); err != nil || !running {
+			t.Errorf("IsRunning() = %v, %v, want true, nil", running, err)
+		}
+		if err := p.Terminate(); err != nil {
+			t.Fatal(err)
+		}
+	})
+	t.Run("not running", func(t *testing.T) {
+		pidFile := filepath.Join(t.TempDir(), "helper.pid")
+		startHelper(t, helperConfig{PIDFile: pidFile, Restart: true})
+
+		p, err := New(WithPIDFile(pidFile))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if running, err := p.IsRunning(); err != nil || !running {
+			t.Errorf("IsRunning() = %v, %v, want true, nil", running, err)
+		}
+		if err := p.Terminate(); err != nil {
+			t.Fatal(err)
+		}
+	})
+	t.Run("listener handoff", func(t *testing.T) {
+		dir := t.TempDir()
+		pidFile := filepath.Join(dir, "helper.pid")
+		exitLog := filepath.Join(dir, "exit.log")
+		startHelper(t, helperConfig{PIDFile: pidFile, ExitLog: exitLog, ControlToken: "secret"}, &listenHelper{})
+		p, err := New(WithPIDFile(pidFile), WithControlToken("secret"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		oldPID, addr := waitListen(t, p, 0)
+		if pid := dialPID(t, addr); pid != oldPID {
+			t.Fatalf("listener PID = %d, want %d", pid, oldPID)
+		}
+		startHelper(t, helperConfig{PIDFile: pidFile, Restart: true, ControlToken: "secret"}, &listenHelper{})
+
+		pid, newAddr := waitListen(t, p, oldPID)
+		if newAddr != addr {
+			t.Errorf("listener address = %q, want %q", newAddr, addr)
+		}
+		// the old process exits on its own, once the new one is ready.
+		for deadline := time.Now().Add(10 * time.Second); ; time.Sleep(pollInterval) {
+			if data, _ := os.ReadFile(exitLog); string(data) == "exit\n" {
+				break
+			}
+			if time.Now().After(deadline) {
+				t.Fatal("old process did not exit")
+			}
+		}
+		for deadline := time.Now().Add(10 * time.Second); dialPID(t, addr) != pid; time.Sleep(pollInterval) {
+			if time.Now().After(deadline) {
+				t.Fatalf("listener is not served by the new process %d", pid)
+			}
+		}
+		if err := p.Terminate(); err != nil {
+			t.Fatal(err)
+		}
+	})
+	t.Run("old process does not exit", func(t *testing.T) {
+		pidFile := filepath.Join(t.TempDir(), "helper.pid")
+		startHelper(t, helperConfig{PIDFile: pidFile, HangOnExit: true})
+
+		cmd := helperCommand(t, helperConfig{PIDFile: pidFile, Restart: true, StartTimeout: 200 * time.Millisecond})
+		out, err := cmd.CombinedOutput()
+		if err == nil {
+			t.Error("restart expected to fail")
+		}
+		if !strings.Contains(string(out), ErrStopTimeout.Error()) {
+			t.Errorf("helper output = %q, want %q", out, ErrStopTimeout)
+		}
+	})
+}
+
+// waitListen waits for the helper process, other than the one with oldPID,
+// to store the listener address in the PID file, and returns its PID and the
+// address.
+func waitListen(t *testing.T, p *Process, oldPID int) (int, string) {
+	t.Helper()
+	for deadline := time.Now().Add(10 * time.Second); time.Now().Before(deadline); time.Sleep(pollInterval) {
+		pi, err := p.Info()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if pi.PID != oldPID && pi.Meta["listen"] != "" {
+			return pi.PID, pi.Meta["listen"]
+		}
+	}
+	t.Fatal("listener address is not in the PID file")
+	return 0, ""
+}
+
+// dialPID connects to the helper listener at addr, and returns the PID it
+// responds with.
+func dialPID(t *testing.T, addr string) int {
+	t.Helper()
+	conn, err := net.DialTimeout("tcp", addr, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	var pid int
+	if _, err := fmt.Fscan(conn, &pid); err != nil {
+		t.Fatal(err)
+	}
+	return pid
+}
+
+func TestProcess_Shutdown(t *testing.T) {
+	t.Run("graceful", func(t *testing.T) {
+		pidFile := filepath.Join(t.TempDir(), "helper.pid")
+		startHelper(t, helperConfig{PIDFile: pidFile})
+
+		p, err := New(WithPIDFile(pidFile))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := p.Shutdown(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := os.Stat(pidFile); !os.IsNotExist(err) {
+			t.Errorf("PID file was not removed: %v", err)
+		}
+	})
+	t.Run("timeout", func(t *testing.T) {
+		pidFile := filepath.Join(t.TempDir(), "helper.pid")
+		startHelper(t, helperConfig{PIDFile: pidFile, HangOnExit: true})
+
+		p, err := New(WithPIDFile(pidFile))
+		if err != nil {
+			t.Fatal(err)
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+		defer cancel()
+		if err := p.Shutdown(ctx); !errors.Is(err, ErrStopTimeout) {
+			t.Errorf("Shutdown() error = %v, want %v", err, ErrStopTimeout)
+		}
+		if running, err := p.IsRunning(); err != nil || !running {
+			t.Errorf("IsRunning() = %v, %v, want true, nil", running, err)
+		}
+	})
+	t.Run("force kill", func(t *testing.T) {
+		pidFile := filepath.Join(t.TempDir(), "helper.pid")
+		startHelper(t, helperConfig{PIDFile: pidFile, HangOnExit: true})
+
+		p, err := New(WithPIDFile(pidFile), WithForceKill(true))
+		if err != nil {
+			t.Fatal(err)
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+		defer cancel()
+		if err := p.Shutdown(ctx); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := os.Stat(pidFile); !os.IsNotExist(err) {
+			t.Errorf("PID file was not removed: %v", err)
+		}
+	})
+	t.Run("already stopped", func(t *testing.T) {
+		pidFile := filepath.Join(t.TempDir(), "helper.pid")
+		p, err := New(WithPIDFile(pidFile))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := p.Shutdown(context.Background()); !errors.Is(err, ErrNotRunning) {
+			t.Errorf("Shutdown() error = %v, want %v", err, ErrNotRunning)
+		}
+	})
+}
+
+// notifyHelper makes the helper send the readiness notification to the
+// listener at Addr, with the notify failure policy.
+type notifyHelper struct {
+	Addr   string
+	Policy NotifyFailurePolicy
+}
+
+func (f *notifyHelper) apply(h *helper) error {
+	h.opts = append(h.opts, WithNotifyAddr(f.Addr), WithNotifyFailurePolicy(f.Policy))
+	return nil
+}
+
+func TestWithNotifyAddr(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	got := make(chan string, 1)
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		msg, err := readFrame(conn)
+		if err != nil {
+			return
+		}
+		got <- string(msg)
+	}()
+
+	pidFile := filepath.Join(t.TempDir(), "helper.pid")
+	startHelper(t, helperConfig{PIDFile: pidFile}, &notifyHelper{Addr: ln.Addr().String()})
+	select {
+	case msg := <-got:
+		if msg != "ok" {
+			t.Errorf("notification = %q, want %q", msg, "ok")
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("notification was not received")
+	}
+
+	p, err := New(WithPIDFile(pidFile))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := p.Terminate(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestWithNotifyTarget(t *testing.T) {
+	if _, err := New(WithPIDFile("test.pid"), WithNotifyTarget(os.Getpid())); err != nil {
+		t.Errorf("New() error = %v", err)
+	}
+	// the process that has exited.
+	cmd := exec.Command(os.Args[0], "-test.run=^$")
+	if err := cmd.Run(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := New(WithPIDFile("test.pid"), WithNotifyTarget(cmd.Process.Pid)); err == nil {
+		t.Error("New() expected an error for the missing process")
+	}
+	if _, err := New(WithPIDFile("test.pid"), WithNotifyAddr("localhost")); err == nil {
+		t.Error("New() expected an error for the address without port")
+	}
+}
+
+// argsHelper sets the arguments of the detached helper, and strips Drop from
+// them in each stage with WithArgFilter.  The detached helper stores its
+// arguments in the "args" metadata key.
+type argsHelper struct {
+	Args []string
+	Drop string
+}
+
+func (f *argsHelper) apply(h *helper) error {
+	h.opts = append(h.opts, WithArgs(f.Args), WithArgFilter(func(args []string) []string {
+		var filtered []string
+		for _, arg := range args {
+			if arg != f.Drop {
+				filtered = append(filtered, arg)
+			}
+		}
+		return filtered
+	}))
+	h.running = append(h.running, func(p *Process) error {
+		return addMeta(p, "args", strings.Join(os.Args[1:], " "))
+	})
+	return nil
+}
+
+func TestWithArgs(t *testing.T) {
+	pidFile := filepath.Join(t.TempDir(), "helper.pid")
+	args := []string{"-test.run=^$", "-test.count=1"}
+	// the filter strips the control flag in each stage.
+	startHelper(t, helperConfig{PIDFile: pidFile}, &argsHelper{Args: append(args, "-test.v"), Drop: "-test.v"})
+
+	p, err := New(WithPIDFile(pidFile))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got string
+	for deadline := time.Now().Add(10 * time.Second); time.Now().Before(deadline); time.Sleep(pollInterval) {
+		pi, err := p.Info()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got = pi.Meta["args"]; got != "" {
+			break
+		}
+	}
+	if want := strings.Join(args, " "); got != want {
+		t.Errorf("detached process args = %q, want %q", got, want)
+	}
+	if err := p.Terminate(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// executableHelper sets the executable of the detached helper, it stores the
+// path it was started with in the "exe" metadata key.
+type executableHelper struct{ Path string }
+
+func (f *executableHelper) apply(h *helper) error {
+	h.opts = append(h.opts, WithExecutable(f.Path))
+	h.running = append(h.running, func(p *Process) error {
+		return addMeta(p, "exe", os.Args[0])
+	})
+	return nil
+}
+
+func TestWithExecutable(t *testing.T) {
+	t.Run("symlink", func(t *testing.T) {
+		dir := t.TempDir()
+		pidFile := filepath.Join(dir, "helper.pid")
+		// the symlink is not followed, the detached process is started
+		// with its path.
+		link := filepath.Join(dir, "wrapped")
+		if err := os.Symlink(os.Args[0], link); err != nil {
+			t.Fatal(err)
+		}
+		startHelper(t, helperConfig{PIDFile: pidFile}, &executableHelper{Path: link})
+
+		p, err := New(WithPIDFile(pidFile))
+		if err != nil {
+			t.Fatal(err)
+		}
+		var got string
+		for deadline := time.Now().Add(10 * time.Second); time.Now().Before(deadline); time.Sleep(pollInterval) {
+			pi, err := p.Info()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got = pi.Meta["exe"]; got != "" {
+				break
+			}
+		}
+		if got != link {
+			t.Errorf("detached process executable = %q, want %q", got, link)
+		}
+		if err := p.Terminate(); err != nil {
+			t.Fatal(err)
+		}
+	})
+	t.Run("missing", func(t *testing.T) {
+		dir := t.TempDir()
+		pidFile := filepath.Join(dir, "helper.pid")
+		cmd := helperCommand(t, helperConfig{PIDFile: pidFile}, &executableHelper{Path: filepath.Join(dir, "missing")})
+		out, err := cmd.CombinedOutput()
+		if err == nil {
+			t.Fatal("helper expected to fail")
+		}
+		if !strings.Contains(string(out), "failed to initialise the process") {
+			t.Errorf("helper output = %q, want the start error", out)
+		}
+		if _, err := os.Stat(pidFile); !os.IsNotExist(err) {
+			t.Errorf("PID file exists: %v", err)
+		}
+	})
+	t.Run("PID file", func(t *testing.T) {
+		p, err := New(WithExecutable("/usr/local/bin/proggy"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if p.pidFile != "proggy.pid" {
+			t.Errorf("PID file = %q, want %q", p.pidFile, "proggy.pid")
+		}
+	})
+	t.Run("symlinked PID file", func(t *testing.T) {
+		dir := t.TempDir()
+		exe := filepath.Join(dir, "proggy")
+		if err := os.WriteFile(exe, nil, 0755); err != nil {
+			t.Fatal(err)
+		}
+		// the second link points to the first one.
+		links := []string{filepath.Join(dir, "alias"), filepath.Join(dir, "other alias")}
+		if err := os.Symlink(exe, links[0]); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Symlink(links[0], links[1]); err != nil {
+			t.Fatal(err)
+		}
+		for _, path := range append([]string{exe}, links...) {
+			p, err := New(WithExecutable(path))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if p.pidFile != "proggy.pid" {
+				t.Errorf("PID file for %q = %q, want %q", filepath.Base(path), p.pidFile, "proggy.pid")
+			}
+			// the detached process is still started through the link.
+			if got, err := p.image(); err != nil || got != path {
+				t.Errorf("image() = %q, %v, want %q", got, err, path)
+			}
+		}
+	})
+}
+
+func TestWithNotifyFailurePolicy(t *testing.T) {
+	// the listener is closed, so the notification fails.
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := ln.Addr().String()
+	ln.Close()
+
+	tests := []struct {
+		name        string
+		policy      NotifyFailurePolicy
+		wantLog     string
+		wantRunning bool
+	}{
+		{"continue", NotifyContinue, helperLogLine, true},
+		{"abort", NotifyAbort, ErrNotifyFailed.Error(), false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			pidFile := filepath.Join(dir, "helper.pid")
+			logFile := filepath.Join(dir, "helper.log")
+			startHelper(t, helperConfig{PIDFile: pidFile, LogFile: logFile}, &notifyHelper{Addr: addr, Policy: tt.policy})
+
+			var data []byte
+			for deadline := time.Now().Add(10 * time.Second); time.Now().Before(deadline); time.Sleep(pollInterval) {
+				data, _ = os.ReadFile(logFile)
+				if strings.Contains(string(data), tt.wantLog) {
+					break
+				}
+			}
+			if !strings.Contains(string(data), tt.wantLog) {
+				t.Fatalf("log = %q, want %q", data, tt.wantLog)
+			}
+			p, err := New(WithPIDFile(pidFile))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if running, err := p.IsRunning(); err != nil || running != tt.wantRunning {
+				t.Errorf("IsRunning() = %v, %v, want %v, nil", running, err, tt.wantRunning)
+			}
+			if !tt.wantRunning {
+				if _, err := os.Stat(pidFile); !os.IsNotExist(err) {
+					t.Errorf("PID file was not removed: %v", err)
+				}
+				return
+			}
+			if err := p.Terminate(); err != nil {
+				t.Fatal(err)
+			}
+		})
+	}
+}
+
+func TestProcess_TerminateTimeout(t *testing.T) {
+	tests := []struct {
+		name       string
+		hangOnExit bool
+	}{
+		{"graceful", false},
+		{"killed", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pidFile := filepath.Join(t.TempDir(), "helper.pid")
+			startHelper(t, helperConfig{PIDFile: pidFile, HangOnExit: tt.hangOnExit})
+
+			p, err := New(WithPIDFile(pidFile))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := p.TerminateTimeout(200 * time.Millisecond); err != nil {
+				t.Fatal(err)
+			}
+			if running, err := p.IsRunning(); err != nil || running {
+				t.Errorf("IsRunning() = %v, %v, want false, nil", running, err)
+			}
+			if _, err := os.Stat(pidFile); !os.IsNotExist(err) {
+				t.Errorf("PID file was not removed: %v", err)
+			}
+		})
+	}
+}
+
+func TestWithStdoutStderr(t *testing.T) {
+	tests := []struct {
+		name       string
+		stdout     string
+		stderr     string
+		wantStdout string
+		wantStderr string
+	}{
+		{
+			"separate files",
+			"out.log",
+			"err.log",
+			helperLogLine + "\n",
+			helperErrLine + "\n",
+		},
+		{
+			"same file",
+			"out.log",
+			"out.log",
+			helperLogLine + "\n" + helperErrLine + "\n",
+			helperLogLine + "\n" + helperErrLine + "\n",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			pidFile := filepath.Join(dir, "helper.pid")
+			stdout, stderr := filepath.Join(dir, tt.stdout), filepath.Join(dir, tt.stderr)
+			startHelper(t, helperConfig{PIDFile: pidFile}, &stdioHelper{Stdout: stdout, Stderr: stderr})
+
+			var gotStdout, gotStderr []byte
+			for deadline := time.Now().Add(10 * time.Second); time.Now().Before(deadline); time.Sleep(pollInterval) {
+				gotStdout, _ = os.ReadFile(stdout)
+				gotStderr, _ = os.ReadFile(stderr)
+				if string(gotStdout) == tt.wantStdout && string(gotStderr) == tt.wantStderr {
+					break
+				}
+			}
+			if string(gotStdout) != tt.wantStdout {
+				t.Errorf("stdout = %q, want %q", gotStdout, tt.wantStdout)
+			}
+			if string(gotStderr) != tt.wantStderr {
+				t.Errorf("stderr = %q, want %q", gotStderr, tt.wantStderr)
+			}
+			p, err := New(WithPIDFile(pidFile))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := p.Terminate(); err != nil {
+				t.Fatal(err)
+			}
+		})
+	}
+}
+
+func Test_terminate(t *testing.T) {
+	cmd := exec.Command("sleep", "30")
+	if err := cmd.Start(); err != nil {
+		t.Skipf("failed to start sleep: %s", err)
+	}
+	t.Cleanup(func() { _ = cmd.Process.Kill() })
+	done := make(chan error, 1)
+	go func() { done <- cmd.Wait() }()
+
+	pidFile := filepath.Join(t.TempDir(), "test.pid")
+	if err := writeInfo(pidFile, PIDInfo{PID: cmd.Process.Pid}, defaultPIDFileMode); err != nil {
+		t.Fatal(err)
+	}
+	if running, err := isRunning(pidFile); err != nil || !running {
+		t.Errorf("isRunning() = %v, %v, want true, nil", running, err)
+	}
+	if err := terminate(defaultLogger(), pidFile, ""); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case err := <-done:
+		var ee *exec.ExitError
+		if !errors.As(err, &ee) {
+			t.Fatalf("process exited with %v, want SIGTERM", err)
+		}
+		if ws, ok := ee.Sys().(syscall.WaitStatus); !ok || ws.Signal() != syscall.SIGTERM {
+			t.Errorf("process exited with %v, want SIGTERM", err)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("process did not receive SIGTERM")
+	}
+	// the process has exited, leaving the PID file behind.
+	p, err := New(WithPIDFile(pidFile))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if running, err := p.IsRunning(); err != nil || running {
+		t.Errorf("IsRunning() = %v, %v, want false, nil", running, err)
+	}
+	err = p.Terminate()
+	var stale *StalePIDError
+	if !errors.As(err, &stale) {
+		t.Fatalf("Terminate() error = %v, want StalePIDError", err)
+	}
+	if stale.PID != cmd.Process.Pid {
+		t.Errorf("StalePIDError.PID = %d, want %d", stale.PID, cmd.Process.Pid)
+	}
+	if !errors.Is(err, ErrNotRunning) {
+		t.Errorf("Terminate() error = %v, want it to match %v", err, ErrNotRunning)
+	}
+
+	missing := filepath.Join(t.TempDir(), "missing.pid")
+	if err := terminate(defaultLogger(), missing, ""); !errors.Is(err, ErrNotRunning) {
+		t.Errorf("terminate() error = %v, want %v", err, ErrNotRunning)
+	}
+	if running, err := isRunning(missing); err != nil || running {
+		t.Errorf("isRunning() = %v, %v, want false, nil", running, err)
+	}
+}
+
+func Test_enterStage(t *testing.T) {
+	dir := t.TempDir()
+	pidFile := filepath.Join(dir, "helper.pid")
+	stageLog := filepath.Join(dir, "stages.log")
+	startHelper(t, helperConfig{PIDFile: pidFile, StageLog: stageLog})
+
+	data, err := os.ReadFile(stageLog)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "INIT\nDETACH\nRUN\n"; string(data) != want {
+		t.Errorf("stages = %q, want %q", data, want)
+	}
+	p, err := New(WithPIDFile(pidFile))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := p.Terminate(); err != nil {
+		t.Fatal(err)
+	}
+}
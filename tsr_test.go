@@ -3,9 +3,14 @@
 package gotsr
 
 import (
+	"errors"
 	"os"
 	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
 	"testing"
+	"time"
 )
 
 func Test_readPID(t *testing.T) {
@@ -140,11 +145,31 @@ func Test_pidFromExe(t *testing.T) {
 			args{"/usr/local/bin/proggy"},
 			"proggy.pid",
 		},
-		//{
-		//	"win, with path",
-		//	args{"C:\\PROGRAM FILES\\SOME PROGRAM\\run.exe"},
-		//	"run.pid",
-		//},
+		{
+			"nix, with spaces",
+			args{"/opt/some program/run prog"},
+			"run prog.pid",
+		},
+		{
+			"win, with path",
+			args{"C:\\PROGRAM FILES\\SOME PROGRAM\\run.exe"},
+			"run.pid",
+		},
+		{
+			"win, with forward slashes",
+			args{"C:/Program Files/Some Program/run.exe"},
+			"run.pid",
+		},
+		{
+			"dots in the name",
+			args{"C:\\tools\\my.tool.exe"},
+			"my.tool.pid",
+		},
+		{
+			"nix, dots in the path",
+			args{"/opt/my.tools/proggy"},
+			"proggy.pid",
+		},
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
@@ -154,3 +179,548 @@ func Test_pidFromExe(t *testing.T) {
 		})
 	}
 }
+
+func TestWithInstanceName(t *testing.T) {
+	exe, err := os.Executable()
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name        string
+		opts        []Option
+		wantPIDFile string
+		wantErr     bool
+	}{
+		{"inferred", []Option{WithInstanceName("a")}, instancePIDFile(pidFromExe(exe), "a"), false},
+		{"explicit PID file", []Option{WithInstanceName("a"), WithPIDFile("test.pid")}, "test.pid", false},
+		{"separator", []Option{WithInstanceName("a/b")}, "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p, err := New(tt.opts...)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("New() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			if p.pidFile != tt.wantPIDFile {
+				t.Errorf("PID file = %q, want %q", p.pidFile, tt.wantPIDFile)
+			}
+		})
+	}
+	t.Run("environment variables", func(t *testing.T) {
+		a, err := New(WithPIDFile("test.pid"), WithInstanceName("a"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, err := New(WithPIDFile("test.pid"), WithInstanceName("b"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if a.vars() == b.vars() {
+			t.Errorf("instances share the environment variables: %s", a.vars().stage())
+		}
+	})
+}
+
+func TestWithName(t *testing.T) {
+	tests := []struct {
+		name        string
+		opts        []Option
+		wantPIDFile string
+		wantErr     bool
+	}{
+		{"inferred", []Option{WithName("foo")}, "foo.pid", false},
+		{"instance", []Option{WithName("foo"), WithInstanceName("a")}, "foo-a.pid", false},
+		{"explicit PID file", []Option{WithName("foo"), WithPIDFile("test.pid")}, "test.pid", false},
+		{"separator", []Option{WithName("foo/bar")}, "", true},
+		{"dot", []Option{WithName("..")}, "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p, err := New(tt.opts...)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("New() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			if p.pidFile != tt.wantPIDFile {
+				t.Errorf("PID file = %q, want %q", p.pidFile, tt.wantPIDFile)
+			}
+		})
+	}
+	t.Run("environment variables", func(t *testing.T) {
+		a, err := New(WithName("foo"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, err := New(WithName("bar"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if a.vars() == b.vars() {
+			t.Errorf("programs share the environment variables: %s", a.vars().stage())
+		}
+		// the variables do not depend on the PID file location.
+		c, err := New(WithName("foo"), WithPIDFile("/var/run/foo.pid"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if a.vars() != c.vars() {
+			t.Errorf("vars() = %s, want %s", c.vars(), a.vars())
+		}
+	})
+}
+
+func Test_instancePIDFile(t *testing.T) {
+	tests := []struct {
+		pidFile string
+		want    string
+	}{
+		{"responder.pid", "responder-a.pid"},
+		{"/var/run/responder.pid", "/var/run/responder-a.pid"},
+		{"responder", "responder-a"},
+	}
+	for _, tt := range tests {
+		if got := instancePIDFile(tt.pidFile, "a"); got != tt.want {
+			t.Errorf("instancePIDFile(%q) = %q, want %q", tt.pidFile, got, tt.want)
+		}
+	}
+}
+
+func TestProcess_childArgs(t *testing.T) {
+	args := []string{"-addr", ":6060", "-stop"}
+	drop := func(args []string) []string {
+		for i, arg := range args {
+			if arg == "-stop" {
+				return append(args[:i], args[i+1:]...)
+			}
+		}
+		return args
+	}
+	tests := []struct {
+		name string
+		opts []Option
+		want []string
+	}{
+		{"as is", []Option{WithArgs(args)}, args},
+		{"filtered", []Option{WithArgs(args), WithArgFilter(drop)}, []string{"-addr", ":6060"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p, err := New(append(tt.opts, WithPIDFile("test.pid"))...)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got := p.childArgs()
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("childArgs() = %q, want %q", got, tt.want)
+			}
+			// the filter is idempotent, and the arguments are not modified.
+			if got := p.childArgs(); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("second childArgs() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_newEnvVar(t *testing.T) {
+	paths := []string{"test.pid", "test.pi", "/var/run/test.pid", "/var/run/test2.pid", "responder-a.pid", "responder-b.pid"}
+	seen := make(map[envVar]string)
+	for _, path := range paths {
+		id := newEnvVar(path)
+		if other, ok := seen[id]; ok {
+			t.Errorf("newEnvVar(%q) = newEnvVar(%q) = %s", path, other, id)
+		}
+		seen[id] = path
+	}
+	t.Run("hash length", func(t *testing.T) {
+		defer func(n int) { EnvVarHashLen = n }(EnvVarHashLen)
+		for _, tt := range []struct {
+			n    int
+			want int
+		}{{12, 12}, {56, 56}, {0, 7}, {57, 7}} {
+			EnvVarHashLen = tt.n
+			if got := len(newEnvVar("test.pid")); got != tt.want {
+				t.Errorf("EnvVarHashLen = %d: len(newEnvVar()) = %d, want %d", tt.n, got, tt.want)
+			}
+		}
+	})
+}
+
+func TestProcess_stageEnv(t *testing.T) {
+	p, err := New(WithPIDFile("test.pid"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	vars := p.vars()
+	t.Setenv(vars.stage(), sRunning.String())
+	t.Setenv(vars.key(), p.envKey())
+	if got := p.stageEnv(); got != sRunning.String() {
+		t.Errorf("stageEnv() = %q, want %q", got, sRunning)
+	}
+	// the variables of another daemon with the colliding names.
+	t.Setenv(vars.key(), hash("other.pid"))
+	if got := p.stageEnv(); got != "" {
+		t.Errorf("stageEnv() = %q, want the launcher", got)
+	}
+	p.clearForeignEnv(nilLogger{})
+	for _, name := range vars.all() {
+		if v, ok := os.LookupEnv(name); ok {
+			t.Errorf("%s = %q, want unset", name, v)
+		}
+	}
+}
+
+func TestRunningUnderSupervisor(t *testing.T) {
+	if os.Getpid() == 1 || os.Getppid() == 1 {
+		t.Skip("the test runs under init")
+	}
+	tests := []struct {
+		name string
+		env  map[string]string
+		want bool
+	}{
+		{"none", nil, false},
+		{"systemd", map[string]string{"INVOCATION_ID": "0123456789abcdef"}, true},
+		{"socket activation", map[string]string{"LISTEN_PID": strconv.Itoa(os.Getpid())}, true},
+		{"socket activation of another process", map[string]string{"LISTEN_PID": "1"}, false},
+		{"launchd", map[string]string{"XPC_SERVICE_NAME": "com.example.daemon"}, true},
+		{"terminal session", map[string]string{"XPC_SERVICE_NAME": "0"}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for _, name := range []string{"INVOCATION_ID", "LISTEN_PID", "XPC_SERVICE_NAME"} {
+				t.Setenv(name, tt.env[name])
+			}
+			if got := RunningUnderSupervisor(); got != tt.want {
+				t.Errorf("RunningUnderSupervisor() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestWithSupervise(t *testing.T) {
+	tests := []struct {
+		name        string
+		backoff     time.Duration
+		wantBackoff time.Duration
+	}{
+		{"set", 2 * time.Second, 2 * time.Second},
+		{"zero", 0, minSuperviseBackoff},
+		{"too short", time.Millisecond, minSuperviseBackoff},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p, err := New(WithPIDFile("test.pid"), WithSupervise(3, tt.backoff))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if p.superviseMax != 3 || p.superviseBackoff != tt.wantBackoff {
+				t.Errorf("supervision = %d, %v, want 3, %v", p.superviseMax, p.superviseBackoff, tt.wantBackoff)
+			}
+		})
+	}
+}
+
+func TestProcess_EnvVars(t *testing.T) {
+	p, err := New(WithPIDFile("test.pid"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	vars := newEnvVar("test.pid")
+	want := []string{vars.stage(), vars.pid(), vars.addr(), vars.listeners(), vars.key(), vars.restarts(), vars.lastExit(), vars.exitCode(), vars.exitSignal()}
+	got := p.EnvVars()
+	if len(got) != len(want) {
+		t.Fatalf("EnvVars() = %v, want %v", got, want)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Errorf("EnvVars()[%d] = %v, want %v", i, got[i], want[i])
+		}
+	}
+}
+
+func TestProcess_childEnv(t *testing.T) {
+	t.Setenv("GOTSR_TEST_FLAG", "off")
+	p, err := New(WithPIDFile("test.pid"), WithEnv(map[string]string{
+		"GOTSR_TEST_FLAG":             "on",
+		"GOTSR_TEST_CONFIG":           "/etc/test.conf",
+		newEnvVar("test.pid").stage(): "bogus",
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := make(map[string]string)
+	for _, kv := range p.childEnv() {
+		// the last value is used, as in exec.Cmd.
+		k, v, _ := strings.Cut(kv, "=")
+		got[k] = v
+	}
+	if got["GOTSR_TEST_FLAG"] != "on" || got["GOTSR_TEST_CONFIG"] != "/etc/test.conf" {
+		t.Errorf("childEnv() = %v, want the variables set with WithEnv", got)
+	}
+	if v, ok := got[p.vars().stage()]; ok {
+		t.Errorf("childEnv() has the stage variable = %q", v)
+	}
+	if _, err := New(WithPIDFile("test.pid"), WithEnv(map[string]string{"A=B": "x"})); err == nil {
+		t.Error("New() expected an error for the invalid variable name")
+	}
+}
+
+func TestWithStartTimeout(t *testing.T) {
+	tests := []struct {
+		name string
+		d    time.Duration
+		want time.Duration
+	}{
+		{"set", 5 * time.Second, 5 * time.Second},
+		{"zero", 0, startTimeout},
+		{"negative", -time.Second, startTimeout},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for _, opt := range []func(time.Duration) Option{WithStartTimeout, WithTimeout} {
+				p, err := New(WithPIDFile("test.pid"), opt(tt.d))
+				if err != nil {
+					t.Fatal(err)
+				}
+				if p.startTimeout != tt.want {
+					t.Errorf("startTimeout = %v, want %v", p.startTimeout, tt.want)
+				}
+			}
+		})
+	}
+}
+
+func TestWithWorkingDir(t *testing.T) {
+	dir := t.TempDir()
+	t.Run("resolves paths", func(t *testing.T) {
+		p, err := New(WithPIDFile("test.pid"), WithLogFile("test.log"), WithWorkingDir(dir))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if p.workDir != dir {
+			t.Errorf("workDir = %q, want %q", p.workDir, dir)
+		}
+		if !filepath.IsAbs(p.pidFile) || !filepath.IsAbs(p.stdout) || !filepath.IsAbs(p.stderr) {
+			t.Errorf("paths are not absolute: pidFile = %q, stdout = %q, stderr = %q", p.pidFile, p.stdout, p.stderr)
+		}
+	})
+	t.Run("missing", func(t *testing.T) {
+		if _, err := New(WithPIDFile("test.pid"), WithWorkingDir(filepath.Join(dir, "missing"))); err == nil {
+			t.Error("New() expected an error")
+		}
+	})
+	t.Run("not a directory", func(t *testing.T) {
+		file := filepath.Join(dir, "file")
+		if err := os.WriteFile(file, nil, 0644); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := New(WithPIDFile("test.pid"), WithWorkingDir(file)); err == nil {
+			t.Error("New() expected an error")
+		}
+	})
+	t.Run("chdir root", func(t *testing.T) {
+		root, err := filepath.Abs(string(filepath.Separator))
+		if err != nil {
+			t.Fatal(err)
+		}
+		p, err := New(WithPIDFile("test.pid"), WithChdirRoot(true))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if p.workDir != root {
+			t.Errorf("workDir = %q, want %q", p.workDir, root)
+		}
+		if !filepath.IsAbs(p.pidFile) {
+			t.Errorf("pidFile = %q, want the absolute path", p.pidFile)
+		}
+		// the working directory takes precedence.
+		if p, err = New(WithPIDFile("test.pid"), WithChdirRoot(true), WithWorkingDir(dir)); err != nil {
+			t.Fatal(err)
+		}
+		if p.workDir != dir {
+			t.Errorf("workDir = %q, want %q", p.workDir, dir)
+		}
+	})
+}
+
+func TestProcess_AtExitGroup(t *testing.T) {
+	var (
+		p     Process
+		order []string
+	)
+	p.AtExit(func() { order = append(order, "plain") })
+	p.AtExitGroup("archive", 50*time.Millisecond, func() { time.Sleep(time.Second) })
+	p.AtExitGroup("metrics", time.Second, func() { order = append(order, "metrics") })
+	p.AtExitGroup("metrics", time.Minute, func() { order = append(order, "metrics 2") })
+
+	if len(p.atExit) != 3 {
+		t.Fatalf("got %d groups, want 3", len(p.atExit))
+	}
+	start := time.Now()
+	if !p.runAtExit() {
+		t.Error("runAtExit() = false, want true")
+	}
+	if elapsed := time.Since(start); elapsed > 500*time.Millisecond {
+		t.Errorf("runAtExit() took %s, the slow group was not bounded", elapsed)
+	}
+	want := []string{"plain", "metrics", "metrics 2"}
+	if !reflect.DeepEqual(order, want) {
+		t.Errorf("order = %v, want %v", order, want)
+	}
+}
+
+func TestWithShutdownTimeout_groups(t *testing.T) {
+	p, err := New(WithPIDFile("test.pid"), WithShutdownTimeout(50*time.Millisecond))
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.AtExitGroup("archive", time.Minute, func() { time.Sleep(time.Second) })
+	start := time.Now()
+	if p.runAtExit() {
+		t.Error("runAtExit() = true, want false")
+	}
+	if elapsed := time.Since(start); elapsed > 500*time.Millisecond {
+		t.Errorf("runAtExit() took %s, the shutdown timeout was not applied", elapsed)
+	}
+}
+
+func Test_writePID_atomic(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "test.pid")
+	if err := writePID(filename, defaultPIDFileMode, 1, "127.0.0.1:6060"); err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan struct{})
+	errc := make(chan error, 1)
+	go func() {
+		defer close(errc)
+		for i := 0; ; i++ {
+			select {
+			case <-done:
+				return
+			default:
+			}
+			if err := writePID(filename, defaultPIDFileMode, i+1, "127.0.0.1:6060", strings.Repeat("x", i%4096)); err != nil {
+				errc <- err
+				return
+			}
+		}
+	}()
+	deadline := time.Now().Add(500 * time.Millisecond)
+	for time.Now().Before(deadline) {
+		var addr string
+		pid, err := readPID(filename, &addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if pid == 0 || addr != "127.0.0.1:6060" {
+			t.Fatalf("partial read: pid = %d, addr = %q", pid, addr)
+		}
+	}
+	close(done)
+	if err := <-errc; err != nil {
+		t.Fatal(err)
+	}
+	matches, err := filepath.Glob(filename + ".*.tmp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(matches) != 0 {
+		t.Errorf("temporary files left behind: %v", matches)
+	}
+}
+
+func TestProcess_runReload(t *testing.T) {
+	errFailed := errors.New("failed")
+	tests := []struct {
+		name    string
+		results []error
+		wantErr error
+	}{
+		{"none", nil, nil},
+		{"ok", []error{nil, nil}, nil},
+		{"failed", []error{nil, errFailed, nil}, errFailed},
+		{"needs restart", []error{errFailed, ErrNeedsRestart, nil}, ErrNeedsRestart},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var p Process
+			var called []int
+			for i, res := range tt.results {
+				i, res := i, res
+				p.OnReload(func() error {
+					called = append(called, i)
+					return res
+				})
+			}
+			if err := p.runReload(); !errors.Is(err, tt.wantErr) {
+				t.Errorf("runReload() error = %v, want %v", err, tt.wantErr)
+			}
+			if len(called) != len(tt.results) {
+				t.Fatalf("called %d functions, want %d", len(called), len(tt.results))
+			}
+			for i, n := range called {
+				if n != i {
+					t.Errorf("called %v, want the order of registration", called)
+					break
+				}
+			}
+		})
+	}
+}
+
+func TestProcess_runReload_panic(t *testing.T) {
+	var p Process
+	var called bool
+	p.OnReload(func() error { panic("boom") })
+	p.OnReload(func() error { called = true; return nil })
+	err := p.runReload()
+	if err == nil || !strings.Contains(err.Error(), "boom") {
+		t.Errorf("runReload() error = %v, want the panic", err)
+	}
+	if !called {
+		t.Error("the function after the panicking one was not called")
+	}
+}
+
+func TestProcess_AtExitErr(t *testing.T) {
+	var (
+		order []int
+		errA  = errors.New("flush failed")
+		errB  = errors.New("remove failed")
+	)
+	w := &fakeInfoWriter{}
+	p, err := New(WithPIDFile("test.pid"), WithLogger(infoLogger{w: w}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.AtExit(func() { order = append(order, 0) })
+	p.AtExitErr(func() error { order = append(order, 1); return errA })
+	p.AtExitErr(func() error { order = append(order, 2); return nil })
+	p.AtExitErr(func() error { order = append(order, 3); return errB })
+
+	if !p.runAtExit() {
+		t.Error("runAtExit() = false, want true")
+	}
+	if want := []int{0, 3, 2, 1}; !reflect.DeepEqual(order, want) {
+		t.Errorf("order = %v, want %v", order, want)
+	}
+	if len(w.msgs) != 1 {
+		t.Fatalf("messages = %q, want one", w.msgs)
+	}
+	for _, err := range []error{errA, errB} {
+		if !strings.Contains(w.msgs[0], err.Error()) {
+			t.Errorf("message %q does not contain %q", w.msgs[0], err)
+		}
+	}
+
+	order = nil
+	err = p.runAtExitErr()
+	if !errors.Is(err, errA) || !errors.Is(err, errB) {
+		t.Errorf("runAtExitErr() error = %v, want both errors", err)
+	}
+}
@@ -1,29 +1,41 @@
 package gotsr
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"log"
 	"net"
 	"os"
 	"os/exec"
+	"os/signal"
 	"strconv"
+	"sync"
+	"syscall"
 	"time"
 )
 
+// listenNetwork is the network of the control listener, if it is not set
+// with WithControlNetwork.
+const listenNetwork = "tcp"
+
 var (
 	errInvalidStage = errors.New("invalid stage")
 )
 
-// addr returns an additional environment variable used only on Windows.
-// It is used to pass the addr number to the detached process.
-func (id envVar) addr() string {
-	return "TSR_" + string(id) + "__ADDR"
-}
-
 // tsr is the main function that starts the program in the detached mode.
-func tsr(pidFile string, timeout time.Duration, atExit ...func()) (bool, error) {
-	stg, err := summon(pidFile, timeout, atExit...)
+func tsr(ctx context.Context, p *Process) (bool, error) {
+	if p.serviceName != "" {
+		if isService, err := runService(p); err != nil || isService {
+			return isService, err
+		}
+	}
+	p.applyForegroundIf()
+	if p.foreground {
+		enterStage(sRunning)
+		return true, stageRun(stageLogger(p.logger(), sRunning), p, p.vars())
+	}
+	stg, err := summon(ctx, p)
 	return stg == sRunning, err
 }
 
@@ -39,105 +51,223 @@ func tsr(pidFile string, timeout time.Duration, atExit ...func()) (bool, error)
 //  3. Running: the program is running in the background.
 //
 // It identifies the current stage by reading the STAGE environment variable.
-func summon(pidFile string, timeout time.Duration, atExit ...func()) (stage, error) {
-	image, err := os.Executable()
+func summon(ctx context.Context, p *Process) (stage, error) {
+	image, err := p.image()
 	if err != nil {
 		return sUnknown, err
 	}
 
-	vars := newEnvVar(pidFile) // initialise environment variable base name from pidFile.
-	stage := os.Getenv(vars.stage())
+	vars := p.vars() // initialise environment variable base name from pidFile.
+	lg := p.logger()
+	stage := p.stageEnv()
 	switch stage {
 	default:
 		return sUnknown, errInvalidStage
 	case "": // initial setup and preparing for detachment
-		return sInitialise, stageInit(pidFile, vars, image, timeout)
+		p.clearForeignEnv(lg)
+		enterStage(sInitialise)
+		return sInitialise, stageInit(ctx, stageLogger(lg, sInitialise), p, vars, image)
 	// case sDetach.String(): // releasing handles, clean start
 	// 	return sDetach, stageDetach(vars, image)
 	case sRunning.String(): // running TSR program
-		return sRunning, stageRun(pidFile, vars, atExit)
+		enterStage(sRunning)
+		return sRunning, stageRun(stageLogger(lg, sRunning), p, vars)
 	}
 	// unreachable
 }
 
 // stageInit is the first stage that starts a new detached instance of the
 // program in a new session.
-func stageInit(pidFile string, vars envVar, image string, timeout time.Duration) error {
-	ln, err := net.Listen("tcp", "127.0.0.1:0")
+func stageInit(parent context.Context, lg Logger, p *Process, vars envVar, image string) error {
+	if err := checkPIDLock(p.pidFile); err != nil {
+		return err
+	}
+	if p.singleton != "" {
+		h, err := lockSingleton(p.singleton)
+		if err != nil {
+			return err
+		}
+		// the TSR process opens the mutex before reporting back, so it is
+		// held until the TSR process exits.
+		defer syscall.CloseHandle(h)
+	}
+	// the launcher listens while the TSR process is starting, so they can
+	// share only the port range.
+	var addr string
+	if isPortRange(p.controlAddr) {
+		addr = p.controlAddr
+	}
+	ln, err := controlListen(p.network, addr, p.pidFile, sInitialise)
 	if err != nil {
 		return err
 	}
+	ctx, cancel := startupContext(parent, p.startTimeout)
+	defer cancel()
 
 	os.Setenv(vars.stage(), sRunning.String())
 	os.Setenv(vars.pid(), strconv.Itoa(os.Getpid()))
+	os.Setenv(vars.key(), p.envKey())
 	os.Setenv(vars.addr(), ln.Addr().String())
 	log.Printf("listening on %s", ln.Addr().String())
 
-	cmd := exec.Command(image, os.Args[1:]...)
-	cmd.Env = os.Environ()
+	cmd := exec.Command(image, p.childArgs()...)
+	cmd.Env = p.childEnv()
 	cmd.Stderr = nil
 	cmd.Stdout = nil
 	cmd.Stdin = nil
 
 	if err := cmd.Start(); err != nil {
+		ln.Close()
 		return fmt.Errorf("failed to initialise the process: %s", err)
 	}
-	timer := time.After(timeout)
+	if p.hasNotifyTarget() {
+		// the readiness notification goes to the target.
+		ln.Close()
+		return nil
+	}
 	go func() {
-		<-timer
+		<-ctx.Done()
 		ln.Close()
 	}()
 
 	conn, err := ln.Accept()
 	if err != nil {
+		if ctx.Err() != nil && !startTimedOut(parent, ctx) {
+			if err := cmd.Process.Kill(); err != nil {
+				lg.Printf("failed to kill the process: %s", err)
+			}
+			_ = cmd.Wait()
+			abortStart(lg, p.pidFile)
+			return fmt.Errorf("start interrupted: %w", ctx.Err())
+		}
 		return err
 	}
-	conn.Close()
 	defer ln.Close()
+	// the TSR process sends the start error instead of the notification, if
+	// it fails to start.
+	if dl, ok := ctx.Deadline(); ok {
+		_ = conn.SetReadDeadline(dl)
+	}
+	resp, err := readFrame(conn)
+	conn.Close()
+	if err == nil {
+		if err := startError(string(resp)); err != nil {
+			return err
+		}
+	}
+	// there's no intermediate process on Windows, the launcher starts the
+	// TSR process itself.
+	p.startedPID = cmd.Process.Pid
 
-	pid, err := readPID(pidFile)
+	pid, err := readPID(p.pidFile)
 	if err != nil {
 		lg.Printf("process started, but PID file is missing: %s", err)
 	} else if pid == 0 {
 		lg.Println("warning: process started, but PID is 0")
 	} else {
-		lg.Printf("process started with PID: %d", pid)
+		withAttr(lg, "pid", pid).Printf("process started with PID: %d", pid)
 	}
 	return nil
 }
 
-// stageRun runs the main program.
-func stageRun(pidFile string, vars envVar, atExit []func()) error {
-	pid := os.Getpid()
-	ln, err := net.Listen("tcp", "127.0.0.1:0")
+// stageRun runs the main program.  If it fails, the detached process reports
+// the error to the parent.
+func stageRun(lg Logger, p *Process, vars envVar) (err error) {
+	// the service is started by the SCM, there's no parent holding the mutex
+	// or waiting for the notification.
+	detached := p.stageEnv() == sRunning.String()
+	if detached && !p.hasNotifyTarget() {
+		defer func() {
+			if err == nil {
+				return
+			}
+			if nerr := notifyError(p.network, os.Getenv(vars.addr()), err); nerr != nil {
+				lg.Printf("failed to report the error to the parent process: %s", nerr)
+			}
+		}()
+	}
+	if p.workDir != "" && !p.foreground {
+		if err := os.Chdir(p.workDir); err != nil {
+			return err
+		}
+	}
+	if err := redirectOutput(p.stdout, p.stderr); err != nil {
+		return err
+	}
+	if err := holdPIDLock(p.pidFile); err != nil {
+		return err
+	}
+	if p.singleton != "" {
+		if err := holdSingleton(p.singleton, detached); err != nil {
+			return err
+		}
+	}
+	ln, err := controlListen(p.network, p.controlAddr, p.pidFile, sRunning)
 	if err != nil {
 		return err
 	}
+	lg = withAttr(withAttr(lg, "pid", os.Getpid()), "addr", ln.Addr().String())
 
-	if err := writePID(pidFile, pid, ln.Addr().String()); err != nil {
+	if err := p.initSecret(); err != nil {
+		ln.Close()
 		return err
 	}
 
-	if err := notifySuccess(vars); err != nil {
-		lg.Printf("failed to notify the parent process: %s", err)
+	started := time.Now()
+	pi := PIDInfo{PID: os.Getpid(), StartedAt: started, Addr: ln.Addr().String(), Network: p.network, Control: p.controlMode, Meta: p.meta, Args: os.Args, TokenHash: hashToken(p.controlToken), Secret: p.controlSecret}
+	if err := p.writePIDFile(pi); err != nil {
+		ln.Close()
+		return err
+	}
+	p.stopStatus = p.startStatus(started, ln.Addr().String())
+
+	if detached || p.hasNotifyTarget() {
+		if err := notifySuccess(p, vars); err != nil {
+			if p.notifyPolicy == NotifyAbort {
+				ln.Close()
+				p.stopStatus()
+				os.Remove(p.pidFile)
+				return fmt.Errorf("%w: %s", ErrNotifyFailed, err)
+			}
+			lg.Printf("failed to notify the parent process: %s", err)
+		}
 	}
 	// unset the environment variables once the program is running.
-	for _, envVar := range []string{vars.stage(), vars.pid(), vars.addr()} {
+	for _, envVar := range vars.all() {
 		if err := os.Unsetenv(envVar); err != nil {
 			lg.Printf("failed to unset environment variable %s: %s", envVar, err)
 		}
 	}
 
 	quit := make(chan struct{})
+	var once sync.Once
+	stop := func() { once.Do(func() { close(quit) }) }
 	go func() {
 		<-quit
-		for _, fn := range atExit {
-			fn()
+		code := 0
+		if !p.runAtExit() {
+			lg.Printf("AtExit functions did not complete in %s, exiting", p.shutdownTimeout)
+			code = 1
 		}
+		p.stopStatus()
 		ln.Close()
-		os.Remove(pidFile)
-		os.Exit(0)
+		// the lock is released before the PID file is removed, so that the
+		// process can be started again, once the PID file is gone.
+		releasePIDLock()
+		if !p.keepPIDFile {
+			os.Remove(p.pidFile)
+		}
+		os.Exit(code)
 	}()
+	if p.foreground {
+		// Ctrl-C terminates the program running in the foreground.
+		sig := make(chan os.Signal, 1)
+		signal.Notify(sig, os.Interrupt)
+		go func() {
+			<-sig
+			stop()
+		}()
+	}
 
 	// listener:
 	go func() {
@@ -146,104 +276,167 @@ func stageRun(pidFile string, vars envVar, atExit []func()) error {
 			if err != nil {
 				return
 			}
-			go func() {
-				defer conn.Close()
-				buf := make([]byte, 2)
-				if _, err := conn.Read(buf); err != nil {
-					return
-				}
-				if string(buf) == "ok" {
-					conn.Write([]byte("ok"))
-				}
-				if string(buf) == "ex" {
-					conn.Write([]byte("ok"))
-					close(quit)
-				}
-			}()
+			go serveControl(lg, p, conn, started, stop)
 		}
 	}()
 
 	return nil
 }
 
-// notifySuccess notifies the parent process that the program has started.
-func notifySuccess(vars envVar) error {
+// serveControl handles the control command received over conn, started is
+// the start time of the process.  stop is called on the exit command.  The
+// response to the legacy command is sent without the frame.
+func serveControl(lg Logger, p *Process, conn net.Conn, started time.Time, stop func()) {
+	defer conn.Close()
+	cmd, legacy, err := p.readAuthorised(lg, conn)
+	if err != nil {
+		return
+	}
+	reply := func(resp string) {
+		if legacy {
+			err = writeFull(conn, []byte(resp))
+		} else {
+			err = writeFrame(conn, []byte(resp))
+		}
+		if err != nil {
+			lg.Printf("failed to respond to %q: %s", cmd, err)
+		}
+	}
+	switch cmd {
+	case cmdOK:
+		reply(cmdOK)
+	case cmdFDStats:
+		stats, err := fdStats()
+		if err != nil {
+			lg.Printf("failed to get the fd stats: %s", err)
+			return
+		}
+		if legacy {
+			stats += "\n"
+		}
+		reply(cmdOK + stats)
+	case cmdStatus:
+		resp, err := statusResponse(started, conn.LocalAddr().String())
+		if err != nil {
+			lg.Printf("failed to get the status: %s", err)
+			return
+		}
+		reply(resp)
+	case cmdApply:
+		reply(p.applyResponse())
+	case cmdReady:
+		reply(p.readyResponse())
+	case cmdReload:
+		reply(p.reloadResponse())
+	case cmdHealth:
+		reply(p.healthResponse())
+	case cmdHandoff:
+		// the listeners can't be passed on, the process is restarted.
+		reply(respNoHandoff)
+	case cmdExit:
+		reply(cmdOK)
+		stop()
+	default:
+		if !legacy {
+			reply(respUnknownCommand + cmd)
+		}
+	}
+}
+
+// notifySuccess notifies the parent process, or the notify target, that the
+// program has started.
+func notifySuccess(p *Process, vars envVar) error {
+	if p.notifyAddr != "" {
+		return notifyAddr(p.network, p.notifyAddr)
+	}
 	sAddr := os.Getenv(vars.addr())
 	if sAddr == "" {
 		return errors.New("missing address")
 	}
-	conn, err := net.Dial("tcp", sAddr)
+	return notifyAddr(p.network, sAddr)
+}
+
+// validateNotifyTarget returns ErrNotSupported, as there are no signals to
+// notify the process with on Windows.
+func validateNotifyTarget(pid int) error {
+	return ErrNotSupported
+}
+
+// reload sends the reload command to the TSR process, and returns the error of
+// the reload.
+func reload(pidFile, token string) error {
+	pi, err := readInfo(pidFile)
 	if err != nil {
+		if os.IsNotExist(err) {
+			return ErrNotRunning
+		}
 		return err
 	}
-	defer conn.Close()
-	if _, err := conn.Write([]byte("ok")); err != nil {
+	return reloadControl(pi, token)
+}
+
+// signalProcess translates the signal to the control command of the TSR
+// process, as the signals can't be sent to the other processes on Windows.
+func signalProcess(lg Logger, pidFile, token string, sig os.Signal) error {
+	switch sig {
+	case os.Interrupt, syscall.SIGTERM:
+		return terminate(lg, pidFile, token)
+	case syscall.SIGHUP:
+		return reload(pidFile, token)
+	case os.Kill:
+		_, err := kill(pidFile)
 		return err
+	default:
+		return fmt.Errorf("signal %v: %w", sig, ErrNotSupported)
 	}
-	return nil
 }
 
 // isRunning checks if the process with the given PID is running.
 func isRunning(pidFile string) (bool, error) {
-	var pAddr string
-	pid, err := readPID(pidFile, &pAddr)
+	pi, err := readInfo(pidFile)
 	if err != nil {
 		if os.IsNotExist(err) {
 			return false, nil
 		}
 		return false, err
-	} else if pid == 0 {
+	} else if pi.PID == 0 {
 		return false, ErrNoPID
 	}
-	if pAddr == "" {
-		return false, errors.New("invalid pidfile:  missing address")
-	}
-	conn, err := net.Dial("tcp", pAddr)
+	return pingControl(pi)
+}
+
+// waitKilled waits for the killed process with the given PID to exit.  It
+// returns ErrStopTimeout, if the process is still running after the timeout.
+func waitKilled(pid int, timeout time.Duration) error {
+	h, err := syscall.OpenProcess(syscall.SYNCHRONIZE, false, uint32(pid))
 	if err != nil {
-		return false, nil
-	}
-	defer conn.Close()
-	if _, err := conn.Write([]byte("ok")); err != nil {
-		return false, nil
+		// the process has exited, and its handles are closed.
+		return nil
 	}
-	buf := make([]byte, 2)
-	if _, err := conn.Read(buf); err != nil {
-		return false, err
+	defer syscall.CloseHandle(h)
+	ev, err := syscall.WaitForSingleObject(h, uint32(timeout.Milliseconds()))
+	if err != nil {
+		return err
 	}
-	if string(buf) != "ok" {
-		return false, errors.New("invalid response")
+	if ev == syscall.WAIT_TIMEOUT {
+		return ErrStopTimeout
 	}
-	return true, nil
+	return nil
 }
 
-// terminate sends a SIGTERM signal to the process with the given PID.
-func terminate(pidFile string) error {
-	var pAddr string
-	pid, err := readPID(pidFile, &pAddr)
+// terminate sends the exit command with the control token to the process, and
+// logs the termination with lg.
+func terminate(lg Logger, pidFile, token string) error {
+	pi, err := readInfo(pidFile)
 	if err != nil {
 		if os.IsNotExist(err) {
 			return ErrNotRunning
 		}
 		return err
 	}
-	if pAddr == "" {
-		return errors.New("invalid pidfile:  missing address")
-	}
-	conn, err := net.Dial("tcp", pAddr)
-	if err != nil {
-		return err
-	}
-	defer conn.Close()
-	if _, err := conn.Write([]byte("ex")); err != nil {
+	if err := exitControl(pi, token); err != nil {
 		return err
 	}
-	buf := make([]byte, 2)
-	if _, err := conn.Read(buf); err != nil {
-		return err
-	}
-	if string(buf) != "ok" {
-		return errors.New("invalid response")
-	}
-	lg.Printf("process %d terminated", pid)
+	lg.Printf("process %d terminated", pi.PID)
 	return nil
 }
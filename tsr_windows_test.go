@@ -1,29 +1,88 @@
 package gotsr
 
 import (
+	"context"
+	"io"
+	"net"
+	"path/filepath"
 	"testing"
 	"time"
 )
 
 func Test_stageInit(t *testing.T) {
+	dir := t.TempDir()
 	type args struct {
-		pidFile string
-		vars    envVar
-		image   string
-		timeout time.Duration
+		p     *Process
+		vars  envVar
+		image string
 	}
 	tests := []struct {
 		name    string
 		args    args
 		wantErr bool
 	}{
-		// TODO: Add test cases.
+		{
+			"missing executable",
+			args{
+				p:     &Process{pidFile: filepath.Join(dir, "test.pid"), network: defaultNetwork, startTimeout: startTimeout},
+				vars:  newEnvVar("test.pid"),
+				image: filepath.Join(dir, "missing.exe"),
+			},
+			true,
+		},
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			if err := stageInit(tt.args.pidFile, tt.args.vars, tt.args.image, tt.args.timeout); (err != nil) != tt.wantErr {
+			if err := stageInit(context.Background(), defaultLogger(), tt.args.p, tt.args.vars, tt.args.image); (err != nil) != tt.wantErr {
 				t.Errorf("stageInit() error = %v, wantErr %v", err, tt.wantErr)
 			}
 		})
 	}
 }
+
+func TestServeControl_legacy(t *testing.T) {
+	// the older clients send the two byte commands without the frame, and
+	// read the two byte response.
+	tests := []struct {
+		name     string
+		p        *Process
+		cmd      string
+		wantResp string
+		wantStop bool
+	}{
+		{"ping", &Process{}, cmdOK, cmdOK, false},
+		{"exit", &Process{}, cmdExit, cmdOK, true},
+		{"secret", &Process{controlSecret: "0123456789abcdef"}, cmdExit, "", false},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			client, server := net.Pipe()
+			defer client.Close()
+			stopped := make(chan struct{})
+			done := make(chan struct{})
+			go func() {
+				defer close(done)
+				serveControl(defaultLogger(), tt.p, server, time.Now(), func() { close(stopped) })
+			}()
+			if _, err := client.Write([]byte(tt.cmd)); err != nil {
+				t.Fatal(err)
+			}
+			resp, _ := io.ReadAll(client)
+			<-done
+			if string(resp) != tt.wantResp {
+				t.Errorf("response to %q = %q, want %q", tt.cmd, resp, tt.wantResp)
+			}
+			select {
+			case <-stopped:
+				if !tt.wantStop {
+					t.Error("process was stopped")
+				}
+			default:
+				if tt.wantStop {
+					t.Error("process was not stopped")
+				}
+			}
+		})
+	}
+}